@@ -2,18 +2,32 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"umami/pkg/apps"
+	"umami/pkg/auth"
+	"umami/pkg/claude"
+	"umami/pkg/config"
 	"umami/pkg/db"
+	"umami/pkg/health"
+	"umami/pkg/metrics"
 	"umami/pkg/pubsub"
+	"umami/pkg/quota"
 	"umami/pkg/routes"
+	"umami/pkg/secrets"
 	"umami/pkg/storage"
-
-	"github.com/gorilla/websocket"
+	"umami/pkg/tracing"
+	"umami/pkg/webhooks"
 )
 
-var upgrader = websocket.Upgrader{}
+// shutdownTimeout bounds finishing the requests in flight, and then sending the remaining
+// spans, when the control plane is stopped
+const shutdownTimeout = 10 * time.Second
 
 func main() {
 	// Start Server that receives execute task signal
@@ -31,58 +45,164 @@ func main() {
 	// 4. Checkpoint in git
 	// 5. Push to repo
 
+	cfg, printOnly, err := config.Load("control_plane", os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration %s", err)
+	}
+	if printOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+	dirs := apps.Dirs{Repositories: cfg.Paths.Repositories, Logs: cfg.Paths.Logs}
+
 	ctx := context.Background()
 
+	shutdownTracing, err := tracing.Setup(ctx, "control_plane", cfg.Tracing.Exporter, cfg.Tracing.Endpoint)
+	if err != nil {
+		log.Fatalf("Unable to set up tracing %s", err)
+	}
+
 	router := http.NewServeMux()
-	mongoDb, err := db.NewMongoDB("mongodb://localhost:27017")
+	mongoDb, err := db.NewMongoDB(cfg.Mongo.URI)
 	if err != nil {
 		log.Fatalf("Unable to connect to database %s", err)
 	}
 
-	storageClient, err := storage.NewGCS(ctx)
+	_, err = mongoDb.Migrate(ctx, false)
+	if err != nil {
+		log.Fatalf("Unable to migrate database %s", err)
+	}
+
+	storageClient, err := storage.NewGCS(ctx, cfg.Storage.Location)
 	if err != nil {
 		log.Fatalf("Unable to connect to storage %s", err)
 	}
 
-	pubsubClient, err := pubsub.NewRedis("localhost:6379")
+	pubsubClient, err := pubsub.NewRedis(cfg.Redis.Address, time.Duration(cfg.Redis.LockTTL))
 	if err != nil {
 		log.Fatalf("Unable to connect to pubsub %s", err)
 	}
 
-	router.HandleFunc("/api/v1/apps", routes.ManageApps(mongoDb, storageClient))
-	router.HandleFunc("/api/v1/apps/{id}/tasks", routes.ManageTasks(mongoDb, pubsubClient))
-	router.HandleFunc("/api/v1/apps/{id}/download", routes.Download(mongoDb))
-	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}", routes.ManageTasks(mongoDb, pubsubClient))
-	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/logs", routes.FetchLogs(mongoDb))
-	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/logs/ws", func(w http.ResponseWriter, r *http.Request) {
+	keyProvider, err := secrets.NewLocalKeyProvider(cfg.Files.Keys)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys %s", err)
+	}
+
+	webhookPolicy, err := webhooks.NewAddressPolicy(cfg.Webhooks.AllowedNetworks)
+	if err != nil {
+		log.Fatalf("Invalid webhook allowed networks %s", err)
+	}
+
+	prices, err := claude.LoadPriceTable(cfg.Files.PriceTable)
+	if err != nil {
+		log.Fatalf("Unable to load price table %s", err)
+	}
+
+	quotas, err := quota.Load(cfg.Files.Quotas)
+	if err != nil {
+		log.Fatalf("Unable to load quotas %s", err)
+	}
+	enforcer := quota.NewEnforcer(quotas, mongoDb)
+
+	sessionKey, err := auth.LoadSessionKey(cfg.Files.SessionKey)
+	if err != nil {
+		log.Fatalf("Unable to load session key %s", err)
+	}
+	authenticator := auth.NewAuthenticator(mongoDb, sessionKey)
+
+	router.HandleFunc("/api/v1/apps", routes.ManageApps(mongoDb, dirs, storageClient, keyProvider, enforcer))
+	router.HandleFunc("/api/v1/apps/{id}/tasks", routes.RequireAppAccess(mongoDb, routes.ManageTasks(mongoDb, pubsubClient, enforcer)))
+	router.HandleFunc("/api/v1/apps/{id}/download", routes.RequireAppAccess(mongoDb, routes.Download(mongoDb, dirs)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}", routes.RequireAppAccess(mongoDb, routes.ManageTasks(mongoDb, pubsubClient, enforcer)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/logs", routes.RequireAppAccess(mongoDb, routes.FetchLogs(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/events", routes.RequireAppAccess(mongoDb, routes.FetchEvents(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/tools", routes.RequireAppAccess(mongoDb, routes.FetchToolCalls(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/files", routes.RequireAppAccess(mongoDb, routes.FetchFilesTouched(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/export", routes.RequireAppAccess(mongoDb, routes.ExportTranscript(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/export", routes.RequireAppAccess(mongoDb, routes.ExportTranscript(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/replay", routes.RequireAppAccess(mongoDb, routes.ReplayStream(mongoDb, storageClient, prices, dirs, cfg.Paths.Spool)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/logs/ws", routes.RequireAppAccess(mongoDb, routes.StreamLogWebsocket(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/tasks/{taskId}/logs/stream", routes.RequireAppAccess(mongoDb, routes.StreamLogEvents(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/usage", routes.RequireAppAccess(mongoDb, routes.Usage(mongoDb)))
+	router.HandleFunc("/api/v1/usage", routes.Usage(mongoDb))
+	router.HandleFunc("/api/v1/apps/{id}/quotas", routes.RequireAppAccess(mongoDb, routes.Quotas(enforcer)))
+	router.HandleFunc("/api/v1/quotas", routes.Quotas(enforcer))
+	router.HandleFunc("/api/v1/search", routes.Search(mongoDb))
+	router.HandleFunc("/api/v1/audit", auth.Require(auth.ScopeAdmin, routes.AuditLog(mongoDb)))
+	router.HandleFunc("/api/v1/tokens", auth.Require(auth.ScopeAdmin, routes.ManageTokens(mongoDb)))
+	router.HandleFunc("/api/v1/tokens/{tokenId}", auth.Require(auth.ScopeAdmin, routes.ManageTokens(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/access", routes.RequireAppRole(mongoDb, db.AppRoleOwner, routes.ManageAppAccess(mongoDb)))
+	router.HandleFunc("/api/v1/users", auth.Require(auth.ScopeAdmin, routes.ManageUsers(mongoDb)))
+	router.HandleFunc("/api/v1/teams", auth.Require(auth.ScopeAdmin, routes.ManageTeams(mongoDb)))
+	router.HandleFunc("/api/v1/teams/{teamId}/members", auth.Require(auth.ScopeAdmin, routes.ManageTeams(mongoDb)))
+	router.HandleFunc("/api/v1/apps/{id}/webhooks", routes.RequireAppRole(mongoDb, db.AppRoleOwner, routes.ManageWebhooks(mongoDb, keyProvider, webhookPolicy)))
+	router.HandleFunc("/api/v1/webhooks", auth.Require(auth.ScopeAdmin, routes.ManageWebhooks(mongoDb, keyProvider, webhookPolicy)))
+	router.HandleFunc("/api/v1/webhooks/{webhookId}", routes.ManageWebhooks(mongoDb, keyProvider, webhookPolicy))
+	router.HandleFunc("/api/v1/webhooks/{webhookId}/deliveries", routes.WebhookDeliveries(mongoDb))
+	router.HandleFunc("/api/v1/webhooks/{webhookId}/deliveries/{deliveryId}/redeliver", routes.WebhookDeliveries(mongoDb))
+	router.HandleFunc("/api/v1/webhooks/{webhookId}/ping", routes.PingWebhook(mongoDb))
+	router.HandleFunc(auth.SessionPath, routes.Session(authenticator))
+	router.HandleFunc("/api/v1/openapi.yaml", routes.OpenAPI())
+	router.HandleFunc("/api/v1/apps/{id}/credentials/rotate", routes.RequireAppRole(mongoDb, db.AppRoleOwner, routes.RotateCredentials(mongoDb, pubsubClient, keyProvider)))
+	router.HandleFunc("/apps/{id}", routes.RequireAppRole(mongoDb, db.AppRoleEditor, routes.StartApp(mongoDb, pubsubClient)))
+	router.HandleFunc("/", routes.NotFound())
+
+	// Rotate app database credentials once they reach their maximum age
+	if cfg.Credentials.RotationInterval > 0 {
+		go apps.RotateCredentialsPeriodically(ctx, time.Duration(cfg.Credentials.RotationInterval), time.Duration(cfg.Credentials.MaxAge), mongoDb, pubsubClient, pubsubClient, keyProvider)
+	} else {
+		log.Printf("Credential rotation is disabled")
+	}
+
+	// Send webhook deliveries queued here and by the runners
+	go webhooks.NewDeliverer(mongoDb, keyProvider, webhookPolicy).Run(ctx, time.Duration(cfg.Webhooks.DeliveryInterval))
+
+	// Load balancers probe health, and Prometheus scrapes metrics, without credentials
+	checker := &health.Checker{Checks: []health.Check{
+		{Name: "mongo", Run: mongoDb.Ping},
+		{Name: "mongoChangeStreams", Optional: true, Run: mongoDb.CheckChangeStreams},
+		{Name: "redis", Run: pubsubClient.Ping},
+		{Name: "storage", Optional: true, Run: storageClient.Ping},
+	}}
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", checker.Healthz())
+	root.HandleFunc("/readyz", checker.Readyz())
+	root.Handle("/metrics", metrics.Handler())
 
-		taskID := r.PathValue("taskId")
+	// Every other route requires a token or a session
+	pubsubClient.ExposeQueueDepth()
+	root.Handle("/", tracing.Handler(router, metrics.Instrument(router, auth.Middleware(authenticator, router))))
 
-		// Update to Web Sockets
-		c, err := upgrader.Upgrade(w, r, nil)
+	// On SIGINT or SIGTERM, finish the requests in flight and send the spans still batched
+	server := &http.Server{Addr: cfg.Server.Addr, Handler: root}
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		log.Printf("Control plane stopping on %s", sig)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
 		if err != nil {
-			log.Print("upgrade:", err)
-			return
-		}
-		defer c.Close()
-
-		// Start Stream with database
-		for logSnapshot := range mongoDb.StartLogStream(ctx, taskID) {
-			logBytes, err := json.Marshal(logSnapshot)
-			if err != nil {
-				log.Println(err)
-				break
-			}
-			err = c.WriteMessage(websocket.TextMessage, logBytes)
-			if err != nil {
-				log.Println("write:", err)
-				break
-			}
+			log.Printf("Unable to finish the requests in flight %s", err)
 		}
-	})
-	router.HandleFunc("/apps/{id}", routes.StartApp(mongoDb, pubsubClient))
+	}()
+
+	err = server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		<-stopped
+		err = nil
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if tracingErr := shutdownTracing(shutdownCtx); tracingErr != nil {
+		log.Printf("Unable to send the remaining spans %s", tracingErr)
+	}
 
-	err = http.ListenAndServe(":9808", router)
 	if err != nil {
 		log.Fatalln(err)
 	}
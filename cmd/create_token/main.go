@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+	"umami/pkg/auth"
+	"umami/pkg/config"
+	"umami/pkg/db"
+)
+
+// create_token creates an API token directly in the database, to bootstrap access to
+// the control plane. The token is printed once and cannot be recovered.
+func main() {
+	fs := flag.NewFlagSet("create_token", flag.ExitOnError)
+	name := fs.String("name", "bootstrap", "name of the token")
+	subject := fs.String("subject", "admin", "identity the token acts as")
+	scopes := fs.String("scopes", auth.ScopeAdmin, "comma separated scopes: read, write, admin")
+	expiresIn := fs.Duration("expires-in", 0, "lifetime of the token, or 0 for a token that never expires")
+	cfg, printOnly, err := config.LoadFlags(fs, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration %s", err)
+	}
+	if printOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	ctx := context.Background()
+
+	mongoDb, err := db.NewMongoDB(cfg.Mongo.URI)
+	if err != nil {
+		log.Fatalf("Unable to connect to database %s", err)
+	}
+
+	token := db.APIToken{
+		Name:    *name,
+		Subject: *subject,
+		Scopes:  strings.Split(*scopes, ","),
+		Created: time.Now(),
+	}
+	for _, scope := range token.Scopes {
+		if !auth.ValidScope(scope) {
+			log.Fatalf("Invalid scope %s", scope)
+		}
+	}
+	if *expiresIn > 0 {
+		token.Expires = token.Created.Add(*expiresIn)
+	}
+
+	secret, hash, err := auth.NewAPIToken()
+	if err != nil {
+		log.Fatalf("Unable to generate token %s", err)
+	}
+	token.Hash = hash
+
+	tokenId, err := mongoDb.CreateAPIToken(ctx, &token)
+	if err != nil {
+		log.Fatalf("Unable to create token %s", err)
+	}
+
+	log.Printf("Created token %s for %s with scopes %s", tokenId, token.Subject, *scopes)
+	fmt.Println(secret)
+}
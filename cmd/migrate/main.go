@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"umami/pkg/config"
+	"umami/pkg/db"
+)
+
+// migrate applies pending database migrations. The control plane does the same at
+// startup; use -dry-run to see what would change first.
+func main() {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "report pending migrations without applying them")
+	cfg, printOnly, err := config.LoadFlags(fs, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration %s", err)
+	}
+	if printOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	ctx := context.Background()
+
+	mongoDb, err := db.NewMongoDB(cfg.Mongo.URI)
+	if err != nil {
+		log.Fatalf("Unable to connect to database %s", err)
+	}
+
+	results, err := mongoDb.Migrate(ctx, *dryRun)
+	if err != nil {
+		log.Fatalf("Unable to migrate database %s", err)
+	}
+
+	if len(results) == 0 {
+		log.Printf("Database is up to date")
+		return
+	}
+
+	for _, r := range results {
+		log.Printf("Migration %d (%s): %s", r.Version, r.Description, r.Summary)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"umami/pkg/config"
+	"umami/pkg/db"
+	"umami/pkg/secrets"
+)
+
+// rotate_keys adds a new primary key to the local key ring and re-encrypts every
+// app credential and webhook secret with it. Apps that still hold a plaintext password
+// are encrypted.
+// With -init it creates the key ring when there is none; nothing else creates one.
+func main() {
+	fs := flag.NewFlagSet("rotate_keys", flag.ExitOnError)
+	newKey := fs.Bool("new-key", true, "generate a new primary key before re-encrypting")
+	initKeys := fs.Bool("init", false, "create the key file if it does not exist")
+	cfg, printOnly, err := config.LoadFlags(fs, os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration %s", err)
+	}
+	if printOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+
+	ctx := context.Background()
+
+	mongoDb, err := db.NewMongoDB(cfg.Mongo.URI)
+	if err != nil {
+		log.Fatalf("Unable to connect to database %s", err)
+	}
+
+	keyPath := cfg.Files.Keys
+
+	created := false
+	keyProvider, err := secrets.NewLocalKeyProvider(keyPath)
+	if _, statErr := os.Stat(keyPath); *initKeys && errors.Is(statErr, os.ErrNotExist) {
+		keyProvider, err = secrets.CreateLocalKeyProvider(keyPath)
+		if err == nil {
+			created = true
+			log.Printf("Created key file %s with primary key %s", keyPath, keyProvider.PrimaryKeyID())
+		}
+	}
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys %s", err)
+	}
+
+	// A new key ring already has a fresh primary key
+	if *newKey && !created {
+		keyID, err := keyProvider.AddKey()
+		if err != nil {
+			log.Fatalf("Unable to add encryption key %s", err)
+		}
+		log.Printf("Added primary key %s", keyID)
+	}
+
+	apps, err := mongoDb.GetApps(ctx)
+	if err != nil {
+		log.Fatalf("Unable to list apps %s", err)
+	}
+
+	rotated := 0
+	for _, app := range apps {
+		var envelope *secrets.Envelope
+		switch {
+		case app.EncryptedPassword == nil && app.Password != "":
+			envelope, err = secrets.Seal(ctx, keyProvider, app.Password)
+		case app.EncryptedPassword != nil && app.EncryptedPassword.KeyID != keyProvider.PrimaryKeyID():
+			envelope, err = secrets.Rewrap(ctx, keyProvider, app.EncryptedPassword)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("Unable to re-encrypt credentials for app %s: %s", app.Id.Hex(), err)
+			continue
+		}
+
+		err = mongoDb.UpdateAppPassword(ctx, app.Id.Hex(), envelope)
+		if err != nil {
+			log.Printf("Unable to store credentials for app %s: %s", app.Id.Hex(), err)
+			continue
+		}
+		rotated++
+	}
+
+	log.Printf("Re-encrypted credentials for %d of %d apps", rotated, len(apps))
+
+	hooks, err := mongoDb.GetAllWebhooks(ctx)
+	if err != nil {
+		log.Fatalf("Unable to list webhooks %s", err)
+	}
+
+	rotated = 0
+	for _, hook := range hooks {
+		if hook.Secret == nil || hook.Secret.KeyID == keyProvider.PrimaryKeyID() {
+			continue
+		}
+
+		envelope, err := secrets.Rewrap(ctx, keyProvider, hook.Secret)
+		if err != nil {
+			log.Printf("Unable to re-encrypt the secret of webhook %s: %s", hook.Id.Hex(), err)
+			continue
+		}
+
+		err = mongoDb.UpdateWebhookSecret(ctx, hook.Id.Hex(), envelope)
+		if err != nil {
+			log.Printf("Unable to store the secret of webhook %s: %s", hook.Id.Hex(), err)
+			continue
+		}
+		rotated++
+	}
+
+	log.Printf("Re-encrypted secrets for %d of %d webhooks", rotated, len(hooks))
+}
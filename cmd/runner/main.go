@@ -2,60 +2,212 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"os"
+	"os/signal"
+	"path"
+	"slices"
+	"sync"
+	"syscall"
 	"time"
+	"umami/pkg/apps"
 	"umami/pkg/claude"
+	"umami/pkg/config"
 	"umami/pkg/db"
+	"umami/pkg/health"
 	"umami/pkg/pubsub"
+	"umami/pkg/quota"
+	"umami/pkg/redact"
+	"umami/pkg/secrets"
+	"umami/pkg/storage"
+	"umami/pkg/tracing"
+	"umami/pkg/webhooks"
 	"umami/pkg/worker"
-)
 
-const (
-	maxNumberOfSubProcesses = 3
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// shutdownTimeout bounds waiting for the tasks in progress to write their logs, and then
+// sending the remaining spans, when the runner is stopped
+const shutdownTimeout = 10 * time.Second
+
+// errRunnerStopped cancels the tasks in progress when the runner is stopped
+var errRunnerStopped = errors.New("runner stopped")
+
 func main() {
-	workChan := make(chan *worker.Work, maxNumberOfSubProcesses)
+	cfg, printOnly, err := config.Load("runner", os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration %s", err)
+	}
+	if printOnly {
+		cfg.Print(os.Stdout)
+		return
+	}
+	dirs := apps.Dirs{Repositories: cfg.Paths.Repositories, Logs: cfg.Paths.Logs}
+	logSpoolDir := cfg.Paths.Spool
+
+	workChan := make(chan *worker.Work, cfg.Runner.MaxSubProcesses)
 	ctx := context.Background()
+
+	shutdownTracing, err := tracing.Setup(ctx, "runner", cfg.Tracing.Exporter, cfg.Tracing.Endpoint)
+	if err != nil {
+		log.Fatalf("Unable to set up tracing %s", err)
+	}
+
+	// On SIGINT or SIGTERM, stop pulling tasks and cancel the ones in progress. Their app
+	// locks are left to expire, which puts them back in the queue.
+	runnerCtx, stopRunner := context.WithCancelCause(ctx)
+	go func() {
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+		sig := <-stop
+		log.Printf("Runner stopping on %s", sig)
+		stopRunner(errRunnerStopped)
+	}()
+
+	// Tasks handed to a worker, which are done once their logs are written
+	var running sync.WaitGroup
+
 	// Initialise Redis connection
-	// redisAddress := os.Getenv("REDIS_ADDRESS")
-	redisClient, err := pubsub.NewRedis("localhost:6379")
+	redisClient, err := pubsub.NewRedis(cfg.Redis.Address, time.Duration(cfg.Redis.LockTTL))
 	if err != nil {
 		log.Fatalf("Unable to connect to redis %s", err)
 	}
 
 	// Initialise Mongo connection
-	// mongoAddress := os.Getenv("MONGO_ADDRESS")
-	mongoClient, err := db.NewMongoDB("mongodb://localhost:27017")
+	mongoClient, err := db.NewMongoDB(cfg.Mongo.URI)
 	if err != nil {
 		log.Fatalf("Unable to connect to mongo %s", err)
 	}
 
-	// Infinite for to pull messages from Redis
+	storageClient, err := storage.NewGCS(ctx, cfg.Storage.Location)
+	if err != nil {
+		log.Fatalf("Unable to connect to storage %s", err)
+	}
+
+	keyProvider, err := secrets.NewLocalKeyProvider(cfg.Files.Keys)
+	if err != nil {
+		log.Fatalf("Unable to load encryption keys %s", err)
+	}
+
+	prices, err := claude.LoadPriceTable(cfg.Files.PriceTable)
+	if err != nil {
+		log.Fatalf("Unable to load price table %s", err)
+	}
+
+	quotas, err := quota.Load(cfg.Files.Quotas)
+	if err != nil {
+		log.Fatalf("Unable to load quotas %s", err)
+	}
+	enforcer := quota.NewEnforcer(quotas, mongoClient)
+
+	extraPatterns, err := redact.LoadPatterns(cfg.Files.RedactPatterns)
+	if err != nil {
+		log.Fatalf("Unable to load redaction patterns %s", err)
+	}
+	redactPatterns := slices.Concat(redact.DefaultPatterns, extraPatterns)
+	if _, err := redact.New(nil, redactPatterns); err != nil {
+		log.Fatalf("Invalid redaction pattern %s", err)
+	}
+
+	runnerStatus := newStatus(cfg.Runner.MaxSubProcesses)
+	runnerStatus.exposeMetrics()
+	if cfg.Runner.StatusAddr != "" {
+		go serveStatus(cfg.Runner.StatusAddr, &health.Checker{
+			Checks: []health.Check{
+				{Name: "mongo", Run: mongoClient.Ping},
+				{Name: "redis", Run: redisClient.Ping},
+			},
+			Details: runnerStatus.details,
+		})
+	}
+
+	// Write logs spooled by a previous run that could not reach the database
+	err = claude.ReplaySpool(ctx, mongoClient, logSpoolDir)
+	if err != nil {
+		log.Printf("Unable to replay spooled logs %s", err)
+	}
+
+	// Start the app processes asked for through the control plane
+	go startApps(runnerCtx, redisClient, redisClient, mongoClient, dirs, keyProvider)
+
+	// Pull messages from Redis until the runner is stopped
 	for {
 		// Pull message from Redis
 		log.Printf("Worker waiting for message...")
-		taskId, err := redisClient.PullMessage(ctx)
+		runnerStatus.setLoop(loopWaiting)
+		message, err := redisClient.PullMessage(runnerCtx)
+		if runnerCtx.Err() != nil {
+			// A task pulled as the runner stopped is put back in the queue once its app
+			// lock expires
+			break
+		}
 		if err != nil {
 			log.Printf("Unable to pull message from redis %s", err)
+			runnerStatus.failed(err)
 			continue
 		}
+		runnerStatus.setLoop(loopDispatching)
+		taskId := message.TaskID
 		log.Printf("Worker got message %s", taskId)
 
-		taskCtx, cancel := context.WithCancel(ctx)
+		// The spans of the task continue the trace of the request that queued it
+		traceCtx, span := tracing.Tracer.Start(message.Context(runnerCtx), "runner.task", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+			attribute.String("task.id", taskId),
+		))
+
+		// A task stopped for its app's budget is cancelled with the *quota.Exceeded as cause
+		taskCtx, cancel := context.WithCancelCause(traceCtx)
 
 		// Fetch task details from Mongo
-		task, err := mongoClient.GetTask(ctx, taskId)
+		task, err := mongoClient.GetTask(traceCtx, taskId)
 		if err != nil {
 			log.Printf("Unable to pull task from the datastore %s", err)
-			cancel()
+			runnerStatus.failed(err)
+			cancel(nil)
+			tracing.End(span, err)
 			continue
 		}
+		span.SetAttributes(attribute.String("app.id", task.AppId.Hex()))
 
-		app, err := mongoClient.GetApp(ctx, task.AppId.Hex())
+		// The task was cancelled, or edited back to authoring, after it was queued
+		if task.Status != db.TaskStatusInProgress {
+			log.Printf("Skipping task %s with status %s", taskId, task.Status)
+			redisClient.DeleteLock(traceCtx, task.AppId.Hex())
+			cancel(nil)
+			span.SetAttributes(attribute.String("skipped", task.Status))
+			tracing.End(span, nil)
+			continue
+		}
+
+		// The app used up its budget while the task waited in the queue
+		budgetErr := enforcer.CheckBudget(traceCtx, task.AppId.Hex())
+		if errors.Is(budgetErr, quota.ErrExceeded) {
+			log.Printf("Cancelling task %s for app %s: %s", taskId, task.AppId, budgetErr)
+			err = mongoClient.UpdateTask(traceCtx, task.AppId.Hex(), taskId, task.Title, task.Description, db.TaskStatusCancelled)
+			if err != nil {
+				log.Printf("Unable to update task status for task %s and app %s. Error: %s", taskId, task.AppId, err)
+			}
+			emitTaskFinished(traceCtx, mongoClient, taskId, budgetErr)
+			redisClient.DeleteLock(traceCtx, task.AppId.Hex())
+			cancel(nil)
+			tracing.End(span, budgetErr)
+			continue
+		}
+		if budgetErr != nil {
+			log.Printf("Unable to check the budget of app %s, running task %s anyway. Error: %s", task.AppId, taskId, budgetErr)
+		}
+
+		app, err := mongoClient.GetApp(traceCtx, task.AppId.Hex())
 		if err != nil {
 			log.Printf("Unable to pull app from the datastore %s", err)
-			cancel()
+			runnerStatus.failed(err)
+			cancel(nil)
+			tracing.End(span, err)
 			continue
 		}
 
@@ -68,38 +220,114 @@ func main() {
 				case <-taskCtx.Done():
 					log.Printf("Renew loop cancelled for Task %s for app %s cancelled", task.Id, task.AppId)
 					return
-				case <-time.After(time.Second * 15):
+				case <-time.After(time.Duration(cfg.Runner.LockRenewInterval)):
 					if taskInProgress {
-						redisClient.RenewLock(taskCtx, task.AppId.Hex())
+						err := redisClient.RenewLock(taskCtx, task.AppId.Hex(), message.LockToken)
+						if errors.Is(err, pubsub.ErrLockLost) {
+							log.Printf("Stopping task %s for app %s: %s", task.Id, task.AppId, err)
+							cancel(err)
+							return
+						} else if err != nil {
+							log.Printf("Unable to renew the lock of app %s. Error: %s", task.AppId, err)
+						}
+
+						err = enforcer.CheckBudget(taskCtx, task.AppId.Hex())
+						if errors.Is(err, quota.ErrExceeded) {
+							log.Printf("Stopping task %s for app %s: %s", task.Id, task.AppId, err)
+							cancel(err)
+						} else if err != nil {
+							log.Printf("Unable to check the budget of app %s. Error: %s", task.AppId, err)
+						}
 					}
 				}
 			}
 		}()
 
+		runnerStatus.started(taskId)
+		running.Add(1)
 		go func() {
+			defer running.Done()
+			defer runnerStatus.finished(taskId)
 			w := <-workChan
 
-			taskLogWriter := claude.NewLogWriter(mongoClient, task.Id.Hex())
+			// Set when the task could not run to the end, which is reported as task.failed
+			var runErr error
 
-			// Create a sub process
-			err := w.Execute(taskCtx, taskLogWriter)
+			env, err := w.Env(taskCtx)
 			if err != nil {
-				log.Printf("Unable to complete work for task %s and app %s. Error: %s", w.Task.Id, w.Task.AppId, err)
+				log.Printf("Unable to prepare work for task %s and app %s. Error: %s", w.Task.Id, w.Task.AppId, err)
+				runErr = err
+			} else {
+				// Anything in the agent's environment that looks secret is masked in its logs
+				redactor, err := redact.New(redact.EnvSecrets(env), redactPatterns)
+				if err != nil {
+					log.Printf("Unable to create log redactor %s", err)
+				}
+
+				taskLogWriter := claude.NewLogWriter(taskCtx, mongoClient, task.Id.Hex(), w.Dir, logSpoolDir, prices, redactor)
+
+				// Keep the raw stream alongside the parsed events
+				var output io.Writer = taskLogWriter
+				started := time.Now().UTC()
+				archive, err := claude.NewStreamArchive(path.Join(logSpoolDir, fmt.Sprintf("%s-%d.jsonl.gz", w.Task.Id.Hex(), started.Unix())), redactor)
+				if err != nil {
+					log.Printf("Unable to archive the stream of task %s. Error: %s", w.Task.Id, err)
+				} else {
+					output = io.MultiWriter(taskLogWriter, archive)
+				}
+
+				// Create a sub process
+				err = w.Execute(taskCtx, env, output)
+				if err != nil {
+					log.Printf("Unable to complete work for task %s and app %s. Error: %s", w.Task.Id, w.Task.AppId, err)
+					runErr = err
+				}
+
+				err = taskLogWriter.Flush()
+				if err != nil {
+					log.Printf("Unable to write all logs for task %s, the rest stays spooled. Error: %s", w.Task.Id, err)
+				}
+
+				if archive != nil {
+					uploadStreamArchive(traceCtx, mongoClient, storageClient, w, archive, started)
+				}
 			}
 			// log.Printf("Processing task %s for app %s", w.Task.Id, w.Task.AppId)
 			// // time.Sleep(time.Second * 30)
 			// log.Printf("Completed task %s for app %s", w.Task.Id, w.Task.AppId)
 
+			// The task went back to the queue when the lock expired, so it is left to the
+			// worker that holds the lock now. A task stopped with the runner goes back once
+			// its lock expires.
+			if cause := context.Cause(taskCtx); errors.Is(cause, pubsub.ErrLockLost) || errors.Is(cause, errRunnerStopped) {
+				taskInProgress = false
+				cancel(nil)
+				span.SetAttributes(attribute.String("status", "requeued"))
+				tracing.End(span, cause)
+				return
+			}
+
+			status := db.TaskStatusCompleted
+			if cause := context.Cause(taskCtx); errors.Is(cause, quota.ErrExceeded) {
+				status, runErr = db.TaskStatusCancelled, cause
+			} else if runErr != nil {
+				status = db.TaskStatusFailed
+			}
+
 			taskInProgress = false
-			redisClient.DeleteLock(taskCtx, task.AppId.Hex())
-			cancel()
+			redisClient.DeleteLock(traceCtx, task.AppId.Hex())
+			cancel(nil)
 
 			// Update task status
-			err = mongoClient.UpdateTask(ctx, w.Task.AppId.Hex(), w.Task.Id.Hex(), w.Task.Title, w.Task.Description, "completed")
+			err = mongoClient.UpdateTask(traceCtx, w.Task.AppId.Hex(), w.Task.Id.Hex(), w.Task.Title, w.Task.Description, status)
 			if err != nil {
 				log.Printf("Unable to update task status for task %s and app %s. Error: %s", w.Task.Id, w.Task.AppId, err)
 			}
 
+			emitTaskFinished(traceCtx, mongoClient, w.Task.Id.Hex(), runErr)
+			span.SetAttributes(attribute.String("status", status))
+			tracing.End(span, runErr)
+
 			// Kill subprocess
 			// Clear port in redis
 		}()
@@ -108,6 +336,122 @@ func main() {
 		workChan <- &worker.Work{
 			Task: task,
 			App:  app,
+			Dir:  dirs.Repository(app.Id.Hex()),
+			Keys: keyProvider,
+		}
+	}
+
+	// Agents exit once their task is cancelled, and their logs are written before the
+	// task is done. Whatever is not written in time stays spooled for the next run.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	finished := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-shutdownCtx.Done():
+		log.Printf("Tasks still writing their logs when the runner stopped, the rest stays spooled")
+	}
+
+	tracingCtx, cancelTracing := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelTracing()
+	err = shutdownTracing(tracingCtx)
+	if err != nil {
+		log.Printf("Unable to send the remaining spans %s", err)
+	}
+	log.Printf("Runner stopped")
+}
+
+// startApps starts the app processes asked for with SendAppStart. Apps are started here
+// rather than by the control plane, as it is the runner that decrypts app credentials.
+func startApps(ctx context.Context, queue pubsub.PubSub, cache pubsub.Cache, database db.DB, dirs apps.Dirs, keys secrets.KeyProvider) {
+	for ctx.Err() == nil {
+		start, err := queue.PullAppStart(ctx)
+		if err != nil {
+			log.Printf("Unable to pull app starts from redis %s", err)
+			time.Sleep(time.Second * 10)
+			continue
+		}
+		if start == nil {
+			continue
+		}
+
+		app, err := database.GetApp(ctx, start.AppID)
+		if err != nil {
+			log.Printf("Unable to get app %s to start it. Error: %s", start.AppID, err)
+			continue
+		}
+
+		err = apps.Start(ctx, app, dirs, cache, keys, start.Port)
+		if err != nil {
+			log.Printf("Unable to start app %s. Error: %s", start.AppID, err)
+			continue
 		}
+		log.Printf("Started app %s on port %d", start.AppID, start.Port)
+	}
+}
+
+// emitTaskFinished queues the task.completed or task.failed webhook deliveries of a task.
+// The control plane sends them.
+func emitTaskFinished(ctx context.Context, database db.DB, taskId string, runErr error) {
+	task, err := database.GetTask(ctx, taskId)
+	if err != nil {
+		log.Printf("Unable to get task %s for its webhook event. Error: %s", taskId, err)
+		return
+	}
+
+	event, data := db.WebhookEventTaskCompleted, webhooks.TaskData{Task: task}
+	if runErr != nil {
+		event, data.Error = db.WebhookEventTaskFailed, runErr.Error()
+	}
+
+	err = webhooks.Emit(ctx, database, event, task.AppId.Hex(), data)
+	if err != nil {
+		log.Printf("Unable to emit webhook event %s for task %s. Error: %s", event, taskId, err)
+	}
+}
+
+// uploadStreamArchive moves a task's raw stream archive to the app's bucket and references
+// it from the task. The local file is kept if the upload fails.
+func uploadStreamArchive(ctx context.Context, database db.DB, storageClient storage.Storage, w *worker.Work, archive *claude.StreamArchive, started time.Time) {
+	err := archive.Close()
+	if err != nil {
+		log.Printf("Unable to write the stream archive of task %s. Error: %s", w.Task.Id, err)
+		return
 	}
+
+	f, err := os.Open(archive.Path)
+	if err != nil {
+		log.Printf("Unable to open the stream archive of task %s. Error: %s", w.Task.Id, err)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		log.Printf("Unable to open the stream archive of task %s. Error: %s", w.Task.Id, err)
+		return
+	}
+
+	object := fmt.Sprintf("streams/%s/%s.jsonl.gz", w.Task.Id.Hex(), started.Format("20060102T150405Z"))
+	err = storageClient.PutObject(ctx, w.App.Name, object, f)
+	if err != nil {
+		log.Printf("Unable to upload the stream archive of task %s, kept at %s. Error: %s", w.Task.Id, archive.Path, err)
+		return
+	}
+
+	err = database.AddTaskStream(ctx, w.Task.Id.Hex(), db.StreamArchive{
+		Object:  object,
+		Started: started,
+		Size:    info.Size(),
+	})
+	if err != nil {
+		log.Printf("Unable to reference the stream archive %s from task %s. Error: %s", object, w.Task.Id, err)
+		return
+	}
+
+	os.Remove(archive.Path)
 }
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+	"umami/pkg/health"
+	"umami/pkg/metrics"
+)
+
+const (
+	loopStarting    = "starting"    // Replaying spooled logs before the first pull
+	loopWaiting     = "waiting"     // Blocked on Redis for the next task
+	loopDispatching = "dispatching" // Loading a pulled task and handing it to a worker
+)
+
+// status is the state of the runner, as reported by its health endpoints
+type status struct {
+	mu        sync.Mutex
+	loop      string
+	since     time.Time
+	lastError string
+	errorTime time.Time
+	slots     int
+	tasks     map[string]time.Time // Tasks being worked on, by ID, with when they started
+}
+
+type statusDetails struct {
+	Loop      string        `json:"loop"`
+	Since     time.Time     `json:"since"`
+	LastError string        `json:"lastError,omitempty"`
+	ErrorTime time.Time     `json:"errorTime,omitzero"`
+	Slots     int           `json:"slots"`
+	Busy      int           `json:"busy"`
+	Tasks     []runningTask `json:"tasks"`
+}
+
+type runningTask struct {
+	Id      string    `json:"id"`
+	Started time.Time `json:"started"`
+}
+
+func newStatus(slots int) *status {
+	return &status{loop: loopStarting, since: time.Now(), slots: slots, tasks: map[string]time.Time{}}
+}
+
+func (s *status) setLoop(loop string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.loop, s.since = loop, time.Now()
+}
+
+// failed records an error of the pull loop
+func (s *status) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastError, s.errorTime = err.Error(), time.Now()
+}
+
+func (s *status) started(taskId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[taskId] = time.Now()
+}
+
+func (s *status) finished(taskId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tasks, taskId)
+}
+
+func (s *status) details() any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	details := statusDetails{
+		Loop:      s.loop,
+		Since:     s.since,
+		LastError: s.lastError,
+		ErrorTime: s.errorTime,
+		Slots:     s.slots,
+		Busy:      len(s.tasks),
+		Tasks:     []runningTask{},
+	}
+	for id, started := range s.tasks {
+		details.Tasks = append(details.Tasks, runningTask{Id: id, Started: started})
+	}
+	sort.Slice(details.Tasks, func(i, j int) bool {
+		return details.Tasks[i].Started.Before(details.Tasks[j].Started)
+	})
+
+	return details
+}
+
+// exposeMetrics adds the slots of the runner and how many are busy to the metrics
+func (s *status) exposeMetrics() {
+	metrics.NewGaugeFunc("umami_runner_slots", "Tasks the runner works on at once.", nil, func(emit func(float64, ...string)) {
+		emit(float64(s.slots))
+	})
+	metrics.NewGaugeFunc("umami_runner_busy_slots", "Tasks the runner is working on.", nil, func(emit func(float64, ...string)) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		emit(float64(len(s.tasks)))
+	})
+}
+
+// serveStatus serves /healthz, /readyz and /metrics on addr until the runner exits
+func serveStatus(addr string, checker *health.Checker) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checker.Healthz())
+	mux.HandleFunc("/readyz", checker.Readyz())
+	mux.HandleFunc("/metrics", metrics.Handler())
+
+	log.Printf("Serving runner status on %s", addr)
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Printf("Unable to serve runner status %s", err)
+	}
+}
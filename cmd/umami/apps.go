@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func apps(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("apps expects a subcommand: list, create, download or start")
+	}
+
+	g := globals{}
+	switch args[0] {
+	case "list":
+		fs := newFlagSet("apps list", &g)
+		_, err := parseArgs(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+
+		apps, err := c.ListApps(ctx)
+		if err != nil {
+			return err
+		}
+		if g.json {
+			return printJSON(apps)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tSTATUS\tCREATED\tDESCRIPTION")
+		for _, app := range apps {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", app.Id, app.Name, app.Status, app.Created.Local().Format(time.DateTime), app.Description)
+		}
+		return tw.Flush()
+	case "create":
+		fs := newFlagSet("apps create", &g)
+		name := fs.String("name", "", "name of the app")
+		description := fs.String("description", "", "description of the app")
+		_, err := parseArgs(fs, args[1:])
+		if err != nil {
+			return err
+		}
+		if *name == "" {
+			return fmt.Errorf("apps create needs -name")
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+
+		appId, err := c.CreateApp(ctx, *name, *description)
+		if err != nil {
+			return err
+		}
+		if g.json {
+			return printJSON(map[string]string{"id": appId})
+		}
+		fmt.Println(appId)
+		return nil
+	case "download":
+		fs := newFlagSet("apps download", &g)
+		output := fs.String("o", "", "file to write, by default APP_ID.zip, or - for stdout")
+		positional, err := parseArgs(fs, args[1:], "APP_ID")
+		if err != nil {
+			return err
+		}
+		appId := positional[0]
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+
+		if *output == "" {
+			*output = appId + ".zip"
+		}
+		var w io.Writer = os.Stdout
+		if *output != "-" {
+			f, err := os.Create(*output)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		err = c.DownloadApp(ctx, appId, w)
+		if err != nil {
+			return err
+		}
+		if *output != "-" {
+			fmt.Fprintf(os.Stderr, "Saved %s\n", *output)
+		}
+		return nil
+	case "start":
+		fs := newFlagSet("apps start", &g)
+		positional, err := parseArgs(fs, args[1:], "APP_ID")
+		if err != nil {
+			return err
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+
+		url, err := c.StartApp(ctx, positional[0])
+		if err != nil {
+			return err
+		}
+		if g.json {
+			return printJSON(map[string]string{"url": url})
+		}
+		fmt.Println(url)
+		return nil
+	default:
+		return fmt.Errorf("unknown apps subcommand %s", args[0])
+	}
+}
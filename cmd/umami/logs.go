@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"umami/pkg/api"
+)
+
+func logs(ctx context.Context, args []string) error {
+	g := globals{}
+	fs := newFlagSet("logs", &g)
+	follow := fs.Bool("f", false, "follow the log as the agent works")
+	positional, err := parseArgs(fs, args, "APP_ID", "TASK_ID")
+	if err != nil {
+		return err
+	}
+	appId, taskId := positional[0], positional[1]
+	c, err := g.client()
+	if err != nil {
+		return err
+	}
+
+	if !*follow {
+		l, err := c.GetLog(ctx, appId, taskId)
+		if err != nil {
+			return err
+		}
+		for _, e := range l.Events {
+			printEvent(e, g.json)
+		}
+		return nil
+	}
+
+	// The stream starts with the events so far
+	for e, err := range c.StreamEvents(ctx, appId, taskId, 0) {
+		if errors.Is(err, context.Canceled) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		printEvent(e, g.json)
+	}
+
+	return nil
+}
+
+// printEvent renders an event for a terminal, or as a line of JSON
+func printEvent(e *api.Event, asJSON bool) {
+	if asJSON {
+		data, err := json.Marshal(e)
+		if err == nil {
+			fmt.Println(string(data))
+		}
+		return
+	}
+
+	prefix := e.Time.Local().Format("15:04:05")
+	switch e.Kind {
+	case api.EventKindText:
+		fmt.Printf("%s %s\n", prefix, indent(strings.TrimSpace(e.Text)))
+	case api.EventKindToolUse:
+		fmt.Printf("%s → %s %s\n", prefix, e.ToolName, toolSummary(e))
+		if e.Diff != "" {
+			fmt.Println(indent(strings.TrimRight(e.Diff, "\n")))
+		}
+	case api.EventKindToolResult:
+		mark := "✓"
+		if e.IsError {
+			mark = "✗"
+		}
+		fmt.Printf("%s   %s %s\n", prefix, mark, firstLine(e.Text, 120))
+	case api.EventKindResult:
+		fmt.Printf("%s ■ %s\n", prefix, firstLine(e.Text, 200))
+		if e.Subtype != "" && e.Subtype != "success" {
+			fmt.Printf("%s   %s\n", prefix, e.Subtype)
+		}
+	case api.EventKindRaw:
+		fmt.Printf("%s %s\n", prefix, firstLine(e.Text, 200))
+	}
+}
+
+// toolSummary picks the input that best describes a tool use
+func toolSummary(e *api.Event) string {
+	if e.FilePath != "" {
+		return e.FilePath
+	}
+	for _, key := range []string{"command", "file_path", "path", "pattern", "url", "description", "prompt"} {
+		if v, ok := e.ToolInput[key].(string); ok && v != "" {
+			return firstLine(v, 100)
+		}
+	}
+	return ""
+}
+
+func firstLine(s string, width int) string {
+	s = strings.TrimSpace(s)
+	line, _, multiline := strings.Cut(s, "\n")
+	if runes := []rune(line); len(runes) > width {
+		return string(runes[:width]) + "…"
+	}
+	if multiline {
+		return line + " …"
+	}
+	return line
+}
+
+func indent(s string) string {
+	return strings.ReplaceAll(s, "\n", "\n         ")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"umami/pkg/client"
+)
+
+const defaultServer = "http://localhost:9808"
+
+const usage = `umami drives the Umami control plane.
+
+Usage:
+  umami login -server URL -token TOKEN
+  umami apps list
+  umami apps create -name NAME [-description TEXT]
+  umami apps download [-o FILE] APP_ID
+  umami apps start APP_ID
+  umami tasks list APP_ID
+  umami tasks create -title TITLE [-description TEXT] [-queue] APP_ID
+  umami tasks edit [-title TITLE] [-description TEXT] APP_ID TASK_ID
+  umami tasks queue APP_ID TASK_ID
+  umami tasks cancel APP_ID TASK_ID
+  umami logs [-f] APP_ID TASK_ID
+
+Every command takes -json for machine readable output, and -server, -token and -config to
+override the server and token. They are read, in order, from the flags, the UMAMI_SERVER and
+UMAMI_TOKEN variables and the config file written by login.
+`
+
+// config is the CLI config file, by default in the user's config directory
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// globals are the flags every command accepts
+type globals struct {
+	server     string
+	token      string
+	configPath string
+	json       bool
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	var err error
+	switch os.Args[1] {
+	case "login":
+		err = login(ctx, os.Args[2:])
+	case "apps":
+		err = apps(ctx, os.Args[2:])
+	case "tasks":
+		err = tasks(ctx, os.Args[2:])
+	case "logs":
+		err = logs(ctx, os.Args[2:])
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		err = fmt.Errorf("unknown command %s", os.Args[1])
+	}
+
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "umami: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// newFlagSet returns the flags of a command with the global flags registered
+func newFlagSet(name string, g *globals) *flag.FlagSet {
+	fs := flag.NewFlagSet("umami "+name, flag.ContinueOnError)
+	fs.StringVar(&g.server, "server", "", "control plane address, such as "+defaultServer)
+	fs.StringVar(&g.token, "token", "", "API or session token")
+	fs.StringVar(&g.configPath, "config", "", "config file, by default umami/config.json in the user config directory")
+	fs.BoolVar(&g.json, "json", false, "print JSON")
+	return fs
+}
+
+// parseArgs parses the flags of a command and checks it got exactly n positional arguments
+func parseArgs(fs *flag.FlagSet, args []string, names ...string) ([]string, error) {
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if fs.NArg() != len(names) {
+		return nil, fmt.Errorf("%s expects %d arguments: %v", fs.Name(), len(names), names)
+	}
+	return fs.Args(), nil
+}
+
+func (g *globals) client() (*client.Client, error) {
+	cfg, err := loadConfig(g.configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	server := firstNonEmpty(g.server, os.Getenv("UMAMI_SERVER"), cfg.Server, defaultServer)
+	token := firstNonEmpty(g.token, os.Getenv("UMAMI_TOKEN"), cfg.Token)
+	if token == "" {
+		return nil, errors.New("no token, run umami login or set UMAMI_TOKEN")
+	}
+
+	return client.New(server, token), nil
+}
+
+func login(ctx context.Context, args []string) error {
+	g := globals{}
+	fs := newFlagSet("login", &g)
+	_, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if g.token == "" {
+		return errors.New("login needs -token")
+	}
+	if g.server == "" {
+		g.server = defaultServer
+	}
+
+	// Check the token before saving it
+	session, err := client.New(g.server, g.token).CreateSession(ctx)
+	if err != nil {
+		return err
+	}
+
+	path, err := configPath(g.configPath)
+	if err != nil {
+		return err
+	}
+	err = saveConfig(path, config{Server: g.server, Token: g.token})
+	if err != nil {
+		return err
+	}
+
+	if g.json {
+		return printJSON(session)
+	}
+	fmt.Printf("Logged in to %s as %s with scopes %v, saved to %s\n", g.server, session.Subject, session.Scopes, path)
+	return nil
+}
+
+func configPath(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "umami", "config.json"), nil
+}
+
+// loadConfig reads the config file. A missing file is an empty config.
+func loadConfig(path string) (config, error) {
+	cfg := config{}
+	path, err := configPath(path)
+	if err != nil {
+		return cfg, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+
+	err = json.Unmarshal(data, &cfg)
+	if err != nil {
+		return cfg, fmt.Errorf("unable to parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+func saveConfig(path string, cfg config) error {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The file holds a token
+	return os.WriteFile(path, data, 0600)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
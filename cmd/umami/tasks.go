@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+	"umami/pkg/api"
+	"umami/pkg/client"
+)
+
+func tasks(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("tasks expects a subcommand: list, create, edit, queue or cancel")
+	}
+
+	g := globals{}
+	switch args[0] {
+	case "list":
+		fs := newFlagSet("tasks list", &g)
+		positional, err := parseArgs(fs, args[1:], "APP_ID")
+		if err != nil {
+			return err
+		}
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+
+		tasks, err := c.ListTasks(ctx, positional[0])
+		if err != nil {
+			return err
+		}
+		if g.json {
+			return printJSON(tasks)
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATUS\tUPDATED\tPROGRESS\tCOST\tTITLE")
+		for _, t := range tasks {
+			progress := "-"
+			if t.Todos != nil {
+				progress = fmt.Sprintf("%d/%d", t.Todos.Completed, t.Todos.Total)
+			}
+			cost := "-"
+			if t.Usage != nil {
+				cost = fmt.Sprintf("$%.2f", t.Usage.CostUSD)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", t.Id, t.Status, t.Updated.Local().Format(time.DateTime), progress, cost, t.Title)
+		}
+		return tw.Flush()
+	case "create":
+		fs := newFlagSet("tasks create", &g)
+		title := fs.String("title", "", "title of the task")
+		description := fs.String("description", "", "what the agent should do")
+		queue := fs.Bool("queue", false, "queue the task for a runner once created")
+		positional, err := parseArgs(fs, args[1:], "APP_ID")
+		if err != nil {
+			return err
+		}
+		if *title == "" {
+			return fmt.Errorf("tasks create needs -title")
+		}
+		appId := positional[0]
+		c, err := g.client()
+		if err != nil {
+			return err
+		}
+
+		taskId, err := c.CreateTask(ctx, appId, *title, *description)
+		if err != nil {
+			return err
+		}
+		status := api.TaskStatusAuthoring
+		if *queue {
+			status = api.TaskStatusInProgress
+			err = c.UpdateTask(ctx, appId, taskId, client.TaskUpdate{Title: *title, Description: *description, Status: status})
+			if err != nil {
+				return fmt.Errorf("created task %s but unable to queue it: %w", taskId, err)
+			}
+		}
+
+		if g.json {
+			return printJSON(map[string]string{"id": taskId, "status": status})
+		}
+		fmt.Println(taskId)
+		return nil
+	case "edit":
+		fs := newFlagSet("tasks edit", &g)
+		title := fs.String("title", "", "new title")
+		description := fs.String("description", "", "new description")
+		positional, err := parseArgs(fs, args[1:], "APP_ID", "TASK_ID")
+		if err != nil {
+			return err
+		}
+		return updateTask(ctx, &g, positional[0], positional[1], func(update *client.TaskUpdate) error {
+			if *title != "" {
+				update.Title = *title
+			}
+			if *description != "" {
+				update.Description = *description
+			}
+			return nil
+		})
+	case "queue":
+		fs := newFlagSet("tasks queue", &g)
+		positional, err := parseArgs(fs, args[1:], "APP_ID", "TASK_ID")
+		if err != nil {
+			return err
+		}
+		return updateTask(ctx, &g, positional[0], positional[1], func(update *client.TaskUpdate) error {
+			if update.Status == api.TaskStatusInProgress {
+				return fmt.Errorf("task is already queued or running")
+			}
+			update.Status = api.TaskStatusInProgress
+			return nil
+		})
+	case "cancel":
+		fs := newFlagSet("tasks cancel", &g)
+		positional, err := parseArgs(fs, args[1:], "APP_ID", "TASK_ID")
+		if err != nil {
+			return err
+		}
+		return updateTask(ctx, &g, positional[0], positional[1], func(update *client.TaskUpdate) error {
+			if update.Status != api.TaskStatusInProgress {
+				return fmt.Errorf("task is %s, only queued tasks can be cancelled", update.Status)
+			}
+			update.Status = api.TaskStatusCancelled
+			return nil
+		})
+	default:
+		return fmt.Errorf("unknown tasks subcommand %s", args[0])
+	}
+}
+
+// updateTask applies change to the current fields of a task, which change can check first
+func updateTask(ctx context.Context, g *globals, appId, taskId string, change func(update *client.TaskUpdate) error) error {
+	c, err := g.client()
+	if err != nil {
+		return err
+	}
+
+	task, err := findTask(ctx, c, appId, taskId)
+	if err != nil {
+		return err
+	}
+
+	update := client.TaskUpdate{Title: task.Title, Description: task.Description, Status: task.Status}
+	err = change(&update)
+	if err != nil {
+		return err
+	}
+
+	err = c.UpdateTask(ctx, appId, taskId, update)
+	if err != nil {
+		return err
+	}
+
+	if g.json {
+		return printJSON(map[string]string{"id": taskId, "status": update.Status})
+	}
+	fmt.Printf("Task %s is %s\n", taskId, update.Status)
+	return nil
+}
+
+func findTask(ctx context.Context, c *client.Client, appId, taskId string) (*api.Task, error) {
+	tasks, err := c.ListTasks(ctx, appId)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tasks {
+		if t.Id == taskId {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("task %s not found in app %s", taskId, appId)
+}
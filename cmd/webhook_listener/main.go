@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"umami/pkg/webhooks"
+)
+
+// webhook_listener receives webhook deliveries on a local port and prints them, to try
+// webhooks out without a real receiver. With -secret it checks each signature and rejects
+// deliveries that do not match; -status makes it answer with another status, to watch
+// the control plane retry. Webhooks are only sent to local addresses the control plane
+// allows, so start it with -webhook-allowed-networks 127.0.0.0/8 to register this one.
+func main() {
+	addr := flag.String("addr", "localhost:9810", "address to listen on")
+	secret := flag.String("secret", "", "signing secret of the webhook, to verify deliveries")
+	status := flag.Int("status", http.StatusOK, "status to answer verified deliveries with")
+	tolerance := flag.Duration("tolerance", 5*time.Minute, "maximum age of a delivery's timestamp")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to read body: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		event, delivery := r.Header.Get(webhooks.HeaderEvent), r.Header.Get(webhooks.HeaderDelivery)
+		if *secret != "" {
+			err = webhooks.Verify(*secret, r.Header.Get(webhooks.HeaderTimestamp), r.Header.Get(webhooks.HeaderSignature), body, *tolerance)
+			if err != nil {
+				log.Printf("Rejected %s delivery %s: %s", event, delivery, err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, body, "", "  ") != nil {
+			pretty.Reset()
+			pretty.Write(body)
+		}
+		log.Printf("Received %s delivery %s, answering %d\n%s", event, delivery, *status, pretty.String())
+
+		w.WriteHeader(*status)
+	})
+
+	log.Printf("Listening for webhook deliveries on http://%s/", *addr)
+	err := http.ListenAndServe(*addr, nil)
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,257 @@
+// Package api holds the JSON types of the control plane API, as pkg/client sends and
+// receives them. The routes encode the pkg/db types, which have the same JSON form; these
+// carry IDs as strings, so consumers of the API do not depend on the MongoDB driver.
+package api
+
+import "time"
+
+const TaskStatusAuthoring = "authoring"
+const TaskStatusInProgress = "in-progress"
+const TaskStatusCompleted = "completed"
+const TaskStatusCancelled = "cancelled" // Queued tasks in this status are skipped by the runner
+const TaskStatusFailed = "failed"       // The runner could not prepare or finish the task
+
+const EventKindText = "text"
+const EventKindThinking = "thinking"
+const EventKindToolUse = "tool_use"
+const EventKindToolResult = "tool_result"
+const EventKindSystem = "system"
+const EventKindResult = "result"
+const EventKindRaw = "raw" // A line of agent output that is not a stream update
+
+const UsagePeriodDay = "day"
+const UsagePeriodWeek = "week"
+const UsagePeriodMonth = "month"
+
+const AppRoleViewer = "viewer" // Read the app, its tasks and logs
+const AppRoleEditor = "editor" // Also create and update tasks and start the app
+const AppRoleOwner = "owner"   // Also manage who has access and rotate credentials
+
+const GrantKindUser = "user"
+const GrantKindTeam = "team"
+
+type App struct {
+	Id          string     `json:"id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Created     time.Time  `json:"created"`
+	Status      string     `json:"status"`
+	Access      []AppGrant `json:"access"`
+}
+
+// AppGrant gives a user or a team a role on an app
+type AppGrant struct {
+	Kind    string `json:"kind"`    // GrantKindUser or GrantKindTeam
+	Subject string `json:"subject"` // User name or team ID
+	Role    string `json:"role"`
+}
+
+type Task struct {
+	Id          string          `json:"id"`
+	AppId       string          `json:"appId"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Status      string          `json:"status"`
+	Created     time.Time       `json:"created"`
+	Updated     time.Time       `json:"updated"`
+	Usage       *TaskUsage      `json:"usage,omitempty"`
+	Todos       *TodoList       `json:"todos,omitempty"`
+	Redactions  int             `json:"redactions"` // Number of secrets masked in the task's logs
+	Streams     []StreamArchive `json:"streams,omitempty"`
+}
+
+// StreamArchive references the raw agent output of one run of a task in the app's bucket
+type StreamArchive struct {
+	Object  string    `json:"object"`
+	Started time.Time `json:"started"`
+	Size    int64     `json:"size"` // Compressed size in bytes
+}
+
+// TodoList is the agent's latest checklist for a task
+type TodoList struct {
+	Items     []TodoItem `json:"items"`
+	Completed int        `json:"completed"`
+	Total     int        `json:"total"`
+	Current   string     `json:"current,omitempty"` // Active form of the item in progress
+	Updated   time.Time  `json:"updated"`
+}
+
+type TodoItem struct {
+	Content    string `json:"content"`
+	Status     string `json:"status"`
+	ActiveForm string `json:"activeForm"`
+}
+
+type TaskUsage struct {
+	InputTokens              int     `json:"inputTokens"`
+	OutputTokens             int     `json:"outputTokens"`
+	CacheCreationInputTokens int     `json:"cacheCreationInputTokens"`
+	CacheReadInputTokens     int     `json:"cacheReadInputTokens"`
+	CostUSD                  float64 `json:"costUsd"`
+	ReportedCostUSD          float64 `json:"reportedCostUsd"` // As reported by the agent's result event
+	DurationMs               int     `json:"durationMs"`
+	DurationApiMs            int     `json:"durationApiMs"`
+	NumTurns                 int     `json:"numTurns"`
+}
+
+// UsageSummary is the usage of an app over a period, or over the whole range queried
+type UsageSummary struct {
+	AppId  string     `json:"appId"`
+	Period *time.Time `json:"period,omitempty"`
+	Tasks  int        `json:"tasks"` // Tasks that used tokens in the period
+	TaskUsage
+}
+
+// QuotaUsage is how much of a quota is used and when it resets
+type QuotaUsage struct {
+	Quota    string    `json:"quota"`
+	Limit    float64   `json:"limit"`
+	Used     float64   `json:"used"`
+	ResetsAt time.Time `json:"resetsAt,omitzero"`
+}
+
+type Log struct {
+	Id         string              `json:"id"`
+	TaskID     string              `json:"taskId"`
+	Messages   []map[string]string `json:"messages"`
+	EventCount int64               `json:"eventCount"`
+	Events     []*Event            `json:"events"`
+	Todos      *TodoList           `json:"todos,omitempty"`
+}
+
+// Event is a single typed entry of a task's agent stream
+type Event struct {
+	TaskID          string         `json:"taskId"`
+	Seq             int64          `json:"seq"`
+	Time            time.Time      `json:"time"`
+	Kind            string         `json:"kind"`
+	Subtype         string         `json:"subtype,omitempty"`
+	SessionID       string         `json:"sessionId,omitempty"`
+	MessageID       string         `json:"messageId,omitempty"`
+	ParentToolUseID string         `json:"parentToolUseId,omitempty"`
+	Model           string         `json:"model,omitempty"`
+	ToolUseID       string         `json:"toolUseId,omitempty"`
+	ToolName        string         `json:"toolName,omitempty"`
+	ToolInput       map[string]any `json:"toolInput,omitempty"`
+	Text            string         `json:"text,omitempty"`
+	IsError         bool           `json:"isError,omitempty"`
+	FilePath        string         `json:"filePath,omitempty"` // File changed by an Edit, MultiEdit or Write tool use, relative to the repository
+	Diff            string         `json:"diff,omitempty"`     // Unified diff of that change
+	Usage           *EventUsage    `json:"usage,omitempty"`
+	Data            map[string]any `json:"data,omitempty"` // Remaining fields of system and result events
+}
+
+type EventUsage struct {
+	InputTokens              int `json:"inputTokens"`
+	OutputTokens             int `json:"outputTokens"`
+	CacheCreationInputTokens int `json:"cacheCreationInputTokens"`
+	CacheReadInputTokens     int `json:"cacheReadInputTokens"`
+}
+
+// ToolCall is a tool use paired with its result, once there is one
+type ToolCall struct {
+	ToolUseID       string         `json:"toolUseId"`
+	ToolName        string         `json:"toolName"`
+	ToolInput       map[string]any `json:"toolInput,omitempty"`
+	ParentToolUseID string         `json:"parentToolUseId,omitempty"`
+	Time            time.Time      `json:"time"`
+	Completed       bool           `json:"completed"`
+	Result          string         `json:"result,omitempty"`
+	IsError         bool           `json:"isError,omitempty"`
+	ResultTime      *time.Time     `json:"resultTime,omitempty"`
+	FilePath        string         `json:"filePath,omitempty"`
+	Diff            string         `json:"diff,omitempty"`
+}
+
+// FileChanges are the tool calls that changed a file, in order
+type FileChanges struct {
+	Path    string      `json:"path"`
+	Changes []*ToolCall `json:"changes"`
+}
+
+// SearchHit is a task or an event matching a search. Highlights are byte offsets of the
+// matched terms within Snippet.
+type SearchHit struct {
+	Kind       string    `json:"kind"` // task or event
+	AppId      string    `json:"appId"`
+	TaskId     string    `json:"taskId"`
+	TaskTitle  string    `json:"taskTitle"`
+	Seq        int64     `json:"seq,omitempty"`
+	EventKind  string    `json:"eventKind,omitempty"`
+	Field      string    `json:"field"`
+	Snippet    string    `json:"snippet"`
+	Highlights [][2]int  `json:"highlights"`
+	Score      float64   `json:"score"`
+	Time       time.Time `json:"time"`
+}
+
+type AuditRecord struct {
+	Id       string                 `json:"id"`
+	Time     time.Time              `json:"time"`
+	Actor    string                 `json:"actor"`
+	Action   string                 `json:"action"`
+	AppId    string                 `json:"appId,omitempty"`
+	TaskId   string                 `json:"taskId,omitempty"`
+	ClientIP string                 `json:"clientIp"`
+	Changes  map[string]AuditChange `json:"changes,omitempty"`
+}
+
+type AuditChange struct {
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+type APIToken struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Subject string    `json:"subject"` // Identity the token acts as
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"` // Zero for tokens that never expire
+}
+
+type User struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Email   string    `json:"email,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type Team struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Members []string  `json:"members"` // User names
+	Created time.Time `json:"created"`
+}
+
+// Webhook is an endpoint that is sent the events it subscribes to. Webhooks without an app
+// are global and receive the events of every app.
+type Webhook struct {
+	Id        string    `json:"id"`
+	AppId     string    `json:"appId,omitempty"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // Event names, or "*" for every event
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+}
+
+// WebhookDelivery is one event sent to one webhook, with every attempt made to send it
+type WebhookDelivery struct {
+	Id           string           `json:"id"`
+	WebhookId    string           `json:"webhookId"`
+	Event        string           `json:"event"`
+	Payload      string           `json:"payload"` // Request body, the same for every attempt
+	Status       string           `json:"status"`
+	Attempts     []WebhookAttempt `json:"attempts"`
+	NextAttempt  time.Time        `json:"nextAttempt,omitzero"` // Zero once the delivery succeeded or failed
+	RedeliveryOf string           `json:"redeliveryOf,omitempty"`
+	Created      time.Time        `json:"created"`
+}
+
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Response   string    `json:"response,omitempty"` // Start of the response body
+	DurationMs int       `json:"durationMs"`
+}
@@ -0,0 +1,83 @@
+package apierror
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+const CodeBadRequest = "bad_request"             // The body or a parameter could not be parsed
+const CodeValidationFailed = "validation_failed" // One or more fields are invalid, see Fields
+const CodeUnauthorized = "unauthorized"
+const CodeForbidden = "forbidden"
+const CodeNotFound = "not_found"
+const CodeMethodNotAllowed = "method_not_allowed"
+const CodeConflict = "conflict"
+const CodeInvalidTransition = "invalid_transition" // The task cannot move to the requested status
+const CodeRequestTooLarge = "request_too_large"
+const CodeQuotaExceeded = "quota_exceeded" // A quota of the caller or the app does not allow the request
+const CodeInternal = "internal"
+const CodeUnavailable = "unavailable"
+
+// Error is the body of every error response of the API
+type Error struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is a problem with a single field of a request body, or a query parameter
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Write responds with an error. The code is CodeValidationFailed when there are field
+// errors, otherwise the one that matches status.
+func Write(w http.ResponseWriter, status int, message string, fields ...FieldError) {
+	code := CodeFor(status)
+	if len(fields) > 0 {
+		code = CodeValidationFailed
+	}
+	WriteCode(w, status, code, message, fields...)
+}
+
+// WriteCode responds with an error that has a more specific code than its status
+func WriteCode(w http.ResponseWriter, status int, code string, message string, fields ...FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(Error{Code: code, Message: message, Fields: fields})
+	if err != nil {
+		log.Printf("Unable to marshal error response %s", err)
+	}
+}
+
+// CodeFor returns the code of errors with the given status
+func CodeFor(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusRequestEntityTooLarge:
+		return CodeRequestTooLarge
+	case http.StatusTooManyRequests:
+		return CodeQuotaExceeded
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	if status >= http.StatusInternalServerError {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
@@ -0,0 +1,34 @@
+package apps
+
+import (
+	"context"
+	"fmt"
+	"umami/pkg/db"
+	"umami/pkg/secrets"
+	"umami/pkg/utils"
+)
+
+// Env returns the environment an app's processes need to reach their own resources.
+// This is the only place app credentials are decrypted, and only runners call it: for
+// the agents of tasks and for the app processes they start.
+func Env(ctx context.Context, app *db.App, keys secrets.KeyProvider) ([]string, error) {
+	password, err := appPassword(ctx, app, keys)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decrypt app credentials: %w", err)
+	}
+
+	return []string{
+		fmt.Sprintf("MONGO_CONNECTION_STRING=mongodb://%s:%s@localhost:27017", app.User, password),
+		fmt.Sprintf("MONGO_DB_NAME=%s", app.Database),
+		fmt.Sprintf("APP_BUCKET_NAME=%s", fmt.Sprintf("umami-bucket-%s", utils.GetName(app.Name))),
+	}, nil
+}
+
+func appPassword(ctx context.Context, app *db.App, keys secrets.KeyProvider) (string, error) {
+	// Apps created before credentials were encrypted still carry a plaintext password
+	if app.EncryptedPassword == nil {
+		return app.Password, nil
+	}
+
+	return secrets.Open(ctx, keys, app.EncryptedPassword)
+}
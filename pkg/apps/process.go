@@ -0,0 +1,142 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"time"
+	"umami/pkg/db"
+	"umami/pkg/pubsub"
+	"umami/pkg/secrets"
+)
+
+// ErrStartTimeout is returned when no runner started the app in time
+var ErrStartTimeout = errors.New("no runner started the app in time")
+
+const (
+	startTimeout      = 30 * time.Second // Bounds waiting for a runner to start an app
+	startPollInterval = 250 * time.Millisecond
+)
+
+// Dirs are the directories apps live in on the host
+type Dirs struct {
+	Repositories string // A git repository per app, named by its ID
+	Logs         string // Output of the app processes
+}
+
+// Repository is the directory of the app's repository
+func (d Dirs) Repository(appId string) string {
+	return filepath.Join(d.Repositories, appId)
+}
+
+// RequestStart asks a runner to start the app on a random high port, restarting it if it
+// is running, and waits until it has. It returns the port.
+func RequestStart(ctx context.Context, appId string, queue pubsub.PubSub, cache pubsub.Cache) (int, error) {
+	port := randomPort()
+	err := queue.SendAppStart(ctx, appId, port)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	ticker := time.NewTicker(startPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return 0, ErrStartTimeout
+			}
+			return 0, ctx.Err()
+		case <-ticker.C:
+		}
+
+		started, err := cache.GetAppPort(ctx, appId)
+		if err == nil && started == port {
+			return port, nil
+		}
+	}
+}
+
+// randomPort is a high port for an app process
+func randomPort() int {
+	return rand.Intn(65535-1024) + 1024
+}
+
+// Start runs the app's run.sh on port, killing any process previously started for the
+// app. Only runners start apps, as they decrypt the app's credentials for its environment.
+func Start(ctx context.Context, app *db.App, dirs Dirs, cache pubsub.Cache, keys secrets.KeyProvider, port int) error {
+	appId := app.Id.Hex()
+
+	// Check if redis has app to port mapping
+	pid, err := cache.GetAppPid(ctx, appId)
+	if err == nil {
+		// Kill Process
+		err := syscall.Kill(pid, syscall.SIGKILL)
+		if err != nil {
+			log.Printf("Could not kill running application with pid: %d. Error %s", pid, err)
+		}
+	}
+
+	appEnv, err := Env(ctx, app, keys)
+	if err != nil {
+		return err
+	}
+
+	// Create log file
+	appLog, err := os.OpenFile(filepath.Join(dirs.Logs, appId+".log"), os.O_RDWR|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	defer appLog.Close()
+
+	// Start app in right directory by running ./run.sh <port>
+	cmd := exec.Command("./run.sh", fmt.Sprintf("%d", port))
+	cmd.Dir = dirs.Repository(appId)
+	cmd.Env = append(os.Environ(), appEnv...)
+	cmd.Stdout = appLog
+	cmd.Stderr = appLog
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setsid: true,
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Add app to redis
+	err = cache.SetAppPid(ctx, appId, cmd.Process.Pid)
+	if err != nil {
+		return fmt.Errorf("unable to set app pid: %w", err)
+	}
+
+	cmd.Process.Release()
+
+	// Control planes waiting for the app to start look for its port
+	err = cache.SetAppPort(ctx, appId, port)
+	if err != nil {
+		return fmt.Errorf("unable to set app port: %w", err)
+	}
+
+	return nil
+}
+
+// IsRunning reports whether the process last started for the app is still alive
+func IsRunning(ctx context.Context, appId string, cache pubsub.Cache) bool {
+	pid, err := cache.GetAppPid(ctx, appId)
+	if err != nil {
+		return false
+	}
+
+	return syscall.Kill(pid, 0) == nil
+}
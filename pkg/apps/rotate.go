@@ -0,0 +1,103 @@
+package apps
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+	"umami/pkg/db"
+	"umami/pkg/pubsub"
+	"umami/pkg/secrets"
+	"umami/pkg/utils"
+)
+
+// ErrAppBusy is returned when a task for the app is running. Its agent was started with
+// the current password, so rotating now would break it mid-flight.
+var ErrAppBusy = errors.New("app has a task in progress")
+
+// RotateCredentials gives the app's database user a new password and asks a runner to
+// restart the app process, if it is running, so that it picks the new password up. The
+// app lock is held throughout so no task starts with a credential that is about to change.
+func RotateCredentials(ctx context.Context, app *db.App, dbConn db.DB, queue pubsub.PubSub, cache pubsub.Cache, keys secrets.KeyProvider) error {
+	appId := app.Id.Hex()
+
+	token, locked, err := queue.TryLock(ctx, appId)
+	if err != nil {
+		return err
+	}
+	if !locked {
+		return ErrAppBusy
+	}
+	defer func() {
+		err := queue.ReleaseLock(context.Background(), appId, token)
+		if err != nil {
+			log.Printf("Unable to release the lock of app %s %s", appId, err)
+		}
+	}()
+
+	password := utils.RandStringBytes(db.AppPasswordLength)
+	encrypted, err := secrets.Seal(ctx, keys, password)
+	if err != nil {
+		return fmt.Errorf("unable to encrypt app credentials: %w", err)
+	}
+
+	err = dbConn.RotateAppPassword(ctx, app, password, encrypted)
+	if err != nil {
+		return fmt.Errorf("unable to rotate app credentials: %w", err)
+	}
+	app.EncryptedPassword = encrypted
+	app.Password = ""
+
+	if IsRunning(ctx, appId, cache) {
+		log.Printf("Restarting app %s after credential rotation", appId)
+		err = queue.SendAppStart(ctx, appId, randomPort())
+		if err != nil {
+			return fmt.Errorf("credentials rotated but unable to restart app: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// RotateCredentialsPeriodically rotates the credentials of every app whose password is
+// older than maxAge, checking every interval. Busy apps are retried on the next check.
+func RotateCredentialsPeriodically(ctx context.Context, interval, maxAge time.Duration, dbConn db.DB, queue pubsub.PubSub, cache pubsub.Cache, keys secrets.KeyProvider) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		allApps, err := dbConn.GetApps(ctx)
+		if err != nil {
+			log.Printf("Credential rotation unable to list apps %s", err)
+			continue
+		}
+
+		for _, app := range allApps {
+			lastRotated := app.PasswordRotated
+			if lastRotated.IsZero() {
+				lastRotated = app.Created
+			}
+			if time.Since(lastRotated) < maxAge {
+				continue
+			}
+
+			err := RotateCredentials(ctx, app, dbConn, queue, cache, keys)
+			if errors.Is(err, ErrAppBusy) {
+				log.Printf("Credential rotation postponed for busy app %s", app.Id.Hex())
+				continue
+			}
+			if err != nil {
+				log.Printf("Credential rotation failed for app %s: %s", app.Id.Hex(), err)
+				continue
+			}
+			log.Printf("Rotated credentials for app %s", app.Id.Hex())
+		}
+	}
+}
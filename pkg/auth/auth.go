@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+)
+
+const ScopeRead = "read"   // Read apps, tasks, logs and usage
+const ScopeWrite = "write" // Create and change apps and tasks, start apps
+const ScopeAdmin = "admin" // Manage tokens and read the audit log
+
+const IdentityKindToken = "token"
+const IdentityKindSession = "session"
+
+const SessionCookie = "umami_session"
+
+// SessionPath is where the UI exchanges a token for a session. Signing in only needs the read scope.
+const SessionPath = "/api/v1/auth/session"
+
+var ErrUnauthenticated = errors.New("missing credentials")
+var ErrInvalidCredentials = errors.New("invalid or expired credentials")
+
+// Identity is the authenticated caller of a request
+type Identity struct {
+	Subject string
+	Kind    string // IdentityKindToken or IdentityKindSession
+	TokenId string // API token the caller authenticated with, directly or through a session
+	Scopes  []string
+	Expires time.Time // Zero for tokens that never expire
+}
+
+// HasScope reports whether the identity grants scope. Admin implies write and write implies read.
+func (i *Identity) HasScope(scope string) bool {
+	switch {
+	case slices.Contains(i.Scopes, ScopeAdmin):
+		return true
+	case slices.Contains(i.Scopes, ScopeWrite):
+		return scope != ScopeAdmin
+	default:
+		return slices.Contains(i.Scopes, scope)
+	}
+}
+
+type identityKey struct{}
+
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the identity attached by the middleware, if any
+func FromContext(ctx context.Context) (*Identity, bool) {
+	identity, ok := ctx.Value(identityKey{}).(*Identity)
+	return identity, ok
+}
+
+// ValidScope reports whether scope is one of the known scopes
+func ValidScope(scope string) bool {
+	return scope == ScopeRead || scope == ScopeWrite || scope == ScopeAdmin
+}
+
+type Authenticator struct {
+	database   db.DB
+	sessionKey []byte
+}
+
+func NewAuthenticator(database db.DB, sessionKey []byte) *Authenticator {
+	return &Authenticator{
+		database:   database,
+		sessionKey: sessionKey,
+	}
+}
+
+// Authenticate resolves the caller from an Authorization bearer token, which may be an API
+// token or a session token, or from the session cookie set for the UI.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := ""
+	if header := r.Header.Get("Authorization"); header != "" {
+		scheme, value, ok := strings.Cut(header, " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") {
+			return nil, ErrInvalidCredentials
+		}
+		token = strings.TrimSpace(value)
+	} else if cookie, err := r.Cookie(SessionCookie); err == nil {
+		token = cookie.Value
+	}
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	if strings.HasPrefix(token, apiTokenPrefix) {
+		return a.authenticateAPIToken(r.Context(), token)
+	}
+	return a.VerifySession(token)
+}
+
+func (a *Authenticator) authenticateAPIToken(ctx context.Context, token string) (*Identity, error) {
+	apiToken, err := a.database.GetAPITokenByHash(ctx, HashAPIToken(token))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up token: %w", err)
+	}
+
+	if !apiToken.Expires.IsZero() && time.Now().After(apiToken.Expires) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Subject: apiToken.Subject,
+		Kind:    IdentityKindToken,
+		TokenId: apiToken.Id.Hex(),
+		Scopes:  apiToken.Scopes,
+		Expires: apiToken.Expires,
+	}, nil
+}
+
+// Middleware authenticates every request to next and attaches the caller's identity to its
+// context. Safe methods need the read scope and all others the write scope; handlers that need
+// more wrap themselves with Require.
+func Middleware(a *Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity, err := a.Authenticate(r)
+		if errors.Is(err, ErrUnauthenticated) || errors.Is(err, ErrInvalidCredentials) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="umami"`)
+			apierror.Write(w, http.StatusUnauthorized, fmt.Sprintf("Unauthorized: %s", err))
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to authenticate: %s", err))
+			return
+		}
+
+		scope := ScopeWrite
+		switch {
+		case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+			scope = ScopeRead
+		case r.URL.Path == SessionPath:
+			scope = ScopeRead
+		}
+		if !identity.HasScope(scope) {
+			apierror.Write(w, http.StatusForbidden, fmt.Sprintf("Forbidden: requires scope %s", scope))
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithIdentity(r.Context(), identity)))
+	})
+}
+
+// Require wraps a handler that needs scope beyond what the middleware checks by method
+func Require(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := FromContext(r.Context())
+		if !ok || !identity.HasScope(scope) {
+			apierror.Write(w, http.StatusForbidden, fmt.Sprintf("Forbidden: requires scope %s", scope))
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const sessionVersion = "v1"
+
+const sessionKeySize = 32
+
+// SessionTTL is how long a session token issued to the UI is valid
+const SessionTTL = 12 * time.Hour
+
+type sessionClaims struct {
+	Subject  string   `json:"sub"`
+	TokenId  string   `json:"tid"`
+	Scopes   []string `json:"scopes"`
+	IssuedAt int64    `json:"iat"`
+	Expires  int64    `json:"exp"`
+}
+
+// LoadSessionKey reads the key that signs session tokens, creating it if it does not exist
+func LoadSessionKey(path string) ([]byte, error) {
+	key, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key = make([]byte, sessionKeySize)
+		_, err = rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+		return key, os.WriteFile(path, key, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) < sessionKeySize {
+		return nil, fmt.Errorf("session key %s is shorter than %d bytes", path, sessionKeySize)
+	}
+
+	return key, nil
+}
+
+// IssueSession returns a signed session token for identity. The session never outlives the
+// token it was issued from, but deleting that token does not end it before SessionTTL.
+func (a *Authenticator) IssueSession(identity *Identity) (string, time.Time, error) {
+	now := time.Now()
+	expires := now.Add(SessionTTL)
+	if !identity.Expires.IsZero() && identity.Expires.Before(expires) {
+		expires = identity.Expires
+	}
+
+	payload, err := json.Marshal(sessionClaims{
+		Subject:  identity.Subject,
+		TokenId:  identity.TokenId,
+		Scopes:   identity.Scopes,
+		IssuedAt: now.Unix(),
+		Expires:  expires.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signed := sessionVersion + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + a.sign(signed), expires, nil
+}
+
+// VerifySession checks the signature and expiry of a session token
+func (a *Authenticator) VerifySession(token string) (*Identity, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !strings.HasPrefix(token, sessionVersion+".") {
+		return nil, ErrInvalidCredentials
+	}
+	signed, signature := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(a.sign(signed))) {
+		return nil, ErrInvalidCredentials
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(signed, sessionVersion+"."))
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	var claims sessionClaims
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	expires := time.Unix(claims.Expires, 0)
+	if time.Now().After(expires) {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Subject: claims.Subject,
+		Kind:    IdentityKindSession,
+		TokenId: claims.TokenId,
+		Scopes:  claims.Scopes,
+		Expires: expires,
+	}, nil
+}
+
+func (a *Authenticator) sign(s string) string {
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
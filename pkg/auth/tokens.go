@@ -0,0 +1,33 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// API tokens carry a prefix so they can be told apart from session tokens and spotted by
+// secret scanners
+const apiTokenPrefix = "umami_"
+
+const apiTokenBytes = 32
+
+// NewAPIToken returns a new random API token and the hash to store for it
+func NewAPIToken() (token string, hash string, err error) {
+	b := make([]byte, apiTokenBytes)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+
+	token = apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	return token, HashAPIToken(token), nil
+}
+
+// HashAPIToken returns the stored form of an API token. Tokens are long and random, so an
+// unsalted SHA-256 is enough to make a leaked tokens collection useless.
+func HashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
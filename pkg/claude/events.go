@@ -0,0 +1,92 @@
+package claude
+
+import (
+	"time"
+	"umami/pkg/db"
+)
+
+// Events converts a stream update into typed events. An assistant or user message yields
+// one event per content block; system and result updates yield a single event.
+func (u *Update) Events(now time.Time) []*db.Event {
+	events := []*db.Event{}
+
+	switch u.Type {
+	case "system":
+		events = append(events, &db.Event{
+			Time:      now,
+			Kind:      db.EventKindSystem,
+			Subtype:   u.Subtype,
+			SessionID: u.SessionID,
+			Model:     u.Model,
+			Data: map[string]any{
+				"cwd":   u.Cwd,
+				"tools": u.Tools,
+			},
+		})
+	case "result":
+		events = append(events, &db.Event{
+			Time:      now,
+			Kind:      db.EventKindResult,
+			Subtype:   u.Subtype,
+			SessionID: u.SessionID,
+			Text:      u.Result,
+			IsError:   u.IsError,
+			Usage:     eventUsage(u.Usage),
+			Data: map[string]any{
+				"durationMs":    u.DurationMs,
+				"durationApiMs": u.DurationApi,
+				"numTurns":      u.NumTurns,
+				"totalCostUsd":  u.TotalCostUSD,
+			},
+		})
+	case "assistant", "user":
+		for _, c := range u.Message.Content {
+			e := &db.Event{
+				Time:            now,
+				SessionID:       u.SessionID,
+				MessageID:       u.Message.ID,
+				ParentToolUseID: u.ParentToolUseID,
+				Model:           u.Message.Model,
+			}
+
+			switch c.Type {
+			case "text":
+				e.Kind = db.EventKindText
+				e.Text = c.Text
+			case "thinking":
+				e.Kind = db.EventKindThinking
+				e.Text = c.Thinking
+			case "tool_use":
+				e.Kind = db.EventKindToolUse
+				e.ToolUseID = c.ID
+				e.ToolName = c.Name
+				e.ToolInput = c.Input
+			case "tool_result":
+				e.Kind = db.EventKindToolResult
+				e.ToolUseID = c.ToolUseID
+				e.Text = c.ResultText()
+				e.IsError = c.IsError
+			default:
+				continue
+			}
+
+			events = append(events, e)
+		}
+
+		// Usage belongs to the message, so it is carried by its first event only
+		if u.Type == "assistant" && len(events) > 0 {
+			events[0].Usage = eventUsage(u.Message.Usage)
+		}
+	}
+
+	return events
+}
+
+func eventUsage(usage UpdateUsage) *db.EventUsage {
+	return &db.EventUsage{
+		InputTokens:              usage.InputTokens,
+		OutputTokens:             usage.OutputTokens,
+		CacheCreationInputTokens: usage.CacheCreationInputTokens,
+		CacheReadInputTokens:     usage.CacheReadInputTokens,
+	}
+}
@@ -0,0 +1,96 @@
+package claude
+
+import (
+	"path/filepath"
+	"strings"
+	"umami/pkg/db"
+	"umami/pkg/diff"
+)
+
+const diffContextLines = 3
+
+// annotateFileChange sets the file path and diff of an Edit, MultiEdit or Write tool use.
+// The diff is built from the tool input alone: the file on disk may already have been
+// changed by the time the event is read, and reading it would hold up the agent's output.
+// Tool uses of files outside workDir are left without a path or diff.
+func annotateFileChange(workDir string, e *db.Event) {
+	if e.Kind != db.EventKindToolUse {
+		return
+	}
+
+	filePath, _ := e.ToolInput["file_path"].(string)
+	if filePath == "" {
+		return
+	}
+
+	switch e.ToolName {
+	case "Edit", "MultiEdit", "Write":
+	default:
+		return
+	}
+
+	if !filepath.IsAbs(filePath) {
+		filePath = filepath.Join(workDir, filePath)
+	}
+	rel, ok := relativePath(workDir, filePath)
+	if !ok {
+		return
+	}
+	e.FilePath = rel
+
+	fromName := "a/" + rel
+	var before, after string
+	if e.ToolName == "Write" {
+		// Whether the file existed is not known from the input, so its content is shown
+		// as a new file
+		fromName = "/dev/null"
+		after, _ = e.ToolInput["content"].(string)
+	} else {
+		before, after = editFragments(e.ToolInput)
+	}
+
+	e.Diff = diff.Unified(fromName, "b/"+rel, before, after, diffContextLines)
+}
+
+func editFragments(input map[string]any) (before string, after string) {
+	if edits, ok := input["edits"].([]any); ok {
+		for _, edit := range edits {
+			if e, ok := edit.(map[string]any); ok {
+				b, a := editFragments(e)
+				before += b
+				after += a
+			}
+		}
+		return before, after
+	}
+
+	before, _ = input["old_string"].(string)
+	after, _ = input["new_string"].(string)
+	return ensureNewline(before), ensureNewline(after)
+}
+
+func ensureNewline(s string) string {
+	if s == "" || strings.HasSuffix(s, "\n") {
+		return s
+	}
+	return s + "\n"
+}
+
+// relativePath returns path relative to workDir, with forward slashes. Both are made
+// absolute and clean first, as workDir is usually relative to the runner's directory and
+// the agent reports absolute paths. It reports false for a path outside workDir.
+func relativePath(workDir, path string) (string, bool) {
+	absWorkDir, err := filepath.Abs(workDir)
+	if err != nil {
+		return "", false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(absWorkDir, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
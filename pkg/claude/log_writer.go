@@ -1,116 +1,296 @@
 package claude
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"log"
-	"strings"
+	"path/filepath"
+	"sync"
 	"time"
 	"umami/pkg/db"
+	"umami/pkg/metrics"
+	"umami/pkg/redact"
+	"umami/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	logBatchSize     = 50
+	logFlushInterval = time.Second
+	logWriteTimeout  = 10 * time.Second
+)
+
+var (
+	agentTokens      = metrics.NewCounter("umami_agent_tokens_total", "Tokens used by agents, by type: input, output, cacheCreation or cacheRead.", "type")
+	agentCost        = metrics.NewCounter("umami_agent_cost_usd_total", "Cost of agent messages, priced with the price table.")
+	logEvents        = metrics.NewCounter("umami_log_events_total", "Task events parsed from agent output.")
+	logBatchDuration = metrics.NewHistogram("umami_log_batch_duration_seconds", "Time to write a batch of task events to the database, by outcome: success or spooled.", metrics.LatencyBuckets, "outcome")
 )
 
+// LogWriter turns the agent's stream-json output into task events. Lines are parsed and
+// scrubbed of secrets as they arrive, but events, usage and todos are written to the database in batches by a
+// background flusher, so a slow database never stalls the agent. Batches that cannot be
+// written are spooled to a local file and replayed, in order, before the next batch.
 type LogWriter struct {
-	dbClient db.DB
-	taskID   string
-	buffer   strings.Builder
+	dbClient  db.DB
+	taskID    string
+	workDir   string // Repository the agent works in, used to render file diffs
+	spoolPath string
+	prices    PriceTable
+	redactor  *redact.Redactor
+	parent    trace.SpanContext // Parent of the spans of batch writes
+	buffer    []byte            // Incomplete trailing line
+	// Each content block of a message is streamed as its own update carrying the
+	// same usage, so usage is only counted for the first update of a message
+	seenMessages map[string]struct{}
+
+	mu         sync.Mutex
+	events     []*db.Event
+	usage      *db.TaskUsage
+	todos      *db.TodoList
+	redactions int
+	flushMu    sync.Mutex // Serialises flushes so batches are written in order
+	kick       chan struct{}
+	stop       chan struct{}
+	stopped    chan struct{}
+	stopOnce   sync.Once
 }
 
-func NewLogWriter(dbClient db.DB, taskID string) *LogWriter {
-	return &LogWriter{
-		dbClient: dbClient,
-		taskID:   taskID,
+// NewLogWriter starts the background flusher. ctx only parents the spans of batch writes;
+// batches are written even once it is cancelled.
+func NewLogWriter(ctx context.Context, dbClient db.DB, taskID string, workDir string, spoolDir string, prices PriceTable, redactor *redact.Redactor) *LogWriter {
+	l := &LogWriter{
+		dbClient:     dbClient,
+		taskID:       taskID,
+		workDir:      workDir,
+		spoolPath:    filepath.Join(spoolDir, taskID+spoolExtension),
+		prices:       prices,
+		redactor:     redactor,
+		parent:       trace.SpanContextFromContext(ctx),
+		seenMessages: map[string]struct{}{},
+		kick:         make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
 	}
+
+	go l.flushLoop()
+
+	return l
 }
 
 func (l *LogWriter) Write(p []byte) (n int, err error) {
-	// Add incoming bytes to buffer
-	l.buffer.Write(p)
+	l.buffer = append(l.buffer, p...)
 
-	// Process complete lines from buffer
-	l.processCompleteLines()
+	// Process every complete line, keeping a trailing partial line for the next write
+	for {
+		i := bytes.IndexByte(l.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		l.processLine(l.buffer[:i])
+		l.buffer = l.buffer[i+1:]
+	}
 
 	return len(p), nil
 }
 
-func (l *LogWriter) processCompleteLines() {
-	bufferContent := l.buffer.String()
-	scanner := bufio.NewScanner(strings.NewReader(bufferContent))
-
-	var processedLines []string
-	var lastIncomplete string
-
-	// Process each line
-	for scanner.Scan() {
-		line := scanner.Text()
-		if l.processJSONLine(line) {
-			processedLines = append(processedLines, line)
-		} else {
-			// This line might be incomplete JSON, keep it for next time
-			lastIncomplete = line
-		}
+func (l *LogWriter) processLine(line []byte) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+
+	now := time.Now()
+	u := Update{}
+	err := json.Unmarshal(line, &u)
+	if err != nil {
+		// A complete line that is not an update is kept verbatim rather than dropped
+		log.Printf("LogWriter: Unable to unmarshal update, storing it raw: %s", err)
+		text, redactions := l.redactor.String(string(line))
+		l.enqueue([]*db.Event{{Time: now, Kind: db.EventKindRaw, Text: text}}, nil, nil, redactions)
+		return
 	}
 
-	// Reset buffer with any incomplete line
-	l.buffer.Reset()
-	if lastIncomplete != "" {
-		l.buffer.WriteString(lastIncomplete)
+	usage := l.updateUsage(&u)
+	if usage != nil {
+		agentTokens.Add(float64(usage.InputTokens), "input")
+		agentTokens.Add(float64(usage.OutputTokens), "output")
+		agentTokens.Add(float64(usage.CacheCreationInputTokens), "cacheCreation")
+		agentTokens.Add(float64(usage.CacheReadInputTokens), "cacheRead")
+		agentCost.Add(usage.CostUSD)
 	}
+
+	events := u.Events(now)
+	var todos *db.TodoList
+	redactions := 0
+	for _, e := range events {
+		annotateFileChange(l.workDir, e)
+		redactions += redactEvent(l.redactor, e)
+		if t := db.TodoListFromEvent(e); t != nil {
+			todos = t
+		}
+	}
+
+	l.enqueue(events, usage, todos, redactions)
 }
 
-func (l *LogWriter) processJSONLine(line string) bool {
-	line = strings.TrimSpace(line)
-	if line == "" {
-		return true // Empty lines are "processed"
+func (l *LogWriter) updateUsage(u *Update) *db.TaskUsage {
+	usage := db.TaskUsage{}
+
+	switch u.Type {
+	case "assistant":
+		if u.Message.ID == "" {
+			return nil
+		}
+		if _, seen := l.seenMessages[u.Message.ID]; seen {
+			return nil
+		}
+		l.seenMessages[u.Message.ID] = struct{}{}
+
+		usage.InputTokens = u.Message.Usage.InputTokens
+		usage.OutputTokens = u.Message.Usage.OutputTokens
+		usage.CacheCreationInputTokens = u.Message.Usage.CacheCreationInputTokens
+		usage.CacheReadInputTokens = u.Message.Usage.CacheReadInputTokens
+		usage.CostUSD = l.prices.Cost(u.Message.Model, u.Message.Usage)
+	case "result":
+		usage.ReportedCostUSD = u.TotalCostUSD
+		usage.DurationMs = u.DurationMs
+		usage.DurationApiMs = u.DurationApi
+		usage.NumTurns = u.NumTurns
+	default:
+		return nil
 	}
 
-	log.Printf("LogWriter: Processing line: %s", line)
+	return &usage
+}
 
-	ctx := context.Background()
-	u := Update{}
-	err := json.Unmarshal([]byte(line), &u)
-	if err != nil {
-		log.Printf("LogWriter: Unable to unmarshal update (might be partial): %s", err)
-		return false // Not processed, might be incomplete
-	}
-
-	messages := []map[string]string{}
-
-	for _, c := range u.Message.Content {
-		switch c.Type {
-		case "text":
-			messages = append(messages, map[string]string{
-				"time":  time.Now().Format(time.RFC3339),
-				"title": "update",
-				"text":  c.Text,
-			})
-		case "tool_use":
-			messages = append(messages, map[string]string{
-				"title": "tool",
-				"text":  c.Name,
-			})
+func (l *LogWriter) enqueue(events []*db.Event, usage *db.TaskUsage, todos *db.TodoList, redactions int) {
+	logEvents.Add(float64(len(events)))
+
+	l.mu.Lock()
+	l.events = append(l.events, events...)
+	if usage != nil {
+		if l.usage == nil {
+			l.usage = &db.TaskUsage{}
+		}
+		l.usage.Add(*usage)
+	}
+	if todos != nil {
+		l.todos = todos
+	}
+	l.redactions += redactions
+	full := len(l.events) >= logBatchSize
+	l.mu.Unlock()
+
+	if full {
+		select {
+		case l.kick <- struct{}{}:
+		default:
 		}
 	}
+}
+
+func (l *LogWriter) flushLoop() {
+	defer close(l.stopped)
 
-	if len(messages) > 0 {
-		err = l.dbClient.InsertLog(ctx, l.taskID, messages)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		case <-l.kick:
+		}
+
+		err := l.flush()
 		if err != nil {
-			log.Printf("LogWriter: Unable to insert log %s", err)
-			return false
+			log.Printf("LogWriter: Unable to write batch for task %s, spooled to %s: %s", l.taskID, l.spoolPath, err)
 		}
 	}
+}
+
+// flush writes any spooled batches followed by the pending batch. Whatever cannot be
+// written stays in the spool file.
+func (l *LogWriter) flush() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+
+	records, err := readSpool(l.spoolPath)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	batch := spoolRecords(l.taskID, l.events, l.usage, l.todos, l.redactions)
+	l.events, l.usage, l.todos, l.redactions = nil, nil, nil, 0
+	l.mu.Unlock()
+
+	if len(records) == 0 && len(batch) == 0 {
+		return nil
+	}
+	records = append(records, batch...)
 
-	return true // Successfully processed
+	ctx, cancel := context.WithTimeout(trace.ContextWithSpanContext(context.Background(), l.parent), logWriteTimeout)
+	defer cancel()
+	ctx, span := tracing.Tracer.Start(ctx, "logs.write", trace.WithAttributes(
+		attribute.String("task.id", l.taskID),
+		attribute.Int("records", len(records)),
+	))
+
+	started := time.Now()
+	remaining, applyErr := applySpoolRecords(ctx, l.dbClient, records)
+	outcome := "success"
+	if applyErr != nil {
+		outcome = "spooled"
+	}
+	logBatchDuration.Observe(time.Since(started).Seconds(), outcome)
+	span.SetAttributes(attribute.Int("spooled", len(remaining)))
+	tracing.End(span, applyErr)
+
+	err = writeSpool(l.spoolPath, remaining)
+	if err != nil {
+		// Neither the database nor the spool took the batch, so it is lost
+		log.Printf("LogWriter: Unable to spool %d records for task %s: %s", len(remaining), l.taskID, err)
+		return err
+	}
+
+	return applyErr
 }
 
-// Flush processes any remaining buffered content
-// Call this when you're done writing to ensure no data is lost
+// Flush processes any incomplete trailing line, writes everything buffered and stops the
+// background flusher. Call it once the agent has exited; the writer must not be used after.
+// An error means some records remain spooled and will be replayed by ReplaySpool.
 func (l *LogWriter) Flush() error {
-	remaining := strings.TrimSpace(l.buffer.String())
-	if remaining != "" {
-		log.Printf("LogWriter: Flushing remaining buffer: %s", remaining)
-		l.processJSONLine(remaining)
+	if len(bytes.TrimSpace(l.buffer)) > 0 {
+		log.Printf("LogWriter: Flushing remaining buffer: %s", l.buffer)
+		l.processLine(l.buffer)
+	}
+	l.buffer = nil
+
+	l.stopOnce.Do(func() { close(l.stop) })
+	<-l.stopped
+
+	return l.flush()
+}
+
+// redactEvent masks secrets in every free-form field of e and returns the number masked
+func redactEvent(r *redact.Redactor, e *db.Event) int {
+	var count, n int
+
+	e.Text, n = r.String(e.Text)
+	count += n
+	e.Diff, n = r.String(e.Diff)
+	count += n
+
+	for _, fields := range []map[string]any{e.ToolInput, e.Data} {
+		_, n = r.Value(fields)
+		count += n
 	}
-	l.buffer.Reset()
-	return nil
+
+	return count
 }
@@ -0,0 +1,72 @@
+package claude
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// ModelPrice is the price in USD per million tokens for a model.
+type ModelPrice struct {
+	Input      float64 `json:"input"`
+	Output     float64 `json:"output"`
+	CacheWrite float64 `json:"cacheWrite"`
+	CacheRead  float64 `json:"cacheRead"`
+}
+
+// PriceTable maps a model name, or a prefix of it, to its price.
+type PriceTable map[string]ModelPrice
+
+var DefaultPriceTable = PriceTable{
+	"claude-opus-4":     {Input: 15, Output: 75, CacheWrite: 18.75, CacheRead: 1.5},
+	"claude-sonnet-4":   {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-7-sonnet": {Input: 3, Output: 15, CacheWrite: 3.75, CacheRead: 0.3},
+	"claude-3-5-haiku":  {Input: 0.8, Output: 4, CacheWrite: 1, CacheRead: 0.08},
+}
+
+// LoadPriceTable reads a JSON price table from path. An empty path returns the default table.
+func LoadPriceTable(path string) (PriceTable, error) {
+	if path == "" {
+		return DefaultPriceTable, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	prices := PriceTable{}
+	err = json.Unmarshal(data, &prices)
+	if err != nil {
+		return nil, err
+	}
+
+	return prices, nil
+}
+
+// Price returns the price for model, matching the longest configured prefix so that
+// dated model names such as claude-sonnet-4-20250514 resolve to claude-sonnet-4.
+func (p PriceTable) Price(model string) (ModelPrice, bool) {
+	best := ""
+	for name := range p {
+		if strings.HasPrefix(model, name) && len(name) > len(best) {
+			best = name
+		}
+	}
+	if best == "" {
+		return ModelPrice{}, false
+	}
+	return p[best], true
+}
+
+func (p PriceTable) Cost(model string, usage UpdateUsage) float64 {
+	price, ok := p.Price(model)
+	if !ok {
+		return 0
+	}
+
+	return (float64(usage.InputTokens)*price.Input +
+		float64(usage.OutputTokens)*price.Output +
+		float64(usage.CacheCreationInputTokens)*price.CacheWrite +
+		float64(usage.CacheReadInputTokens)*price.CacheRead) / 1_000_000
+}
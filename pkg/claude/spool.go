@@ -0,0 +1,202 @@
+package claude
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"umami/pkg/db"
+
+	"github.com/google/uuid"
+)
+
+const spoolExtension = ".spool.jsonl"
+
+// spoolRecord is a single database write of a task's log. Each record is applied on its
+// own so a replay that fails part way resumes from the failed record.
+type spoolRecord struct {
+	TaskID string        `json:"taskId"`
+	Events []*db.Event   `json:"events,omitempty"`
+	Usage  *db.TaskUsage `json:"usage,omitempty"`
+	Todos  *db.TodoList  `json:"todos,omitempty"`
+	// Redactions is the number of secrets masked in the task's events
+	Redactions int `json:"redactions,omitempty"`
+
+	// Usage and redactions are added to totals, so they carry an ID that the database
+	// applies once, and the time the usage is counted at
+	Batch string    `json:"batch,omitempty"`
+	Time  time.Time `json:"time,omitzero"`
+}
+
+// identify gives a record that adds to totals its batch ID and time, unless it has them.
+// Records spooled before batches had IDs get them when they are read back.
+func (r *spoolRecord) identify() {
+	if (r.Usage != nil || r.Redactions > 0) && r.Batch == "" {
+		r.Batch = uuid.New().String()
+		r.Time = time.Now().UTC()
+	}
+}
+
+func spoolRecords(taskID string, events []*db.Event, usage *db.TaskUsage, todos *db.TodoList, redactions int) []spoolRecord {
+	records := []spoolRecord{}
+	if len(events) > 0 {
+		records = append(records, spoolRecord{TaskID: taskID, Events: events})
+	}
+	if usage != nil {
+		records = append(records, spoolRecord{TaskID: taskID, Usage: usage})
+	}
+	if todos != nil {
+		records = append(records, spoolRecord{TaskID: taskID, Todos: todos})
+	}
+	if redactions > 0 {
+		records = append(records, spoolRecord{TaskID: taskID, Redactions: redactions})
+	}
+	for i := range records {
+		records[i].identify()
+	}
+	return records
+}
+
+// applySpoolRecords writes records in order and returns the ones that were not written
+func applySpoolRecords(ctx context.Context, dbClient db.DB, records []spoolRecord) ([]spoolRecord, error) {
+	for i, r := range records {
+		var err error
+		switch {
+		case len(r.Events) > 0:
+			err = insertEvents(ctx, dbClient, r)
+		case r.Usage != nil:
+			err = dbClient.AddTaskUsage(ctx, r.TaskID, r.Batch, r.Time, *r.Usage)
+		case r.Todos != nil:
+			err = dbClient.UpdateTaskTodos(ctx, r.TaskID, r.Todos)
+		case r.Redactions > 0:
+			err = dbClient.AddTaskRedactions(ctx, r.TaskID, r.Batch, r.Redactions)
+		}
+		if err != nil {
+			return records[i:], err
+		}
+	}
+	return nil, nil
+}
+
+// insertEvents writes a batch of events. Their sequence numbers are reserved on the first
+// attempt and kept on the events, which stay spooled with the record until it is written,
+// so a retry reuses them and events written by an earlier attempt are not added twice.
+func insertEvents(ctx context.Context, dbClient db.DB, r spoolRecord) error {
+	if r.Events[0].Seq == 0 {
+		first, err := dbClient.ReserveEventSeqs(ctx, r.TaskID, len(r.Events))
+		if err != nil {
+			return err
+		}
+		for i, e := range r.Events {
+			e.Seq = first + int64(i)
+		}
+	}
+
+	return dbClient.InsertLog(ctx, r.TaskID, r.Events)
+}
+
+func readSpool(path string) ([]spoolRecord, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records := []spoolRecord{}
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(strings.TrimSpace(string(line))) > 0 {
+			r := spoolRecord{}
+			if jsonErr := json.Unmarshal(line, &r); jsonErr != nil {
+				log.Printf("LogWriter: Skipping corrupt spool record in %s: %s", path, jsonErr)
+			} else {
+				r.identify()
+				records = append(records, r)
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	return records, nil
+}
+
+// writeSpool replaces the spool file with records, removing it when there are none
+func writeSpool(path string, records []spoolRecord) error {
+	if len(records) == 0 {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(f)
+	for _, r := range records {
+		if err := encoder.Encode(r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	err = f.Sync()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// ReplaySpool writes the spooled logs left in dir by writers that could not reach the
+// database before their process exited.
+func ReplaySpool(ctx context.Context, dbClient db.DB, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+spoolExtension))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		records, err := readSpool(path)
+		if err != nil {
+			return err
+		}
+
+		remaining, applyErr := applySpoolRecords(ctx, dbClient, records)
+		err = writeSpool(path, remaining)
+		if err != nil {
+			return err
+		}
+		if applyErr != nil {
+			return applyErr
+		}
+		log.Printf("LogWriter: Replayed %d spooled records from %s", len(records), path)
+	}
+
+	return nil
+}
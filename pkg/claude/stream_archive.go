@@ -0,0 +1,127 @@
+package claude
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+	"umami/pkg/redact"
+)
+
+// StreamArchive keeps a gzip-compressed copy of the agent's raw stream-json output in a
+// local file, to be uploaded to object storage once the agent exits. Writing locally keeps
+// a slow or unavailable object store from affecting the agent. Secrets are masked line
+// by line like in the task's events.
+type StreamArchive struct {
+	Path     string
+	file     *os.File
+	gz       *gzip.Writer
+	redactor *redact.Redactor
+	buffer   []byte // Incomplete trailing line
+	err      error
+}
+
+func NewStreamArchive(path string, redactor *redact.Redactor) (*StreamArchive, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StreamArchive{
+		Path:     path,
+		file:     f,
+		gz:       gzip.NewWriter(f),
+		redactor: redactor,
+	}, nil
+}
+
+// Write never fails so that it can sit next to the LogWriter in an io.MultiWriter; the
+// first error is reported by Close instead.
+func (a *StreamArchive) Write(p []byte) (int, error) {
+	a.buffer = append(a.buffer, p...)
+
+	for {
+		i := bytes.IndexByte(a.buffer, '\n')
+		if i < 0 {
+			break
+		}
+		a.writeLine(a.buffer[:i+1])
+		a.buffer = a.buffer[i+1:]
+	}
+
+	return len(p), nil
+}
+
+func (a *StreamArchive) writeLine(line []byte) {
+	if a.err != nil {
+		return
+	}
+	masked, _ := a.redactor.String(string(line))
+	_, a.err = a.gz.Write([]byte(masked))
+}
+
+func (a *StreamArchive) Close() error {
+	if len(a.buffer) > 0 {
+		a.writeLine(a.buffer)
+		a.buffer = nil
+	}
+
+	if err := a.gz.Close(); err != nil && a.err == nil {
+		a.err = err
+	}
+	if err := a.file.Close(); err != nil && a.err == nil {
+		a.err = err
+	}
+
+	return a.err
+}
+
+// Replay feeds an archived stream, gzip-compressed or plain, through w line by line as if
+// the agent were producing it, pausing delay between lines. It does not flush w.
+func Replay(ctx context.Context, archive io.Reader, w io.Writer, delay time.Duration) error {
+	buffered := bufio.NewReader(archive)
+
+	var r io.Reader = buffered
+	// Gzip streams start with the magic bytes 0x1f 0x8b
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	lines := bufio.NewReader(r)
+	for {
+		line, err := lines.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if delay > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+		}
+	}
+}
@@ -1,5 +1,10 @@
 package claude
 
+import (
+	"encoding/json"
+	"strings"
+)
+
 type Update struct {
 	Type         string        `json:"type"`
 	Subtype      string        `json:"subtype"`
@@ -8,36 +13,96 @@ type Update struct {
 	DurationApi  int           `json:"duration_api_ms"`
 	NumTurns     int           `json:"num_turns"`
 	Result       string        `json:"result"`
+	TotalCostUSD float64       `json:"total_cost_usd"`
 	Message      UpdateMessage `json:"message"`
 	StopReason   string        `json:"stop_reason"`
 	StopSequence int           `json:"stop_sequence"`
-	Usage        struct {
-		InputTokens              int `json:"input_tokens"`
-		CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
-		CacheReadInputTokens     int `json:"cache_read_input_tokens"`
-		CacheCreation            struct {
-			Ephemeral5mInputTokens int `json:"ephemeral_5m_input_tokens"`
-			Ephemeral1hInputTokens int `json:"ephemeral_1h_input_tokens"`
-		} `json:"cache_creation"`
-		OutputTokens int    `json:"output_tokens"`
-		ServiceTier  string `json:"service_tier"`
-	} `json:"usage"`
-	UUID      string `json:"uuid"`
-	SessionID string `json:"session_id"`
+	Usage        UpdateUsage   `json:"usage"`
+	UUID         string        `json:"uuid"`
+	SessionID    string        `json:"session_id"`
+	// Set on system init updates
+	Model           string   `json:"model"`
+	Cwd             string   `json:"cwd"`
+	Tools           []string `json:"tools"`
+	ParentToolUseID string   `json:"parent_tool_use_id"`
+}
+
+type UpdateUsage struct {
+	InputTokens              int `json:"input_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
+	CacheCreation            struct {
+		Ephemeral5mInputTokens int `json:"ephemeral_5m_input_tokens"`
+		Ephemeral1hInputTokens int `json:"ephemeral_1h_input_tokens"`
+	} `json:"cache_creation"`
+	OutputTokens int    `json:"output_tokens"`
+	ServiceTier  string `json:"service_tier"`
 }
 
 type UpdateMessage struct {
-	ID              string                 `json:"id"`
-	Type            string                 `json:"type"`
-	Role            string                 `json:"role"`
-	Model           string                 `json:"model"`
-	Content         []UpdateMessageContent `json:"content"`
-	ParentToolUseID string                 `json:"parent_tool_use_id"`
+	ID              string                `json:"id"`
+	Type            string                `json:"type"`
+	Role            string                `json:"role"`
+	Model           string                `json:"model"`
+	Content         UpdateMessageContents `json:"content"`
+	ParentToolUseID string                `json:"parent_tool_use_id"`
+	Usage           UpdateUsage           `json:"usage"`
 }
 
 type UpdateMessageContent struct {
-	Type  string                 `json:"type"`
-	Text  string                 `json:"text"`
-	Name  string                 `json:"name"`
-	Input map[string]interface{} `json:"input"`
+	Type     string                 `json:"type"`
+	Text     string                 `json:"text"`
+	Thinking string                 `json:"thinking"`
+	ID       string                 `json:"id"`
+	Name     string                 `json:"name"`
+	Input    map[string]interface{} `json:"input"`
+	// Set on tool_result blocks
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+}
+
+// UpdateMessageContents accepts both a list of content blocks and the plain string
+// form used for simple user messages.
+type UpdateMessageContents []UpdateMessageContent
+
+func (c *UpdateMessageContents) UnmarshalJSON(data []byte) error {
+	var text string
+	if err := json.Unmarshal(data, &text); err == nil {
+		*c = UpdateMessageContents{{Type: "text", Text: text}}
+		return nil
+	}
+
+	var blocks []UpdateMessageContent
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return err
+	}
+	*c = blocks
+	return nil
+}
+
+// ResultText flattens the content of a tool_result block, which is either a string or
+// a list of text blocks, into text.
+func (c UpdateMessageContent) ResultText() string {
+	if len(c.Content) == 0 {
+		return ""
+	}
+
+	var text string
+	if err := json.Unmarshal(c.Content, &text); err == nil {
+		return text
+	}
+
+	var blocks []UpdateMessageContent
+	if err := json.Unmarshal(c.Content, &blocks); err != nil {
+		return string(c.Content)
+	}
+
+	parts := []string{}
+	for _, b := range blocks {
+		if b.Type == "text" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
 }
@@ -0,0 +1,177 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"umami/pkg/api"
+)
+
+type UsageQuery struct {
+	AppIds []string // Limit to these apps, or every app the caller can see when empty
+	Period string   // api.UsagePeriodDay, Week or Month, or empty to sum over the range
+	From   time.Time
+	To     time.Time
+}
+
+func (c *Client) Usage(ctx context.Context, q UsageQuery) ([]*api.UsageSummary, error) {
+	query := url.Values{"appId": q.AppIds}
+	if q.Period != "" {
+		query.Set("period", q.Period)
+	}
+	setTime(query, "from", q.From)
+	setTime(query, "to", q.To)
+
+	summaries := []*api.UsageSummary{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/usage", query, nil, &summaries)
+	return summaries, err
+}
+
+// Quotas returns the caller's quotas, or the app's for a non-empty appId, and how much of
+// each is used. Requests a quota does not allow fail with a 429 *Error.
+func (c *Client) Quotas(ctx context.Context, appId string) ([]api.QuotaUsage, error) {
+	path := "/api/v1/quotas"
+	if appId != "" {
+		path = appPath(appId, "/quotas")
+	}
+
+	usage := []api.QuotaUsage{}
+	err := c.do(ctx, http.MethodGet, path, nil, nil, &usage)
+	return usage, err
+}
+
+// Search runs a full-text search over tasks and their logs. A limit of 0 uses the server default.
+func (c *Client) Search(ctx context.Context, text string, appIds []string, limit int) ([]*api.SearchHit, error) {
+	query := url.Values{"q": {text}, "appId": appIds}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	hits := []*api.SearchHit{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/search", query, nil, &hits)
+	return hits, err
+}
+
+type AuditQuery struct {
+	Actor  string
+	Action string
+	AppId  string
+	TaskId string
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+func (c *Client) AuditRecords(ctx context.Context, q AuditQuery) ([]*api.AuditRecord, error) {
+	query := url.Values{}
+	for key, value := range map[string]string{"actor": q.Actor, "action": q.Action, "appId": q.AppId, "taskId": q.TaskId} {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	setTime(query, "from", q.From)
+	setTime(query, "to", q.To)
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	records := []*api.AuditRecord{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/audit", query, nil, &records)
+	return records, err
+}
+
+type CreateTokenRequest struct {
+	Name      string        `json:"name"`
+	Subject   string        `json:"subject,omitempty"` // Defaults to the caller
+	Scopes    []string      `json:"scopes"`
+	ExpiresIn time.Duration `json:"-"` // Zero for a token that never expires
+}
+
+// CreatedToken is a new token. Token is only ever returned here.
+type CreatedToken struct {
+	api.APIToken
+	Token string `json:"token"`
+}
+
+func (c *Client) ListTokens(ctx context.Context) ([]*api.APIToken, error) {
+	tokens := []*api.APIToken{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/tokens", nil, nil, &tokens)
+	return tokens, err
+}
+
+func (c *Client) CreateToken(ctx context.Context, req CreateTokenRequest) (*CreatedToken, error) {
+	body := struct {
+		CreateTokenRequest
+		ExpiresIn string `json:"expiresIn,omitempty"`
+	}{CreateTokenRequest: req}
+	if req.ExpiresIn > 0 {
+		body.ExpiresIn = req.ExpiresIn.String()
+	}
+
+	token := CreatedToken{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/tokens", nil, body, &token)
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (c *Client) DeleteToken(ctx context.Context, tokenId string) error {
+	return c.do(ctx, http.MethodDelete, "/api/v1/tokens/"+url.PathEscape(tokenId), nil, nil, nil)
+}
+
+type Session struct {
+	Token   string    `json:"token"`
+	Subject string    `json:"subject"`
+	Scopes  []string  `json:"scopes"`
+	Expires time.Time `json:"expires"`
+}
+
+// CreateSession exchanges the client's token for a session token
+func (c *Client) CreateSession(ctx context.Context) (*Session, error) {
+	session := Session{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/auth/session", nil, nil, &session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (c *Client) ListUsers(ctx context.Context) ([]*api.User, error) {
+	users := []*api.User{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/users", nil, nil, &users)
+	return users, err
+}
+
+func (c *Client) CreateUser(ctx context.Context, name, email string) (string, error) {
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/users", nil, api.User{Name: name, Email: email}, &res)
+	return res.Id, err
+}
+
+func (c *Client) ListTeams(ctx context.Context) ([]*api.Team, error) {
+	teams := []*api.Team{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/teams", nil, nil, &teams)
+	return teams, err
+}
+
+func (c *Client) CreateTeam(ctx context.Context, name string, members []string) (string, error) {
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/teams", nil, api.Team{Name: name, Members: members}, &res)
+	return res.Id, err
+}
+
+// SetTeamMembers replaces the members of a team
+func (c *Client) SetTeamMembers(ctx context.Context, teamId string, members []string) error {
+	return c.do(ctx, http.MethodPut, "/api/v1/teams/"+url.PathEscape(teamId)+"/members", nil, map[string][]string{
+		"members": members,
+	}, nil)
+}
+
+func setTime(query url.Values, key string, t time.Time) {
+	if !t.IsZero() {
+		query.Set(key, t.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+	"umami/pkg/api"
+	"umami/pkg/apierror"
+)
+
+func TestUsage(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"appId":"64b7f0c2a1b2c3d4e5f60718","tasks":2,"inputTokens":10,"costUsd":0.5}]`))
+	from := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	summaries, err := c.Usage(context.Background(), UsageQuery{AppIds: []string{"a1", "a2"}, Period: api.UsagePeriodDay, From: from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Tasks != 2 || summaries[0].InputTokens != 10 || summaries[0].CostUSD != 0.5 {
+		t.Errorf("summaries = %+v", summaries)
+	}
+
+	if last.method != http.MethodGet || last.path != "/api/v1/usage" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	query, _ := url.ParseQuery(last.query)
+	if len(query["appId"]) != 2 || query.Get("period") != api.UsagePeriodDay || query.Get("from") != "2026-10-01T00:00:00Z" || query.Has("to") {
+		t.Errorf("query = %s", last.query)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"quota":"tasksPerDay","limit":20,"used":3,"resetsAt":"2026-10-20T00:00:00Z"}]`))
+	usage, err := c.Quotas(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.path != "/api/v1/quotas" {
+		t.Errorf("path = %s", last.path)
+	}
+	if len(usage) != 1 || usage[0].Quota != "tasksPerDay" || usage[0].Limit != 20 || usage[0].Used != 3 || usage[0].ResetsAt.IsZero() {
+		t.Errorf("usage = %+v", usage)
+	}
+
+	_, err = c.Quotas(context.Background(), "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.path != "/api/v1/apps/a1/quotas" {
+		t.Errorf("path = %s, want the app's quotas", last.path)
+	}
+}
+
+func TestCreateToken(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusCreated, `{"id":"64b7f0c2a1b2c3d4e5f6071a","name":"ci","subject":"ci-bot","scopes":["read"],"token":"umami_secret"}`))
+	token, err := c.CreateToken(context.Background(), CreateTokenRequest{Name: "ci", Subject: "ci-bot", Scopes: []string{"read"}, ExpiresIn: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.method != http.MethodPost || last.path != "/api/v1/tokens" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	body := map[string]any{}
+	err = json.Unmarshal([]byte(last.body), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["name"] != "ci" || body["subject"] != "ci-bot" || body["expiresIn"] != "24h0m0s" {
+		t.Errorf("body = %s", last.body)
+	}
+	if token.Token != "umami_secret" || token.Name != "ci" || token.Id != "64b7f0c2a1b2c3d4e5f6071a" {
+		t.Errorf("token = %+v", token)
+	}
+}
+
+func TestCreateTokenForbidden(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, http.StatusForbidden, "The admin scope is required")
+	})
+	token, err := c.CreateToken(context.Background(), CreateTokenRequest{Name: "ci", Scopes: []string{"admin"}})
+
+	apiErr := &Error{}
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden || apiErr.Code != apierror.CodeForbidden {
+		t.Errorf("error = %v, want a 403 forbidden *Error", err)
+	}
+	if token != nil {
+		t.Errorf("token = %+v, want none on error", token)
+	}
+}
+
+func TestDeleteToken(t *testing.T) {
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	err := c.DeleteToken(context.Background(), "tok1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.method != http.MethodDelete || last.path != "/api/v1/tokens/tok1" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+}
+
+func TestSetTeamMembers(t *testing.T) {
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	err := c.SetTeamMembers(context.Background(), "team1", []string{"ada", "grace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.method != http.MethodPut || last.path != "/api/v1/teams/team1/members" || last.body != `{"members":["ada","grace"]}` {
+		t.Errorf("request = %s %s %s", last.method, last.path, last.body)
+	}
+}
+
+func TestAuditRecords(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"actor":"ada","action":"task.update"}]`))
+	records, err := c.AuditRecords(context.Background(), AuditQuery{Actor: "ada", AppId: "a1", Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query, _ := url.ParseQuery(last.query)
+	if last.path != "/api/v1/audit" || query.Get("actor") != "ada" || query.Get("appId") != "a1" || query.Get("limit") != "10" || query.Has("action") {
+		t.Errorf("request = %s?%s", last.path, last.query)
+	}
+	if len(records) != 1 || records[0].Actor != "ada" || records[0].Action != "task.update" {
+		t.Errorf("records = %+v", records)
+	}
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"umami/pkg/api"
+)
+
+// ListApps returns the apps the caller has a role on
+func (c *Client) ListApps(ctx context.Context) ([]*api.App, error) {
+	apps := []*api.App{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/apps", nil, nil, &apps)
+	if err != nil {
+		return nil, err
+	}
+	if apps == nil {
+		apps = []*api.App{}
+	}
+	return apps, nil
+}
+
+// CreateApp creates an app owned by the caller and returns its ID
+func (c *Client) CreateApp(ctx context.Context, name, description string) (string, error) {
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, "/api/v1/apps", nil, map[string]string{
+		"name":        name,
+		"description": description,
+	}, &res)
+	return res.Id, err
+}
+
+// DownloadApp writes a zip archive of the app's source to w
+func (c *Client) DownloadApp(ctx context.Context, appId string, w io.Writer) error {
+	return c.download(ctx, appPath(appId, "/download"), nil, w)
+}
+
+// StartApp starts the app, restarting it if it runs, and returns the URL it is served on
+func (c *Client) StartApp(ctx context.Context, appId string) (string, error) {
+	res, err := c.send(ctx, http.MethodGet, "/apps/"+url.PathEscape(appId), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("start app %s: no redirect in response with status %d", appId, res.StatusCode)
+	}
+	return location, nil
+}
+
+// RotateCredentials changes the app's database password. It fails with a 409 *Error while
+// the app has a task in progress.
+func (c *Client) RotateCredentials(ctx context.Context, appId string) error {
+	return c.do(ctx, http.MethodPost, appPath(appId, "/credentials/rotate"), nil, nil, nil)
+}
+
+func (c *Client) ListAppGrants(ctx context.Context, appId string) ([]api.AppGrant, error) {
+	grants := []api.AppGrant{}
+	err := c.do(ctx, http.MethodGet, appPath(appId, "/access"), nil, nil, &grants)
+	return grants, err
+}
+
+// SetAppGrant gives a user or team a role on the app, replacing any role it had
+func (c *Client) SetAppGrant(ctx context.Context, appId string, grant api.AppGrant) error {
+	return c.do(ctx, http.MethodPut, appPath(appId, "/access"), nil, grant, nil)
+}
+
+func (c *Client) RemoveAppGrant(ctx context.Context, appId string, kind, subject string) error {
+	query := url.Values{"kind": {kind}, "subject": {subject}}
+	return c.do(ctx, http.MethodDelete, appPath(appId, "/access"), query, nil, nil)
+}
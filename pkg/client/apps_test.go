@@ -0,0 +1,117 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"umami/pkg/api"
+	"umami/pkg/apierror"
+)
+
+func TestListApps(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"id":"64b7f0c2a1b2c3d4e5f60718","name":"shop","status":"running"}]`))
+	apps, err := c.ListApps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.method != http.MethodGet || last.path != "/api/v1/apps" {
+		t.Errorf("request = %s %s, want GET /api/v1/apps", last.method, last.path)
+	}
+	if len(apps) != 1 || apps[0].Id != "64b7f0c2a1b2c3d4e5f60718" || apps[0].Name != "shop" || apps[0].Status != "running" {
+		t.Errorf("apps = %+v", apps)
+	}
+}
+
+func TestListAppsNull(t *testing.T) {
+	c, _ := newTestClient(t, respond(http.StatusOK, `null`))
+	apps, err := c.ListApps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apps == nil || len(apps) != 0 {
+		t.Errorf("apps = %#v, want an empty list", apps)
+	}
+}
+
+func TestCreateApp(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusCreated, `{"id":"64b7f0c2a1b2c3d4e5f60718"}`))
+	id, err := c.CreateApp(context.Background(), "shop", "A web shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "64b7f0c2a1b2c3d4e5f60718" {
+		t.Errorf("id = %q", id)
+	}
+
+	if last.method != http.MethodPost || last.path != "/api/v1/apps" {
+		t.Errorf("request = %s %s, want POST /api/v1/apps", last.method, last.path)
+	}
+	if last.contentType != "application/json" {
+		t.Errorf("Content-Type = %q", last.contentType)
+	}
+	body := map[string]string{}
+	err = json.Unmarshal([]byte(last.body), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body["name"] != "shop" || body["description"] != "A web shop" {
+		t.Errorf("body = %s", last.body)
+	}
+}
+
+func TestStartApp(t *testing.T) {
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://localhost:8123", http.StatusFound)
+	})
+	location, err := c.StartApp(context.Background(), "app 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.method != http.MethodGet || last.path != "/apps/app%201" {
+		t.Errorf("request = %s %s, want GET /apps/app%%201", last.method, last.path)
+	}
+	if location != "http://localhost:8123" {
+		t.Errorf("location = %q, want the redirect rather than following it", location)
+	}
+}
+
+func TestRotateCredentialsConflict(t *testing.T) {
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, http.StatusConflict, "The app has a task in progress")
+	})
+	err := c.RotateCredentials(context.Background(), "a1")
+
+	if last.method != http.MethodPost || last.path != "/api/v1/apps/a1/credentials/rotate" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	apiErr := &Error{}
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusConflict || apiErr.Code != apierror.CodeConflict {
+		t.Errorf("error = %v, want a 409 conflict *Error", err)
+	}
+}
+
+func TestAppGrants(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"kind":"user","subject":"ada","role":"editor"}]`))
+	grants, err := c.ListAppGrants(context.Background(), "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.method != http.MethodGet || last.path != "/api/v1/apps/a1/access" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	if len(grants) != 1 || grants[0] != (api.AppGrant{Kind: "user", Subject: "ada", Role: "editor"}) {
+		t.Errorf("grants = %+v", grants)
+	}
+
+	err = c.RemoveAppGrant(context.Background(), "a1", "team", "ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.method != http.MethodDelete || last.path != "/api/v1/apps/a1/access" || last.query != "kind=team&subject=ops" {
+		t.Errorf("request = %s %s?%s", last.method, last.path, last.query)
+	}
+}
@@ -0,0 +1,157 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"umami/pkg/apierror"
+)
+
+// Client calls the control plane API described by pkg/routes/openapi.yaml
+type Client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// Error is a response with a non-success status. Code, Message and Fields come from the
+// server's JSON error; a body that is not one is kept whole as the Message.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	Fields     []apierror.FieldError
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	for _, f := range e.Fields {
+		msg += fmt.Sprintf("\n  %s %s", f.Field, f.Message)
+	}
+	return msg
+}
+
+// newError reads the error in a response with a non-success status
+func newError(res *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64*1024))
+
+	apiErr := apierror.Error{}
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Code != "" {
+		return &Error{StatusCode: res.StatusCode, Code: apiErr.Code, Message: apiErr.Message, Fields: apiErr.Fields}
+	}
+	return &Error{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
+}
+
+// New returns a client for the control plane at baseURL, such as http://localhost:9808,
+// authenticating with an API or session token
+func New(baseURL string, token string) *Client {
+	return &Client{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		token:   token,
+		httpClient: &http.Client{
+			// StartApp reports the redirect instead of following it
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// do sends a request with body encoded as JSON, if set, and decodes the response into out, if set
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body any, out any) error {
+	res, err := c.send(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+
+	err = json.NewDecoder(res.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("unable to decode response of %s %s: %w", method, path, err)
+	}
+
+	return nil
+}
+
+// send returns the response of a request, or an *Error for a status of 400 or more. The caller closes the body.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	u := c.baseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= http.StatusBadRequest {
+		defer res.Body.Close()
+		return nil, newError(res)
+	}
+
+	return res, nil
+}
+
+// download copies the body of a GET request to w
+func (c *Client) download(ctx context.Context, path string, query url.Values, w io.Writer) error {
+	res, err := c.send(ctx, http.MethodGet, path, query, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+func appPath(appId string, parts ...string) string {
+	return "/api/v1/apps/" + url.PathEscape(appId) + strings.Join(parts, "")
+}
+
+func taskPath(appId, taskId string, parts ...string) string {
+	return appPath(appId, append([]string{"/tasks/" + url.PathEscape(taskId)}, parts...)...)
+}
+
+type idResponse struct {
+	Id string `json:"id"`
+}
+
+// OpenAPI returns the OpenAPI document served by the control plane
+func (c *Client) OpenAPI(ctx context.Context) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	err := c.download(ctx, "/api/v1/openapi.yaml", nil, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
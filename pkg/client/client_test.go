@@ -0,0 +1,151 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"umami/pkg/apierror"
+)
+
+const testToken = "test-token"
+
+// recorded is the last request the test server received
+type recorded struct {
+	method      string
+	path        string
+	query       string
+	auth        string
+	contentType string
+	body        string
+}
+
+// newTestClient returns a client of a server that answers every request with handler and
+// records it
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, *recorded) {
+	t.Helper()
+
+	last := &recorded{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		*last = recorded{
+			method:      r.Method,
+			path:        r.URL.EscapedPath(),
+			query:       r.URL.RawQuery,
+			auth:        r.Header.Get("Authorization"),
+			contentType: r.Header.Get("Content-Type"),
+			body:        string(body),
+		}
+		handler(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	return New(srv.URL+"/", testToken), last
+}
+
+// respond answers with body as JSON
+func respond(status int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}
+}
+
+func TestAuthorizationHeader(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[]`))
+	_, err := c.ListApps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.auth != "Bearer "+testToken {
+		t.Errorf("Authorization = %q, want %q", last.auth, "Bearer "+testToken)
+	}
+
+	c.token = ""
+	_, err = c.ListApps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.auth != "" {
+		t.Errorf("Authorization = %q without a token, want none", last.auth)
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    Error
+	}{
+		{
+			name: "not found",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				apierror.Write(w, http.StatusNotFound, "App not found")
+			},
+			want: Error{StatusCode: http.StatusNotFound, Code: apierror.CodeNotFound, Message: "App not found"},
+		},
+		{
+			name: "validation",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				apierror.Write(w, http.StatusBadRequest, "Invalid request", apierror.FieldError{Field: "name", Message: "is required"})
+			},
+			want: Error{
+				StatusCode: http.StatusBadRequest,
+				Code:       apierror.CodeValidationFailed,
+				Message:    "Invalid request",
+				Fields:     []apierror.FieldError{{Field: "name", Message: "is required"}},
+			},
+		},
+		{
+			name: "quota",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				apierror.Write(w, http.StatusTooManyRequests, "Daily task quota used up")
+			},
+			want: Error{StatusCode: http.StatusTooManyRequests, Code: apierror.CodeQuotaExceeded, Message: "Daily task quota used up"},
+		},
+		{
+			name: "not json",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "upstream unavailable", http.StatusBadGateway)
+			},
+			want: Error{StatusCode: http.StatusBadGateway, Message: "upstream unavailable"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestClient(t, test.handler)
+			_, err := c.ListApps(context.Background())
+
+			apiErr := &Error{}
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want an *Error", err)
+			}
+			if apiErr.StatusCode != test.want.StatusCode || apiErr.Code != test.want.Code || apiErr.Message != test.want.Message {
+				t.Errorf("error = %+v, want %+v", apiErr, test.want)
+			}
+			if len(apiErr.Fields) != len(test.want.Fields) {
+				t.Fatalf("fields = %v, want %v", apiErr.Fields, test.want.Fields)
+			}
+			for i, f := range apiErr.Fields {
+				if f != test.want.Fields[i] {
+					t.Errorf("field %d = %v, want %v", i, f, test.want.Fields[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUndecodableResponse(t *testing.T) {
+	c, _ := newTestClient(t, respond(http.StatusOK, `{"not": "a list"`))
+	_, err := c.ListApps(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for an undecodable response")
+	}
+	if errors.As(err, new(*Error)) {
+		t.Errorf("error = %v, want a decoding error rather than an *Error", err)
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"context"
+	"io"
+	"iter"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"umami/pkg/api"
+
+	"github.com/gorilla/websocket"
+)
+
+// TaskUpdate holds the fields of a task to change; empty fields are left as they are.
+// Setting Status to api.TaskStatusInProgress queues the task.
+type TaskUpdate struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Status      string `json:"status,omitempty"`
+}
+
+func (c *Client) ListTasks(ctx context.Context, appId string) ([]*api.Task, error) {
+	tasks := []*api.Task{}
+	err := c.do(ctx, http.MethodGet, appPath(appId, "/tasks"), nil, nil, &tasks)
+	return tasks, err
+}
+
+// CreateTask creates a task in the authoring status and returns its ID
+func (c *Client) CreateTask(ctx context.Context, appId, title, description string) (string, error) {
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, appPath(appId, "/tasks"), nil, TaskUpdate{
+		Title:       title,
+		Description: description,
+	}, &res)
+	return res.Id, err
+}
+
+func (c *Client) UpdateTask(ctx context.Context, appId, taskId string, update TaskUpdate) error {
+	return c.do(ctx, http.MethodPatch, taskPath(appId, taskId), nil, update, nil)
+}
+
+func (c *Client) GetLog(ctx context.Context, appId, taskId string) (*api.Log, error) {
+	l := api.Log{}
+	err := c.do(ctx, http.MethodGet, taskPath(appId, taskId, "/logs"), nil, nil, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+// ListEvents returns the events of a task with a sequence number greater than after
+func (c *Client) ListEvents(ctx context.Context, appId, taskId string, after int64) ([]*api.Event, error) {
+	query := url.Values{}
+	if after > 0 {
+		query.Set("after", strconv.FormatInt(after, 10))
+	}
+
+	events := []*api.Event{}
+	err := c.do(ctx, http.MethodGet, taskPath(appId, taskId, "/events"), query, nil, &events)
+	return events, err
+}
+
+func (c *Client) ListToolCalls(ctx context.Context, appId, taskId string) ([]*api.ToolCall, error) {
+	calls := []*api.ToolCall{}
+	err := c.do(ctx, http.MethodGet, taskPath(appId, taskId, "/tools"), nil, nil, &calls)
+	return calls, err
+}
+
+// ListFilesTouched returns the files a task changed, or only filePath when it is set
+func (c *Client) ListFilesTouched(ctx context.Context, appId, taskId, filePath string) ([]*api.FileChanges, error) {
+	query := url.Values{}
+	if filePath != "" {
+		query.Set("path", filePath)
+	}
+
+	files := []*api.FileChanges{}
+	err := c.do(ctx, http.MethodGet, taskPath(appId, taskId, "/files"), query, nil, &files)
+	return files, err
+}
+
+// Export writes the transcript of a task, or of every task of the app when taskId is empty,
+// in format (jsonl, markdown or html) to w
+func (c *Client) Export(ctx context.Context, appId, taskId, format string, w io.Writer) error {
+	query := url.Values{"format": {format}}
+	if taskId == "" {
+		return c.download(ctx, appPath(appId, "/export"), query, w)
+	}
+	return c.download(ctx, taskPath(appId, taskId, "/export"), query, w)
+}
+
+// Replay replays an archived agent stream of a task into a new task and returns its ID. An
+// empty object replays the task's latest archive.
+func (c *Client) Replay(ctx context.Context, appId, taskId, object string, delay time.Duration) (string, error) {
+	query := url.Values{}
+	if object != "" {
+		query.Set("object", object)
+	}
+	if delay > 0 {
+		query.Set("delayMs", strconv.FormatInt(delay.Milliseconds(), 10))
+	}
+
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, taskPath(appId, taskId, "/replay"), query, nil, &res)
+	return res.Id, err
+}
+
+// StreamEvents follows the log of a task over the logs websocket, yielding the events after
+// after and then every new event. It stops when ctx is done, the consumer stops or the
+// connection fails, which is yielded as the error.
+func (c *Client) StreamEvents(ctx context.Context, appId, taskId string, after int64) iter.Seq2[*api.Event, error] {
+	return func(yield func(*api.Event, error) bool) {
+		wsURL := strings.Replace(c.baseURL, "http", "ws", 1) + taskPath(appId, taskId, "/logs/ws")
+		if after > 0 {
+			wsURL += "?after=" + strconv.FormatInt(after, 10)
+		}
+		header := http.Header{}
+		if c.token != "" {
+			header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		conn, res, err := websocket.DefaultDialer.DialContext(ctx, wsURL, header)
+		if err != nil {
+			if res != nil && res.StatusCode >= http.StatusBadRequest {
+				err = newError(res)
+			}
+			yield(nil, err)
+			return
+		}
+		defer conn.Close()
+
+		// Unblock the read below when the context ends
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-done:
+			}
+		}()
+
+		for {
+			message := struct {
+				Id    int64      `json:"id"`
+				Event *api.Event `json:"event"`
+			}{}
+			err := conn.ReadJSON(&message)
+			if err != nil {
+				if ctx.Err() != nil {
+					err = ctx.Err()
+				}
+				yield(nil, err)
+				return
+			}
+			if !yield(message.Event, nil) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+	"umami/pkg/api"
+	"umami/pkg/apierror"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestListTasks(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"id":"64b7f0c2a1b2c3d4e5f60719","title":"Add a cart","status":"in-progress","usage":{"inputTokens":120}}]`))
+	tasks, err := c.ListTasks(context.Background(), "a1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.method != http.MethodGet || last.path != "/api/v1/apps/a1/tasks" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	if len(tasks) != 1 || tasks[0].Title != "Add a cart" || tasks[0].Status != api.TaskStatusInProgress {
+		t.Fatalf("tasks = %+v", tasks)
+	}
+	if tasks[0].Usage == nil || tasks[0].Usage.InputTokens != 120 {
+		t.Errorf("usage = %+v", tasks[0].Usage)
+	}
+}
+
+func TestCreateTask(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusCreated, `{"id":"t1"}`))
+	id, err := c.CreateTask(context.Background(), "a1", "Add a cart", "With a checkout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "t1" {
+		t.Errorf("id = %q", id)
+	}
+	if last.method != http.MethodPost || last.path != "/api/v1/apps/a1/tasks" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	if last.body != `{"title":"Add a cart","description":"With a checkout"}` {
+		t.Errorf("body = %s", last.body)
+	}
+}
+
+func TestUpdateTask(t *testing.T) {
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	err := c.UpdateTask(context.Background(), "a1", "t/1", TaskUpdate{Status: api.TaskStatusInProgress})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.method != http.MethodPatch || last.path != "/api/v1/apps/a1/tasks/t%2F1" {
+		t.Errorf("request = %s %s", last.method, last.path)
+	}
+	// Fields left empty must not be sent, or the server would clear them
+	if last.body != `{"status":"in-progress"}` {
+		t.Errorf("body = %s", last.body)
+	}
+}
+
+func TestUpdateTaskInvalidTransition(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		apierror.WriteCode(w, http.StatusConflict, apierror.CodeInvalidTransition, "Unable to move a task from completed to in-progress")
+	})
+	err := c.UpdateTask(context.Background(), "a1", "t1", TaskUpdate{Status: api.TaskStatusInProgress})
+
+	apiErr := &Error{}
+	if !errors.As(err, &apiErr) || apiErr.Code != apierror.CodeInvalidTransition {
+		t.Errorf("error = %v, want an invalid_transition *Error", err)
+	}
+}
+
+func TestListEvents(t *testing.T) {
+	c, last := newTestClient(t, respond(http.StatusOK, `[{"seq":8,"kind":"text","text":"Done"}]`))
+	events, err := c.ListEvents(context.Background(), "a1", "t1", 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last.path != "/api/v1/apps/a1/tasks/t1/events" || last.query != "after=7" {
+		t.Errorf("request = %s?%s", last.path, last.query)
+	}
+	if len(events) != 1 || events[0].Seq != 8 || events[0].Text != "Done" {
+		t.Errorf("events = %+v", events)
+	}
+
+	_, err = c.ListEvents(context.Background(), "a1", "t1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.query != "" {
+		t.Errorf("query = %q, want none from the start", last.query)
+	}
+}
+
+func TestExport(t *testing.T) {
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/markdown")
+		w.Write([]byte("# Add a cart\n"))
+	})
+
+	buf := new(bytes.Buffer)
+	err := c.Export(context.Background(), "a1", "t1", "markdown", buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.path != "/api/v1/apps/a1/tasks/t1/export" || last.query != "format=markdown" {
+		t.Errorf("request = %s?%s", last.path, last.query)
+	}
+	if buf.String() != "# Add a cart\n" {
+		t.Errorf("export = %q", buf.String())
+	}
+
+	err = c.Export(context.Background(), "a1", "", "jsonl", new(bytes.Buffer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.path != "/api/v1/apps/a1/export" {
+		t.Errorf("path = %s, want the app export without a task", last.path)
+	}
+}
+
+func TestStreamEvents(t *testing.T) {
+	upgrader := websocket.Upgrader{}
+	c, last := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for seq := int64(4); seq <= 5; seq++ {
+			conn.WriteJSON(map[string]any{"id": seq, "event": api.Event{Seq: seq, Kind: "text"}})
+		}
+		// Keep the connection open until the client goes away
+		conn.ReadMessage()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	seqs := []int64{}
+	for event, err := range c.StreamEvents(ctx, "a1", "t1", 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, event.Seq)
+		if len(seqs) == 2 {
+			break
+		}
+	}
+
+	if last.path != "/api/v1/apps/a1/tasks/t1/logs/ws" || last.query != "after=3" || last.auth != "Bearer "+testToken {
+		t.Errorf("request = %s?%s with Authorization %q", last.path, last.query, last.auth)
+	}
+	if len(seqs) != 2 || seqs[0] != 4 || seqs[1] != 5 {
+		t.Errorf("seqs = %v, want [4 5]", seqs)
+	}
+}
+
+func TestStreamEventsRejected(t *testing.T) {
+	c, _ := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, http.StatusForbidden, "Viewer role required")
+	})
+
+	for _, err := range c.StreamEvents(context.Background(), "a1", "t1", 0) {
+		apiErr := &Error{}
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusForbidden {
+			t.Errorf("error = %v, want a 403 *Error", err)
+		}
+		break
+	}
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"umami/pkg/api"
+)
+
+// CreatedWebhook is a new webhook. Secret signs its deliveries and is only ever returned here.
+type CreatedWebhook struct {
+	api.Webhook
+	Secret string `json:"secret"`
+}
+
+// webhooksPath is the webhooks collection of an app, or the global one for an empty appId
+func webhooksPath(appId string) string {
+	if appId == "" {
+		return "/api/v1/webhooks"
+	}
+	return appPath(appId, "/webhooks")
+}
+
+func webhookPath(webhookId string, parts ...string) string {
+	return "/api/v1/webhooks/" + url.PathEscape(webhookId) + strings.Join(parts, "")
+}
+
+// ListWebhooks lists the webhooks of an app, or the global webhooks for an empty appId
+func (c *Client) ListWebhooks(ctx context.Context, appId string) ([]*api.Webhook, error) {
+	hooks := []*api.Webhook{}
+	err := c.do(ctx, http.MethodGet, webhooksPath(appId), nil, nil, &hooks)
+	return hooks, err
+}
+
+// CreateWebhook registers an endpoint for the events of an app, or of every app for an
+// empty appId. No events subscribes it to all of them.
+func (c *Client) CreateWebhook(ctx context.Context, appId string, endpoint string, events []string) (*CreatedWebhook, error) {
+	body := map[string]any{"url": endpoint}
+	if len(events) > 0 {
+		body["events"] = events
+	}
+
+	hook := CreatedWebhook{}
+	err := c.do(ctx, http.MethodPost, webhooksPath(appId), nil, body, &hook)
+	if err != nil {
+		return nil, err
+	}
+	return &hook, nil
+}
+
+func (c *Client) DeleteWebhook(ctx context.Context, webhookId string) error {
+	return c.do(ctx, http.MethodDelete, webhookPath(webhookId), nil, nil, nil)
+}
+
+// ListWebhookDeliveries lists the deliveries of a webhook, newest first. A limit of 0 uses
+// the server default.
+func (c *Client) ListWebhookDeliveries(ctx context.Context, webhookId string, limit int) ([]*api.WebhookDelivery, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+
+	deliveries := []*api.WebhookDelivery{}
+	err := c.do(ctx, http.MethodGet, webhookPath(webhookId, "/deliveries"), query, nil, &deliveries)
+	return deliveries, err
+}
+
+// Redeliver queues the payload of a delivery again and returns the new delivery's ID
+func (c *Client) Redeliver(ctx context.Context, webhookId, deliveryId string) (string, error) {
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, webhookPath(webhookId, "/deliveries/", url.PathEscape(deliveryId), "/redeliver"), nil, nil, &res)
+	return res.Id, err
+}
+
+// PingWebhook queues a ping event to the webhook and returns the delivery's ID
+func (c *Client) PingWebhook(ctx context.Context, webhookId string) (string, error) {
+	res := idResponse{}
+	err := c.do(ctx, http.MethodPost, webhookPath(webhookId, "/ping"), nil, nil, &res)
+	return res.Id, err
+}
@@ -0,0 +1,353 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is the configuration of the control plane and the runner. Each binary uses the
+// parts it needs.
+type Config struct {
+	Mongo       Mongo       `json:"mongo"`
+	Redis       Redis       `json:"redis"`
+	Server      Server      `json:"server"`
+	Runner      Runner      `json:"runner"`
+	Storage     Storage     `json:"storage"`
+	Paths       Paths       `json:"paths"`
+	Files       Files       `json:"files"`
+	Tracing     Tracing     `json:"tracing"`
+	Webhooks    Webhooks    `json:"webhooks"`
+	Credentials Credentials `json:"credentials"`
+}
+
+type Mongo struct {
+	URI string `json:"uri"`
+}
+
+type Redis struct {
+	Address string   `json:"address"`
+	LockTTL Duration `json:"lockTtl"` // How long an app stays locked by a runner that stops renewing it
+}
+
+type Server struct {
+	Addr string `json:"addr"` // Address the control plane listens on
+}
+
+type Runner struct {
+	MaxSubProcesses   int      `json:"maxSubProcesses"`   // Tasks a runner works on at once
+	LockRenewInterval Duration `json:"lockRenewInterval"` // Also how often the budget of a running task is checked
+	StatusAddr        string   `json:"statusAddr"`        // Address of the runner's health and metrics endpoints, empty to disable them
+}
+
+type Storage struct {
+	Location string `json:"location"` // Location of the buckets created for apps
+}
+
+type Paths struct {
+	Repositories string `json:"repositories"` // A git repository per app, named by its ID
+	Logs         string `json:"logs"`         // Output of the app processes
+	Spool        string `json:"spool"`        // Logs not yet written to the database, and stream archives
+}
+
+// Files are read at startup. The price table, redaction patterns and quotas are optional.
+type Files struct {
+	Keys           string `json:"keys"`
+	SessionKey     string `json:"sessionKey"`
+	PriceTable     string `json:"priceTable"`
+	RedactPatterns string `json:"redactPatterns"`
+	Quotas         string `json:"quotas"`
+}
+
+type Tracing struct {
+	Exporter string `json:"exporter"` // none, stdout or otlp
+	Endpoint string `json:"endpoint"` // URL of the OTLP/HTTP collector, defaults to OTEL_EXPORTER_OTLP_ENDPOINT
+}
+
+type Webhooks struct {
+	// Comma-separated CIDRs of internal addresses webhooks may be sent to, such as
+	// 127.0.0.0/8 for a local listener. Loopback, private and link-local addresses are
+	// refused otherwise.
+	AllowedNetworks string `json:"allowedNetworks"`
+
+	DeliveryInterval Duration `json:"deliveryInterval"` // How often the control plane sends queued deliveries
+}
+
+// Credentials are the app database passwords, which the control plane rotates
+type Credentials struct {
+	RotationInterval Duration `json:"rotationInterval"` // How often passwords are checked for rotation, 0 to disable rotation
+	MaxAge           Duration `json:"maxAge"`           // Age at which a password is rotated
+}
+
+// Duration is a time.Duration written as a string such as "30s" in configuration files
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default is the configuration of a local setup
+func Default() *Config {
+	return &Config{
+		Mongo:       Mongo{URI: "mongodb://localhost:27017"},
+		Redis:       Redis{Address: "localhost:6379", LockTTL: Duration(30 * time.Second)},
+		Server:      Server{Addr: ":9808"},
+		Runner:      Runner{MaxSubProcesses: 3, LockRenewInterval: Duration(15 * time.Second), StatusAddr: ":9809"},
+		Storage:     Storage{Location: "us-central1"},
+		Paths:       Paths{Repositories: "./repository", Logs: "./logs", Spool: "./spool"},
+		Files:       Files{Keys: "./keys.json", SessionKey: "./session.key"},
+		Tracing:     Tracing{Exporter: "none"},
+		Webhooks:    Webhooks{DeliveryInterval: Duration(2 * time.Second)},
+		Credentials: Credentials{RotationInterval: Duration(time.Hour), MaxAge: Duration(24 * time.Hour)},
+	}
+}
+
+// setting is a value that can be set from the environment and the command line
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	value any // *string, *int or *Duration in the Config
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{"mongo-uri", "MONGO_ADDRESS", "MongoDB connection string", &c.Mongo.URI},
+		{"redis-addr", "REDIS_ADDRESS", "Redis address", &c.Redis.Address},
+		{"lock-ttl", "UMAMI_LOCK_TTL", "how long an app stays locked by a runner that stops renewing it", &c.Redis.LockTTL},
+		{"addr", "UMAMI_ADDR", "address the control plane listens on", &c.Server.Addr},
+		{"max-subprocesses", "UMAMI_MAX_SUBPROCESSES", "tasks a runner works on at once", &c.Runner.MaxSubProcesses},
+		{"lock-renew-interval", "UMAMI_LOCK_RENEW_INTERVAL", "how often a runner renews the lock of the app it works on", &c.Runner.LockRenewInterval},
+		{"status-addr", "UMAMI_STATUS_ADDR", "address of the runner's health and metrics endpoints, empty to disable them", &c.Runner.StatusAddr},
+		{"storage-location", "UMAMI_STORAGE_LOCATION", "location of the buckets created for apps", &c.Storage.Location},
+		{"repositories-dir", "UMAMI_REPOSITORIES_DIR", "directory of the app repositories", &c.Paths.Repositories},
+		{"logs-dir", "UMAMI_LOGS_DIR", "directory of the app process logs", &c.Paths.Logs},
+		{"spool-dir", "UMAMI_SPOOL_DIR", "directory of spooled logs and stream archives", &c.Paths.Spool},
+		{"key-file", "UMAMI_KEY_FILE", "encryption keys", &c.Files.Keys},
+		{"session-key-file", "UMAMI_SESSION_KEY_FILE", "session signing key", &c.Files.SessionKey},
+		{"price-table", "UMAMI_PRICE_TABLE", "model price table, defaults to the built-in prices", &c.Files.PriceTable},
+		{"redact-patterns", "UMAMI_REDACT_PATTERNS", "extra log redaction patterns", &c.Files.RedactPatterns},
+		{"quotas", "UMAMI_QUOTAS", "quotas, defaults to no limits", &c.Files.Quotas},
+		{"tracing-exporter", "UMAMI_TRACING_EXPORTER", "where spans are exported: none, stdout or otlp", &c.Tracing.Exporter},
+		{"tracing-endpoint", "UMAMI_TRACING_ENDPOINT", "URL of the OTLP/HTTP collector, defaults to OTEL_EXPORTER_OTLP_ENDPOINT", &c.Tracing.Endpoint},
+		{"webhook-allowed-networks", "UMAMI_WEBHOOK_ALLOWED_NETWORKS", "comma-separated CIDRs of internal addresses webhooks may be sent to, such as 127.0.0.0/8", &c.Webhooks.AllowedNetworks},
+		{"webhook-delivery-interval", "UMAMI_WEBHOOK_DELIVERY_INTERVAL", "how often the control plane sends queued webhook deliveries", &c.Webhooks.DeliveryInterval},
+		{"credential-rotation-interval", "UMAMI_CREDENTIAL_ROTATION_INTERVAL", "how often app database passwords are checked for rotation, 0 to disable rotation", &c.Credentials.RotationInterval},
+		{"credential-max-age", "UMAMI_CREDENTIAL_MAX_AGE", "age at which an app database password is rotated", &c.Credentials.MaxAge},
+	}
+}
+
+// Load builds the configuration of the binary called name from, in increasing precedence,
+// the defaults, the JSON file named by -config or UMAMI_CONFIG, environment variables and
+// the flags in args. printOnly reports that -print-config was given.
+func Load(name string, args []string) (config *Config, printOnly bool, err error) {
+	return LoadFlags(flag.NewFlagSet(name, flag.ContinueOnError), args)
+}
+
+// LoadFlags is Load for commands with flags of their own, which they define on fs first
+func LoadFlags(fs *flag.FlagSet, args []string) (config *Config, printOnly bool, err error) {
+	config = Default()
+	settings := config.settings()
+
+	path := fs.String("config", os.Getenv("UMAMI_CONFIG"), "JSON configuration file")
+	fs.BoolVar(&printOnly, "print-config", false, "print the configuration and exit")
+	for _, s := range settings {
+		// Values are applied after the file and the environment, so flags only collect them
+		fs.String(s.flag, get(s.value), fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if *path != "" {
+		err = config.readFile(*path)
+		if err != nil {
+			return nil, false, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	for _, s := range settings {
+		if raw, ok := os.LookupEnv(s.env); ok {
+			err = set(s.value, raw)
+			if err != nil {
+				return nil, false, fmt.Errorf("%s: %w", s.env, err)
+			}
+		}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		for _, s := range settings {
+			if s.flag == f.Name && err == nil {
+				err = set(s.value, f.Value.String())
+				if err != nil {
+					err = fmt.Errorf("-%s: %w", s.flag, err)
+				}
+			}
+		}
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return config, printOnly, nil
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// Unknown keys are most likely typos, which would otherwise be silently ignored
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(c)
+}
+
+func get(value any) string {
+	switch v := value.(type) {
+	case *string:
+		return *v
+	case *int:
+		return strconv.Itoa(*v)
+	case *Duration:
+		return v.String()
+	}
+	return ""
+}
+
+func set(value any, raw string) error {
+	switch v := value.(type) {
+	case *string:
+		*v = raw
+	case *int:
+		parsed, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		*v = parsed
+	case *Duration:
+		parsed, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		*v = Duration(parsed)
+	}
+	return nil
+}
+
+// Validate reports every problem with the configuration
+func (c *Config) Validate() error {
+	problems := []error{}
+	add := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	uri, err := url.Parse(c.Mongo.URI)
+	if err != nil || (uri.Scheme != "mongodb" && uri.Scheme != "mongodb+srv") || uri.Host == "" {
+		add("mongo.uri must be a mongodb:// or mongodb+srv:// connection string")
+	}
+	if _, _, err := net.SplitHostPort(c.Redis.Address); err != nil {
+		add("redis.address must be a host:port, %s", err)
+	}
+	if c.Redis.LockTTL <= 0 {
+		add("redis.lockTtl must be positive")
+	}
+	if _, _, err := net.SplitHostPort(c.Server.Addr); err != nil {
+		add("server.addr must be a [host]:port, %s", err)
+	}
+	if c.Runner.MaxSubProcesses < 1 {
+		add("runner.maxSubProcesses must be at least 1")
+	}
+	if c.Runner.LockRenewInterval <= 0 || c.Runner.LockRenewInterval >= c.Redis.LockTTL {
+		add("runner.lockRenewInterval must be positive and shorter than redis.lockTtl (%s)", c.Redis.LockTTL)
+	}
+	if _, _, err := net.SplitHostPort(c.Runner.StatusAddr); c.Runner.StatusAddr != "" && err != nil {
+		add("runner.statusAddr must be a [host]:port or empty, %s", err)
+	}
+	if c.Storage.Location == "" {
+		add("storage.location is required")
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		add("tracing.exporter must be none, stdout or otlp")
+	}
+	if endpoint, err := url.Parse(c.Tracing.Endpoint); c.Tracing.Endpoint != "" && (err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "") {
+		add("tracing.endpoint must be an http:// or https:// URL or empty")
+	}
+	for _, cidr := range strings.Split(c.Webhooks.AllowedNetworks, ",") {
+		if _, err := netip.ParsePrefix(strings.TrimSpace(cidr)); strings.TrimSpace(cidr) != "" && err != nil {
+			add("webhooks.allowedNetworks must be comma-separated CIDRs, %s", err)
+		}
+	}
+	if c.Webhooks.DeliveryInterval <= 0 {
+		add("webhooks.deliveryInterval must be positive")
+	}
+	if c.Credentials.RotationInterval < 0 {
+		add("credentials.rotationInterval must be positive, or 0 to disable rotation")
+	}
+	if c.Credentials.MaxAge <= 0 {
+		add("credentials.maxAge must be positive")
+	}
+	for _, required := range []struct{ name, value string }{
+		{"paths.repositories", c.Paths.Repositories},
+		{"paths.logs", c.Paths.Logs},
+		{"paths.spool", c.Paths.Spool},
+		{"files.keys", c.Files.Keys},
+		{"files.sessionKey", c.Files.SessionKey},
+	} {
+		if strings.TrimSpace(required.value) == "" {
+			add("%s is required", required.name)
+		}
+	}
+
+	return errors.Join(problems...)
+}
+
+// Print writes the configuration as JSON, in the format of configuration files, with the
+// password of the MongoDB connection string masked
+func (c *Config) Print(w io.Writer) error {
+	printed := *c
+	if uri, err := url.Parse(c.Mongo.URI); err == nil {
+		printed.Mongo.URI = uri.Redacted()
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(printed)
+}
@@ -0,0 +1,75 @@
+package db
+
+import (
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const AppRoleViewer = "viewer" // Read the app, its tasks and logs
+const AppRoleEditor = "editor" // Also create and update tasks and start the app
+const AppRoleOwner = "owner"   // Also manage who has access and rotate credentials
+
+const GrantKindUser = "user"
+const GrantKindTeam = "team"
+
+// User is a person or service that authenticates to the API. Name is the subject of their
+// tokens and sessions.
+type User struct {
+	Id      bson.ObjectID `json:"id" bson:"_id"`
+	Name    string        `json:"name" bson:"name"`
+	Email   string        `json:"email,omitempty" bson:"email,omitempty"`
+	Created time.Time     `json:"created" bson:"created"`
+}
+
+type Team struct {
+	Id      bson.ObjectID `json:"id" bson:"_id"`
+	Name    string        `json:"name" bson:"name"`
+	Members []string      `json:"members" bson:"members"` // User names
+	Created time.Time     `json:"created" bson:"created"`
+}
+
+// AppGrant gives a user, or every member of a team, a role on an app
+type AppGrant struct {
+	Kind    string `json:"kind" bson:"kind"`       // GrantKindUser or GrantKindTeam
+	Subject string `json:"subject" bson:"subject"` // User name or team ID
+	Role    string `json:"role" bson:"role"`
+}
+
+// ValidAppRole reports whether role is one of the app roles
+func ValidAppRole(role string) bool {
+	return role == AppRoleViewer || role == AppRoleEditor || role == AppRoleOwner
+}
+
+// AppRoleAtLeast reports whether role grants everything min does
+func AppRoleAtLeast(role, min string) bool {
+	return appRoleRank(role) >= appRoleRank(min) && appRoleRank(role) > 0
+}
+
+func appRoleRank(role string) int {
+	switch role {
+	case AppRoleViewer:
+		return 1
+	case AppRoleEditor:
+		return 2
+	case AppRoleOwner:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// RoleFor returns the highest role the app grants the user, directly or through one of the
+// given teams, or an empty string when it grants none
+func (a *App) RoleFor(user string, teamIds []string) string {
+	role := ""
+	for _, grant := range a.Access {
+		matches := (grant.Kind == GrantKindUser && grant.Subject == user) ||
+			(grant.Kind == GrantKindTeam && slices.Contains(teamIds, grant.Subject))
+		if matches && appRoleRank(grant.Role) > appRoleRank(role) {
+			role = grant.Role
+		}
+	}
+	return role
+}
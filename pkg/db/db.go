@@ -2,8 +2,11 @@ package db
 
 import (
 	"context"
+	"errors"
 	"iter"
+	"slices"
 	"time"
+	"umami/pkg/secrets"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
 )
@@ -11,47 +14,462 @@ import (
 // type LogIterFunc func(yield func(Log) bool)
 
 type DB interface {
+	Ping(ctx context.Context) error
+	CheckChangeStreams(ctx context.Context) error                                                                          // Fails unless change streams, which need a replica set, can be opened
 	CreateAppDatabase(ctx context.Context, name string) (databaseName string, username string, password string, err error) // Create an app database and user
 	CreateApp(ctx context.Context, app *App) (string, error)                                                               // Create an app entry in Umami database
 	CreateTask(ctx context.Context, appId string, title string, description string) (id string, err error)
-	GetApp(ctx context.Context, appId string) (*App, error)
+	GetApp(ctx context.Context, appId string) (*App, error) // Returns ErrNotFound for an unknown app and ErrInvalidID for a malformed ID
 	GetApps(ctx context.Context) ([]*App, error)
+	GetAccessibleApps(ctx context.Context, user string, teamIds []string) ([]*App, error) // Apps granting the user, or one of the teams, any role
+	SetAppGrant(ctx context.Context, appId string, grant AppGrant) error                  // Add the grant, replacing any grant to the same user or team
+	RemoveAppGrant(ctx context.Context, appId string, kind, subject string) error
+	CreateUser(ctx context.Context, user *User) (string, error)
+	GetUsers(ctx context.Context) ([]*User, error)
+	CreateTeam(ctx context.Context, team *Team) (string, error)
+	GetTeams(ctx context.Context) ([]*Team, error)
+	GetTeamsForUser(ctx context.Context, user string) ([]*Team, error)
+	UpdateTeamMembers(ctx context.Context, teamId string, members []string) error
 	GetTasks(ctx context.Context, appId string) ([]*Task, error)
-	GetTask(ctx context.Context, taskId string) (*Task, error)
+	CountTasks(ctx context.Context, appId string, status string) (int64, error)
+	GetTask(ctx context.Context, taskId string) (*Task, error) // Returns ErrNotFound for an unknown task and ErrInvalidID for a malformed ID
 	UpdateTask(ctx context.Context, appId, taskId string, title, description, status string) error
-	InsertLog(ctx context.Context, taskId string, messages []map[string]string) error
+	ReserveEventSeqs(ctx context.Context, taskId string, n int) (int64, error) // Reserves the task's next n event sequence numbers and returns the first
+	InsertLog(ctx context.Context, taskId string, events []*Event) error       // Events carry their sequence numbers; ones already stored are skipped, so a batch can be retried
 	FetchLog(ctx context.Context, taskId string) (*Log, error)
-	StartLogStream(ctx context.Context, taskId string) iter.Seq[Log]
+	FetchEvents(ctx context.Context, taskId string, afterSeq int64) ([]*Event, error)
+	StreamEvents(ctx context.Context, taskId string, afterSeq int64) iter.Seq2[*Event, error]            // Events after afterSeq, then every event added, in sequence order
+	UpdateAppPassword(ctx context.Context, appId string, password *secrets.Envelope) error               // Store an encrypted password and drop any plaintext one
+	RotateAppPassword(ctx context.Context, app *App, password string, encrypted *secrets.Envelope) error // Change the app database user's password and store it
+	UpdateTaskTodos(ctx context.Context, taskId string, todos *TodoList) error
+	AddTaskRedactions(ctx context.Context, taskId, batchId string, count int) error // Applied once per batch ID, so a batch can be retried
+	AddTaskStream(ctx context.Context, taskId string, stream StreamArchive) error
+	Search(ctx context.Context, query SearchQuery) ([]*SearchHit, error)                           // Full-text search over task titles, descriptions, agent text and tool names, best match first
+	AddTaskUsage(ctx context.Context, taskId, batchId string, at time.Time, usage TaskUsage) error // Add usage to the running totals of a task and the totals of its app on the day of at, once per batch ID
+	GetAppUsageSince(ctx context.Context, appId string, from time.Time) (*TaskUsage, error)        // Usage of the app from the day of from onwards, whenever its tasks were created
+	ConsumeQuota(ctx context.Context, key string, limit int64, expires time.Time) (bool, error)    // Count one use of key unless it reached limit, reporting whether it was counted; the counter is removed after expires
+	ReleaseQuota(ctx context.Context, key string) error                                            // Give back one use of key counted by ConsumeQuota
+	GetQuotaCount(ctx context.Context, key string) (int64, error)
+	GetUsage(ctx context.Context, filter UsageFilter) ([]*UsageSummary, error) // Aggregate usage per app and period by the day it happened
+	InsertAuditRecord(ctx context.Context, record *AuditRecord) error
+	GetAuditRecords(ctx context.Context, filter AuditFilter) ([]*AuditRecord, error) // Newest first
+	CreateAPIToken(ctx context.Context, token *APIToken) (string, error)
+	GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error) // Returns ErrNotFound for an unknown token
+	GetAPITokens(ctx context.Context) ([]*APIToken, error)
+	DeleteAPIToken(ctx context.Context, tokenId string) error
+	CreateWebhook(ctx context.Context, webhook *Webhook) (string, error)
+	GetWebhook(ctx context.Context, webhookId string) (*Webhook, error)                      // Returns ErrNotFound for an unknown webhook
+	GetWebhooks(ctx context.Context, appId string) ([]*Webhook, error)                       // Webhooks of the app, or the global ones for an empty appId
+	GetWebhooksForEvent(ctx context.Context, appId string, event string) ([]*Webhook, error) // Webhooks of the app and global webhooks subscribed to event
+	GetAllWebhooks(ctx context.Context) ([]*Webhook, error)                                  // Webhooks of every app and the global ones
+	DeleteWebhook(ctx context.Context, webhookId string) error                               // Also drops the webhook's deliveries
+	UpdateWebhookSecret(ctx context.Context, webhookId string, secret *secrets.Envelope) error
+	CreateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) (string, error)
+	GetWebhookDelivery(ctx context.Context, deliveryId string) (*WebhookDelivery, error)                 // Returns ErrNotFound for an unknown delivery
+	GetWebhookDeliveries(ctx context.Context, webhookId string, limit int64) ([]*WebhookDelivery, error) // Newest first
+	ClaimWebhookDelivery(ctx context.Context, lease time.Duration) (*WebhookDelivery, error)             // Hold the pending delivery due first for lease, or return ErrNotFound
+	RecordWebhookAttempt(ctx context.Context, deliveryId string, attempt WebhookAttempt, status string, nextAttempt time.Time) error
 }
 
+// ErrNotFound is returned by lookups that match nothing
+var ErrNotFound = errors.New("not found")
+
+// ErrInvalidID is returned by lookups given an ID that is not an ObjectID
+var ErrInvalidID = errors.New("invalid id")
+
 type App struct {
 	Id          bson.ObjectID `bson:"_id" json:"id"`
 	Name        string        `bson:"name" json:"name"`
 	Description string        `bson:"description" json:"description"`
 	User        string        `bson:"user" json:"-"`
-	Password    string        `bson:"password" json:"-"`
-	Database    string        `bson:"database" json:"-"`
-	Created     time.Time     `bson:"created" json:"created"`
-	Status      string        `bson:"status" json:"status"`
+	// Password is only set on apps created before credentials were encrypted
+	Password          string            `bson:"password,omitempty" json:"-"`
+	EncryptedPassword *secrets.Envelope `bson:"encryptedPassword,omitempty" json:"-"`
+	PasswordRotated   time.Time         `bson:"passwordRotated,omitempty" json:"-"`
+	Database          string            `bson:"database" json:"-"`
+	Created           time.Time         `bson:"created" json:"created"`
+	Status            string            `bson:"status" json:"status"`
+	Access            []AppGrant        `bson:"access" json:"access"`
 }
 
 type Task struct {
-	Title       string        `json:"title" bson:"title"`
-	Description string        `json:"description" bson:"description"`
-	AppId       bson.ObjectID `json:"appId" bson:"appId"`
-	Id          bson.ObjectID `json:"id" bson:"_id"`
-	Status      string        `json:"status" bson:"status"`
-	Created     time.Time     `json:"created" bson:"created"`
+	Title       string          `json:"title" bson:"title"`
+	Description string          `json:"description" bson:"description"`
+	AppId       bson.ObjectID   `json:"appId" bson:"appId"`
+	Id          bson.ObjectID   `json:"id" bson:"_id"`
+	Status      string          `json:"status" bson:"status"`
+	Created     time.Time       `json:"created" bson:"created"`
+	Updated     time.Time       `json:"updated" bson:"updated"`
+	Usage       *TaskUsage      `json:"usage,omitempty" bson:"usage,omitempty"`
+	Todos       *TodoList       `json:"todos,omitempty" bson:"todos,omitempty"`
+	Redactions  int             `json:"redactions" bson:"redactions"` // Number of secrets masked in the task's logs
+	Streams     []StreamArchive `json:"streams,omitempty" bson:"streams,omitempty"`
+}
+
+// StreamArchive references the raw agent output of one run of a task in the app's bucket
+type StreamArchive struct {
+	Object  string    `json:"object" bson:"object"`
+	Started time.Time `json:"started" bson:"started"`
+	Size    int64     `json:"size" bson:"size"` // Compressed size in bytes
+}
+
+// TodoList is the agent's latest checklist for a task, as written by its TodoWrite tool
+type TodoList struct {
+	Items     []TodoItem `json:"items" bson:"items"`
+	Completed int        `json:"completed" bson:"completed"`
+	Total     int        `json:"total" bson:"total"`
+	Current   string     `json:"current,omitempty" bson:"current,omitempty"` // Active form of the item in progress
+	Updated   time.Time  `json:"updated" bson:"updated"`
+}
+
+type TodoItem struct {
+	Content    string `json:"content" bson:"content"`
+	Status     string `json:"status" bson:"status"`
+	ActiveForm string `json:"activeForm" bson:"activeForm"`
+}
+
+// TodoListFromEvent returns the checklist written by a TodoWrite tool use, or nil for other events
+func TodoListFromEvent(e *Event) *TodoList {
+	if e.Kind != EventKindToolUse || e.ToolName != "TodoWrite" {
+		return nil
+	}
+
+	rawTodos, _ := e.ToolInput["todos"].([]any)
+	todos := &TodoList{
+		Items:   []TodoItem{},
+		Updated: e.Time,
+	}
+	for _, raw := range rawTodos {
+		fields, ok := raw.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		item := TodoItem{}
+		item.Content, _ = fields["content"].(string)
+		item.Status, _ = fields["status"].(string)
+		item.ActiveForm, _ = fields["activeForm"].(string)
+
+		switch item.Status {
+		case TodoStatusCompleted:
+			todos.Completed++
+		case TodoStatusInProgress:
+			if todos.Current == "" {
+				todos.Current = item.ActiveForm
+			}
+		}
+		todos.Items = append(todos.Items, item)
+	}
+	todos.Total = len(todos.Items)
+
+	return todos
+}
+
+// TaskUsage is the token usage and cost accumulated over every run of a task.
+type TaskUsage struct {
+	InputTokens              int     `json:"inputTokens" bson:"inputTokens"`
+	OutputTokens             int     `json:"outputTokens" bson:"outputTokens"`
+	CacheCreationInputTokens int     `json:"cacheCreationInputTokens" bson:"cacheCreationInputTokens"`
+	CacheReadInputTokens     int     `json:"cacheReadInputTokens" bson:"cacheReadInputTokens"`
+	CostUSD                  float64 `json:"costUsd" bson:"costUsd"`
+	ReportedCostUSD          float64 `json:"reportedCostUsd" bson:"reportedCostUsd"` // As reported by the agent's result event
+	DurationMs               int     `json:"durationMs" bson:"durationMs"`
+	DurationApiMs            int     `json:"durationApiMs" bson:"durationApiMs"`
+	NumTurns                 int     `json:"numTurns" bson:"numTurns"`
 }
 
+// Tokens is every token the usage was billed for
+func (u *TaskUsage) Tokens() int {
+	return u.InputTokens + u.OutputTokens + u.CacheCreationInputTokens + u.CacheReadInputTokens
+}
+
+// Cost is the cost the agent reported for its runs, or the cost priced from its messages
+// while a run has not reported one yet
+func (u *TaskUsage) Cost() float64 {
+	return max(u.CostUSD, u.ReportedCostUSD)
+}
+
+func (u *TaskUsage) Add(o TaskUsage) {
+	u.InputTokens += o.InputTokens
+	u.OutputTokens += o.OutputTokens
+	u.CacheCreationInputTokens += o.CacheCreationInputTokens
+	u.CacheReadInputTokens += o.CacheReadInputTokens
+	u.CostUSD += o.CostUSD
+	u.ReportedCostUSD += o.ReportedCostUSD
+	u.DurationMs += o.DurationMs
+	u.DurationApiMs += o.DurationApiMs
+	u.NumTurns += o.NumTurns
+}
+
+type UsageFilter struct {
+	AppId  string
+	AppIds []string // Limit to these apps, in addition to AppId
+	From   time.Time
+	To     time.Time
+	Period string // One of UsagePeriodDay, UsagePeriodWeek, UsagePeriodMonth, or empty for the whole range
+}
+
+type UsageSummary struct {
+	AppId     bson.ObjectID `json:"appId" bson:"appId"`
+	Period    *time.Time    `json:"period,omitempty" bson:"period,omitempty"`
+	Tasks     int           `json:"tasks" bson:"tasks"` // Tasks that used tokens in the period
+	TaskUsage `bson:",inline"`
+}
+
+// Log is the log of a task. Messages is the view the UI renders: messages stored before
+// typed events existed followed by one message per text or tool event.
 type Log struct {
-	Id       bson.ObjectID       `json:"id" bson:"_id"`
-	TaskID   bson.ObjectID       `json:"taskId" bson:"taskId"`
-	Messages []map[string]string `json:"messages" bson:"messages"`
+	Id         bson.ObjectID       `json:"id" bson:"_id"`
+	TaskID     bson.ObjectID       `json:"taskId" bson:"taskId"`
+	Messages   []map[string]string `json:"messages" bson:"messages"`
+	EventCount int64               `json:"eventCount" bson:"eventCount"`
+	Events     []*Event            `json:"events" bson:"-"`
+	Todos      *TodoList           `json:"todos,omitempty" bson:"-"`
+}
+
+// Event is a single typed entry of a task's agent stream
+type Event struct {
+	Id              bson.ObjectID  `json:"-" bson:"_id"`
+	TaskID          bson.ObjectID  `json:"taskId" bson:"taskId"`
+	Seq             int64          `json:"seq" bson:"seq"`
+	Time            time.Time      `json:"time" bson:"time"`
+	Kind            string         `json:"kind" bson:"kind"`
+	Subtype         string         `json:"subtype,omitempty" bson:"subtype,omitempty"`
+	SessionID       string         `json:"sessionId,omitempty" bson:"sessionId,omitempty"`
+	MessageID       string         `json:"messageId,omitempty" bson:"messageId,omitempty"`
+	ParentToolUseID string         `json:"parentToolUseId,omitempty" bson:"parentToolUseId,omitempty"`
+	Model           string         `json:"model,omitempty" bson:"model,omitempty"`
+	ToolUseID       string         `json:"toolUseId,omitempty" bson:"toolUseId,omitempty"`
+	ToolName        string         `json:"toolName,omitempty" bson:"toolName,omitempty"`
+	ToolInput       map[string]any `json:"toolInput,omitempty" bson:"toolInput,omitempty"`
+	Text            string         `json:"text,omitempty" bson:"text,omitempty"`
+	IsError         bool           `json:"isError,omitempty" bson:"isError,omitempty"`
+	FilePath        string         `json:"filePath,omitempty" bson:"filePath,omitempty"` // File changed by an Edit, MultiEdit or Write tool use, relative to the repository
+	Diff            string         `json:"diff,omitempty" bson:"diff,omitempty"`         // Unified diff of that change
+	Usage           *EventUsage    `json:"usage,omitempty" bson:"usage,omitempty"`
+	Data            map[string]any `json:"data,omitempty" bson:"data,omitempty"` // Remaining fields of system and result events
+}
+
+type EventUsage struct {
+	InputTokens              int `json:"inputTokens" bson:"inputTokens"`
+	OutputTokens             int `json:"outputTokens" bson:"outputTokens"`
+	CacheCreationInputTokens int `json:"cacheCreationInputTokens" bson:"cacheCreationInputTokens"`
+	CacheReadInputTokens     int `json:"cacheReadInputTokens" bson:"cacheReadInputTokens"`
+}
+
+// CompatMessage renders an event as a legacy log message, or nil for kinds the UI does not show
+func (e *Event) CompatMessage() map[string]string {
+	switch e.Kind {
+	case EventKindText:
+		return map[string]string{
+			"time":  e.Time.Format(time.RFC3339),
+			"title": "update",
+			"text":  e.Text,
+		}
+	case EventKindToolUse:
+		return map[string]string{
+			"time":  e.Time.Format(time.RFC3339),
+			"title": "tool",
+			"text":  e.ToolName,
+		}
+	}
+	return nil
 }
 
+// ToolCall is a tool use paired with its result
+type ToolCall struct {
+	ToolUseID       string         `json:"toolUseId"`
+	ToolName        string         `json:"toolName"`
+	ToolInput       map[string]any `json:"toolInput,omitempty"`
+	ParentToolUseID string         `json:"parentToolUseId,omitempty"`
+	Time            time.Time      `json:"time"`
+	Completed       bool           `json:"completed"`
+	Result          string         `json:"result,omitempty"`
+	IsError         bool           `json:"isError,omitempty"`
+	ResultTime      *time.Time     `json:"resultTime,omitempty"`
+	FilePath        string         `json:"filePath,omitempty"`
+	Diff            string         `json:"diff,omitempty"`
+}
+
+// FileChanges lists the changes made to a single file over a task
+type FileChanges struct {
+	Path    string      `json:"path"`
+	Changes []*ToolCall `json:"changes"`
+}
+
+// PairToolCalls matches tool_use events with their tool_result events, in order of use
+func PairToolCalls(events []*Event) []*ToolCall {
+	calls := []*ToolCall{}
+	byID := map[string]*ToolCall{}
+
+	for _, e := range events {
+		switch e.Kind {
+		case EventKindToolUse:
+			call := &ToolCall{
+				ToolUseID:       e.ToolUseID,
+				ToolName:        e.ToolName,
+				ToolInput:       e.ToolInput,
+				ParentToolUseID: e.ParentToolUseID,
+				Time:            e.Time,
+				FilePath:        e.FilePath,
+				Diff:            e.Diff,
+			}
+			calls = append(calls, call)
+			byID[e.ToolUseID] = call
+		case EventKindToolResult:
+			call, ok := byID[e.ToolUseID]
+			if !ok {
+				continue
+			}
+			resultTime := e.Time
+			call.Completed = true
+			call.Result = e.Text
+			call.IsError = e.IsError
+			call.ResultTime = &resultTime
+		}
+	}
+
+	return calls
+}
+
+// FilesTouched groups the file changing tool calls by file, in order of first change
+func FilesTouched(calls []*ToolCall) []*FileChanges {
+	files := []*FileChanges{}
+	byPath := map[string]*FileChanges{}
+
+	for _, c := range calls {
+		if c.FilePath == "" {
+			continue
+		}
+		f, ok := byPath[c.FilePath]
+		if !ok {
+			f = &FileChanges{Path: c.FilePath}
+			files = append(files, f)
+			byPath[c.FilePath] = f
+		}
+		f.Changes = append(f.Changes, c)
+	}
+
+	return files
+}
+
+// AppendEvents adds events to the log and to its compatibility messages
+func (l *Log) AppendEvents(events ...*Event) {
+	for _, e := range events {
+		l.Events = append(l.Events, e)
+		if m := e.CompatMessage(); m != nil {
+			l.Messages = append(l.Messages, m)
+		}
+		if todos := TodoListFromEvent(e); todos != nil {
+			l.Todos = todos
+		}
+		if e.Seq > l.EventCount {
+			l.EventCount = e.Seq
+		}
+	}
+}
+
+// AuditRecord describes a single mutating API operation
+type AuditRecord struct {
+	Id       bson.ObjectID          `json:"id" bson:"_id"`
+	Time     time.Time              `json:"time" bson:"time"`
+	Actor    string                 `json:"actor" bson:"actor"`
+	Action   string                 `json:"action" bson:"action"`
+	AppId    string                 `json:"appId,omitempty" bson:"appId,omitempty"`
+	TaskId   string                 `json:"taskId,omitempty" bson:"taskId,omitempty"`
+	ClientIP string                 `json:"clientIp" bson:"clientIp"`
+	Changes  map[string]AuditChange `json:"changes,omitempty" bson:"changes,omitempty"`
+}
+
+// APIToken is a bearer token for the API. Only a hash of the token is stored, so the
+// token itself is shown once when it is created.
+type APIToken struct {
+	Id      bson.ObjectID `json:"id" bson:"_id"`
+	Name    string        `json:"name" bson:"name"`
+	Subject string        `json:"subject" bson:"subject"` // Identity the token acts as
+	Hash    string        `json:"-" bson:"hash"`
+	Scopes  []string      `json:"scopes" bson:"scopes"`
+	Created time.Time     `json:"created" bson:"created"`
+	Expires time.Time     `json:"expires,omitzero" bson:"expires,omitempty"` // Zero for tokens that never expire
+}
+
+type AuditChange struct {
+	Before string `json:"before" bson:"before"`
+	After  string `json:"after" bson:"after"`
+}
+
+type AuditFilter struct {
+	Actor  string
+	Action string
+	AppId  string
+	TaskId string
+	From   time.Time
+	To     time.Time
+	Limit  int64
+}
+
+const AuditActionAppCreate = "app.create"
+const AuditActionAppStart = "app.start"
+const AuditActionAppDownload = "app.download"
+const AuditActionAppRotateCredentials = "app.rotateCredentials"
+const AuditActionTaskCreate = "task.create"
+const AuditActionTaskUpdate = "task.update"
+const AuditActionTokenCreate = "token.create"
+const AuditActionTokenDelete = "token.delete"
+const AuditActionAppGrantAccess = "app.grantAccess"
+const AuditActionAppRevokeAccess = "app.revokeAccess"
+const AuditActionUserCreate = "user.create"
+const AuditActionTeamCreate = "team.create"
+const AuditActionTeamUpdate = "team.update"
+const AuditActionWebhookCreate = "webhook.create"
+const AuditActionWebhookDelete = "webhook.delete"
+const AuditActionWebhookRedeliver = "webhook.redeliver"
+
+const EventKindText = "text"
+const EventKindThinking = "thinking"
+const EventKindToolUse = "tool_use"
+const EventKindToolResult = "tool_result"
+const EventKindSystem = "system"
+const EventKindResult = "result"
+const EventKindRaw = "raw" // A line of agent output that is not a stream update
+
+const TodoStatusPending = "pending"
+const TodoStatusInProgress = "in_progress"
+const TodoStatusCompleted = "completed"
+
 const TaskStatusAuthoring = "authoring"
 const TaskStatusInProgress = "in-progress"
 const TaskStatusCompleted = "completed"
+const TaskStatusCancelled = "cancelled" // Queued tasks in this status are skipped by the runner
+const TaskStatusFailed = "failed"       // The runner could not prepare or finish the task
+
+// taskTransitions lists the statuses the API can move a task to from each status. Only the
+// runner completes or fails a task.
+var taskTransitions = map[string][]string{
+	TaskStatusAuthoring:  {TaskStatusInProgress, TaskStatusCancelled},
+	TaskStatusInProgress: {TaskStatusAuthoring, TaskStatusCancelled},
+	TaskStatusCompleted:  {TaskStatusAuthoring, TaskStatusInProgress},
+	TaskStatusCancelled:  {TaskStatusAuthoring, TaskStatusInProgress},
+	TaskStatusFailed:     {TaskStatusAuthoring, TaskStatusInProgress},
+}
+
+// ValidTaskStatus reports whether status is one of the task statuses
+func ValidTaskStatus(status string) bool {
+	_, ok := taskTransitions[status]
+	return ok
+}
+
+// CanTransitionTask reports whether the API may move a task from one status to another.
+// Tasks whose status was blanked by an older update count as authoring.
+func CanTransitionTask(from, to string) bool {
+	if from == "" {
+		from = TaskStatusAuthoring
+	}
+	return from == to || slices.Contains(taskTransitions[from], to)
+}
 
 const AppStatusActive = "active"
+
+const UsagePeriodDay = "day"
+const UsagePeriodWeek = "week"
+const UsagePeriodMonth = "month"
@@ -0,0 +1,388 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	migrationsCollection     = "_migrations"
+	migrationsLockCollection = "_migrations_lock"
+	migrationsLockID         = "migrations"
+	migrationsLockTTL        = 5 * time.Minute
+	migrationsLockWait       = 2 * time.Minute
+)
+
+// Migration is a versioned change to the umami database. Up must be idempotent and, when
+// dryRun is set, only report what it would change.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, database *mongo.Database, dryRun bool) (summary string, err error)
+}
+
+type MigrationResult struct {
+	Version     int    `json:"version"`
+	Description string `json:"description"`
+	Summary     string `json:"summary"`
+	DryRun      bool   `json:"dryRun"`
+}
+
+type appliedMigration struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+// Migrations are applied in order. Append new entries with the next version number
+// and never change one that has shipped.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "Create indexes on tasks.appId and logs.taskId",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create indexes tasks.appId_1 and logs.taskId_1", nil
+			}
+
+			_, err := database.Collection(tasksCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "appId", Value: 1}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			_, err = database.Collection(logStreamCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "taskId", Value: 1}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created indexes tasks.appId_1 and logs.taskId_1", nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "Backfill task status and timestamps",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			tc := database.Collection(tasksCollection)
+
+			missingStatus := bson.M{"status": bson.M{"$in": bson.A{nil, ""}}}
+			missingCreated := bson.M{"created": bson.M{"$exists": false}}
+			missingUpdated := bson.M{"updated": bson.M{"$exists": false}}
+
+			if dryRun {
+				counts := []int64{}
+				for _, filter := range []bson.M{missingStatus, missingCreated, missingUpdated} {
+					n, err := tc.CountDocuments(ctx, filter)
+					if err != nil {
+						return "", err
+					}
+					counts = append(counts, n)
+				}
+				return fmt.Sprintf("would set status on %d, created on %d and updated on %d tasks", counts[0], counts[1], counts[2]), nil
+			}
+
+			statusRes, err := tc.UpdateMany(ctx, missingStatus, bson.M{"$set": bson.M{"status": TaskStatusAuthoring}})
+			if err != nil {
+				return "", err
+			}
+
+			// Tasks without a created time take it from their object ID
+			createdRes, err := tc.UpdateMany(ctx, missingCreated, mongo.Pipeline{
+				bson.D{{Key: "$set", Value: bson.M{"created": bson.M{"$toDate": "$_id"}}}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			updatedRes, err := tc.UpdateMany(ctx, missingUpdated, mongo.Pipeline{
+				bson.D{{Key: "$set", Value: bson.M{"updated": "$created"}}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return fmt.Sprintf("set status on %d, created on %d and updated on %d tasks", statusRes.ModifiedCount, createdRes.ModifiedCount, updatedRes.ModifiedCount), nil
+		},
+	},
+	{
+		Version:     3,
+		Description: "Create indexes on the audit log",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create indexes audit.time_-1 and audit.appId_1_time_-1", nil
+			}
+
+			_, err := database.Collection(auditCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "time", Value: -1}}},
+				{Keys: bson.D{{Key: "appId", Value: 1}, {Key: "time", Value: -1}}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created indexes audit.time_-1 and audit.appId_1_time_-1", nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "Create unique index on events.taskId and events.seq",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create index events.taskId_1_seq_1", nil
+			}
+
+			_, err := database.Collection(eventsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "taskId", Value: 1}, {Key: "seq", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created index events.taskId_1_seq_1", nil
+		},
+	},
+	{
+		Version:     5,
+		Description: "Create text indexes for search",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create text indexes on tasks (title, description) and events (text, toolName)", nil
+			}
+
+			_, err := database.Collection(tasksCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "title", Value: "text"}, {Key: "description", Value: "text"}},
+				Options: options.Index().SetWeights(bson.D{{Key: "title", Value: 3}, {Key: "description", Value: 1}}),
+			})
+			if err != nil {
+				return "", err
+			}
+
+			_, err = database.Collection(eventsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "text", Value: "text"}, {Key: "toolName", Value: "text"}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created text indexes on tasks and events", nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "Create unique index on tokens.hash",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create index tokens.hash_1", nil
+			}
+
+			_, err := database.Collection(tokensCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "hash", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created index tokens.hash_1", nil
+		},
+	},
+	{
+		Version:     7,
+		Description: "Create indexes for users, teams and app access",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create indexes users.name_1, teams.members_1 and apps.access.kind_1_access.subject_1", nil
+			}
+
+			_, err := database.Collection(usersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "name", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				return "", err
+			}
+
+			_, err = database.Collection(teamsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "members", Value: 1}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			_, err = database.Collection(appsCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "access.kind", Value: 1}, {Key: "access.subject", Value: 1}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created indexes users.name_1, teams.members_1 and apps.access.kind_1_access.subject_1", nil
+		},
+	},
+	{
+		Version:     8,
+		Description: "Create indexes for webhooks and their deliveries",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create indexes webhooks.appId_1, webhook_deliveries.status_1_nextAttempt_1 and webhook_deliveries.webhookId_1_created_-1", nil
+			}
+
+			_, err := database.Collection(webhooksCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys: bson.D{{Key: "appId", Value: 1}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			_, err = database.Collection(webhookDeliveriesCollection).Indexes().CreateMany(ctx, []mongo.IndexModel{
+				{Keys: bson.D{{Key: "status", Value: 1}, {Key: "nextAttempt", Value: 1}}},
+				{Keys: bson.D{{Key: "webhookId", Value: 1}, {Key: "created", Value: -1}}},
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created indexes webhooks.appId_1, webhook_deliveries.status_1_nextAttempt_1 and webhook_deliveries.webhookId_1_created_-1", nil
+		},
+	},
+	{
+		Version:     9,
+		Description: "Create indexes for app usage and quota counters",
+		Up: func(ctx context.Context, database *mongo.Database, dryRun bool) (string, error) {
+			if dryRun {
+				return "would create indexes app_usage.appId_1_day_1 and quota_counters.expires_1", nil
+			}
+
+			_, err := database.Collection(appUsageCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "appId", Value: 1}, {Key: "day", Value: 1}},
+				Options: options.Index().SetUnique(true),
+			})
+			if err != nil {
+				return "", err
+			}
+
+			// Counters of past periods are removed once they expire
+			_, err = database.Collection(quotaCountersCollection).Indexes().CreateOne(ctx, mongo.IndexModel{
+				Keys:    bson.D{{Key: "expires", Value: 1}},
+				Options: options.Index().SetExpireAfterSeconds(0),
+			})
+			if err != nil {
+				return "", err
+			}
+
+			return "created indexes app_usage.appId_1_day_1 and quota_counters.expires_1", nil
+		},
+	},
+}
+
+// Migrate applies every migration that is not yet recorded in the _migrations collection.
+// Only one process migrates at a time; others wait for the lock and then find nothing to do.
+func (m *mongoDB) Migrate(ctx context.Context, dryRun bool) ([]MigrationResult, error) {
+	database := m.client.Database(databaseName)
+
+	release, err := m.acquireMigrationsLock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	applied := map[int]bool{}
+	cursor, err := database.Collection(migrationsCollection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	for cursor.Next(ctx) {
+		var am appliedMigration
+		if err := cursor.Decode(&am); err != nil {
+			return nil, err
+		}
+		applied[am.Version] = true
+	}
+
+	results := []MigrationResult{}
+	for _, mig := range migrations {
+		if applied[mig.Version] {
+			continue
+		}
+
+		log.Printf("Migration %d (%s): running, dry run %t", mig.Version, mig.Description, dryRun)
+		summary, err := mig.Up(ctx, database, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("migration %d failed: %w", mig.Version, err)
+		}
+
+		results = append(results, MigrationResult{
+			Version:     mig.Version,
+			Description: mig.Description,
+			Summary:     summary,
+			DryRun:      dryRun,
+		})
+
+		if dryRun {
+			continue
+		}
+
+		_, err = database.Collection(migrationsCollection).InsertOne(ctx, appliedMigration{
+			Version:     mig.Version,
+			Description: mig.Description,
+			AppliedAt:   time.Now(),
+		})
+		if err != nil {
+			return results, fmt.Errorf("unable to record migration %d: %w", mig.Version, err)
+		}
+		log.Printf("Migration %d: %s", mig.Version, summary)
+	}
+
+	return results, nil
+}
+
+// acquireMigrationsLock takes a lease on a lock document. The lease expires so a crashed
+// process cannot block migrations forever.
+func (m *mongoDB) acquireMigrationsLock(ctx context.Context) (func(), error) {
+	lc := m.client.Database(databaseName).Collection(migrationsLockCollection)
+	owner := uuid.New().String()
+	deadline := time.Now().Add(migrationsLockWait)
+
+	for {
+		now := time.Now()
+		_, err := lc.UpdateOne(ctx,
+			bson.M{"_id": migrationsLockID, "expires": bson.M{"$lt": now}},
+			bson.M{"$set": bson.M{"owner": owner, "expires": now.Add(migrationsLockTTL)}},
+			options.UpdateOne().SetUpsert(true),
+		)
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+		if now.After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for migrations lock")
+		}
+
+		log.Printf("Migrations lock is held by another process, waiting")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(2 * time.Second):
+		}
+	}
+
+	return func() {
+		_, err := lc.DeleteOne(context.Background(), bson.M{"_id": migrationsLockID, "owner": owner})
+		if err != nil {
+			log.Printf("Unable to release migrations lock %s", err)
+		}
+	}, nil
+}
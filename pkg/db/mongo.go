@@ -2,36 +2,67 @@ package db
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"iter"
 	"log"
+	"sort"
+	"sync"
 	"time"
+	"umami/pkg/metrics"
+	"umami/pkg/secrets"
+	"umami/pkg/tracing"
 	"umami/pkg/utils"
 
 	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/event"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"go.mongodb.org/mongo-driver/v2/mongo/readpref"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	databaseName        = "umami"
-	appsCollection      = "apps"
-	tasksCollection     = "tasks"
-	logStreamCollection = "logs"
+	databaseName                = "umami"
+	appsCollection              = "apps"
+	tasksCollection             = "tasks"
+	logStreamCollection         = "logs"
+	auditCollection             = "audit"
+	eventsCollection            = "events"
+	tokensCollection            = "tokens"
+	usersCollection             = "users"
+	teamsCollection             = "teams"
+	webhooksCollection          = "webhooks"
+	webhookDeliveriesCollection = "webhook_deliveries"
+	appUsageCollection          = "app_usage"
+	quotaCountersCollection     = "quota_counters"
+
+	AppPasswordLength = 32
 )
 
 type mongoDB struct {
-	client              *mongo.Client
-	appsCollection      *mongo.Collection
-	tasksCollection     *mongo.Collection
-	logStreamCollection *mongo.Collection
+	client                      *mongo.Client
+	appsCollection              *mongo.Collection
+	tasksCollection             *mongo.Collection
+	logStreamCollection         *mongo.Collection
+	auditCollection             *mongo.Collection
+	eventsCollection            *mongo.Collection
+	tokensCollection            *mongo.Collection
+	usersCollection             *mongo.Collection
+	teamsCollection             *mongo.Collection
+	webhooksCollection          *mongo.Collection
+	webhookDeliveriesCollection *mongo.Collection
+	appUsageCollection          *mongo.Collection
+	quotaCountersCollection     *mongo.Collection
 }
 
 func NewMongoDB(connectionString string) (*mongoDB, error) {
 	opts := options.Client().ApplyURI(connectionString).
 		SetMaxPoolSize(100).
-		SetMaxConnIdleTime(30 * time.Second)
+		SetMaxConnIdleTime(30 * time.Second).
+		SetMonitor(commandMonitor)
 	client, err := mongo.Connect(opts)
 	if err != nil {
 		return nil, err
@@ -41,15 +72,91 @@ func NewMongoDB(connectionString string) (*mongoDB, error) {
 	ac := client.Database(databaseName).Collection(appsCollection)
 	tc := client.Database(databaseName).Collection(tasksCollection)
 	lc := client.Database(databaseName).Collection(logStreamCollection)
+	auc := client.Database(databaseName).Collection(auditCollection)
+	ec := client.Database(databaseName).Collection(eventsCollection)
+	tkc := client.Database(databaseName).Collection(tokensCollection)
+	uc := client.Database(databaseName).Collection(usersCollection)
+	tmc := client.Database(databaseName).Collection(teamsCollection)
+	wc := client.Database(databaseName).Collection(webhooksCollection)
+	wdc := client.Database(databaseName).Collection(webhookDeliveriesCollection)
+	apuc := client.Database(databaseName).Collection(appUsageCollection)
+	qcc := client.Database(databaseName).Collection(quotaCountersCollection)
 
 	return &mongoDB{
-		client:              client,
-		appsCollection:      ac,
-		tasksCollection:     tc,
-		logStreamCollection: lc,
+		client:                      client,
+		appsCollection:              ac,
+		tasksCollection:             tc,
+		logStreamCollection:         lc,
+		auditCollection:             auc,
+		eventsCollection:            ec,
+		tokensCollection:            tkc,
+		usersCollection:             uc,
+		teamsCollection:             tmc,
+		webhooksCollection:          wc,
+		webhookDeliveriesCollection: wdc,
+		appUsageCollection:          apuc,
+		quotaCountersCollection:     qcc,
 	}, nil
 }
 
+var mongoCommandDuration = metrics.NewHistogram("umami_mongo_command_duration_seconds", "Time MongoDB took to answer commands, by command and outcome. Change streams wait on getMore.", metrics.LatencyBuckets, "command", "outcome")
+
+// commandSpans holds the spans of commands in flight, by commandKey
+var commandSpans sync.Map
+
+type commandKey struct {
+	connection string
+	request    int64
+}
+
+// commandMonitor times every command, and traces those sent within a trace so that
+// background work such as connection checks starts no traces of its own
+var commandMonitor = &event.CommandMonitor{
+	Started: func(ctx context.Context, e *event.CommandStartedEvent) {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return
+		}
+		attributes := []attribute.KeyValue{
+			attribute.String("db.system", "mongodb"),
+			attribute.String("db.name", e.DatabaseName),
+			attribute.String("db.operation", e.CommandName),
+		}
+		// The first field of a command names its collection, as in {find: "tasks", ...}. The
+		// driver empties sensitive commands such as authentication.
+		if first, err := e.Command.IndexErr(0); err == nil {
+			if collection, ok := first.Value().StringValueOK(); ok {
+				attributes = append(attributes, attribute.String("db.mongodb.collection", collection))
+			}
+		}
+		_, span := tracing.Tracer.Start(ctx, "mongo."+e.CommandName, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attributes...))
+		commandSpans.Store(commandKey{e.ConnectionID, e.RequestID}, span)
+	},
+	Succeeded: func(_ context.Context, e *event.CommandSucceededEvent) {
+		mongoCommandDuration.Observe(e.Duration.Seconds(), e.CommandName, "success")
+		if span, ok := commandSpans.LoadAndDelete(commandKey{e.ConnectionID, e.RequestID}); ok {
+			tracing.End(span.(trace.Span), nil)
+		}
+	},
+	Failed: func(_ context.Context, e *event.CommandFailedEvent) {
+		mongoCommandDuration.Observe(e.Duration.Seconds(), e.CommandName, "failure")
+		if span, ok := commandSpans.LoadAndDelete(commandKey{e.ConnectionID, e.RequestID}); ok {
+			tracing.End(span.(trace.Span), e.Failure)
+		}
+	},
+}
+
+func (m *mongoDB) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx, readpref.Primary())
+}
+
+func (m *mongoDB) CheckChangeStreams(ctx context.Context) error {
+	stream, err := m.eventsCollection.Watch(ctx, mongo.Pipeline{})
+	if err != nil {
+		return err
+	}
+	return stream.Close(ctx)
+}
+
 func (m *mongoDB) CreateApp(ctx context.Context, app *App) (string, error) {
 
 	app.Id = bson.NewObjectID()
@@ -65,16 +172,16 @@ func (m *mongoDB) CreateApp(ctx context.Context, app *App) (string, error) {
 }
 
 func (m *mongoDB) CreateAppDatabase(ctx context.Context, name string) (databaseName string, username string, password string, err error) {
-	password = utils.RandStringBytes(12)
+	password = utils.RandStringBytes(AppPasswordLength)
 	uuid := uuid.New().String()
 	username = fmt.Sprintf("admin-%s", uuid)
 	databaseName = fmt.Sprintf("%s-%s", utils.GetName(name), uuid)
 
 	res := m.client.Database(databaseName).RunCommand(ctx,
 		bson.D{
-			{"createUser", username},
-			{"pwd", password},
-			{"roles", []bson.M{
+			{Key: "createUser", Value: username},
+			{Key: "pwd", Value: password},
+			{Key: "roles", Value: []bson.M{
 				{"role": "dbOwner", "db": databaseName},
 			}},
 		})
@@ -93,13 +200,15 @@ func (m *mongoDB) CreateTask(ctx context.Context, appId string, title, descripti
 		return "", err
 	}
 
+	now := time.Now()
 	t := Task{
 		Title:       title,
 		Description: description,
 		AppId:       appObjectId,
 		Id:          bson.NewObjectID(),
 		Status:      TaskStatusAuthoring,
-		Created:     time.Now(),
+		Created:     now,
+		Updated:     now,
 	}
 
 	res, err := m.tasksCollection.InsertOne(ctx, &t, nil)
@@ -122,28 +231,71 @@ func (m *mongoDB) CreateTask(ctx context.Context, appId string, title, descripti
 	return insertedTaskId.Hex(), nil
 }
 
-func (m *mongoDB) InsertLog(ctx context.Context, taskId string, messages []map[string]string) error {
+func (m *mongoDB) ReserveEventSeqs(ctx context.Context, taskId string, n int) (int64, error) {
 	taskObjectId, err := bson.ObjectIDFromHex(taskId)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	_, err = m.logStreamCollection.UpdateMany(ctx, bson.M{
-		"taskId": taskObjectId,
-	}, bson.M{
-		"$push": bson.M{
-			"messages": bson.M{
-				"$each": messages,
-			},
-		},
-	})
+	// The block is reserved on the task's log document
+	l := Log{}
+	err = m.logStreamCollection.FindOneAndUpdate(ctx,
+		bson.M{"taskId": taskObjectId},
+		bson.M{"$inc": bson.M{"eventCount": int64(n)}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&l)
+	if err != nil {
+		return 0, err
+	}
+
+	return l.EventCount - int64(n) + 1, nil
+}
+
+func (m *mongoDB) InsertLog(ctx context.Context, taskId string, events []*Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+
+	taskObjectId, err := bson.ObjectIDFromHex(taskId)
 	if err != nil {
 		return err
 	}
 
+	docs := make([]any, len(events))
+	for i, e := range events {
+		if e.Seq == 0 {
+			return fmt.Errorf("event %d of the batch has no sequence number", i)
+		}
+		e.Id = bson.NewObjectID()
+		e.TaskID = taskObjectId
+		docs[i] = e
+	}
+
+	// Unordered, so that events written by an earlier attempt at the batch do not stop the
+	// rest. The unique index on taskId and seq rejects them as duplicates.
+	_, err = m.eventsCollection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !onlyDuplicateKeys(err) {
+		return err
+	}
+
 	return nil
 }
 
+// onlyDuplicateKeys reports whether every write of a bulk write that failed was rejected
+// as a duplicate
+func onlyDuplicateKeys(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if !mongo.IsDuplicateKeyError(writeErr.WriteError) {
+			return false
+		}
+	}
+	return true
+}
+
 func (m *mongoDB) FetchLog(ctx context.Context, taskId string) (*Log, error) {
 	taskObjectId, err := bson.ObjectIDFromHex(taskId)
 	if err != nil {
@@ -155,10 +307,43 @@ func (m *mongoDB) FetchLog(ctx context.Context, taskId string) (*Log, error) {
 	if err != nil {
 		return nil, err
 	}
+	if l.Messages == nil {
+		l.Messages = []map[string]string{}
+	}
+
+	events, err := m.FetchEvents(ctx, taskId, 0)
+	if err != nil {
+		return nil, err
+	}
+	l.Events = []*Event{}
+	l.AppendEvents(events...)
 
 	return &l, nil
 }
 
+func (m *mongoDB) FetchEvents(ctx context.Context, taskId string, afterSeq int64) ([]*Event, error) {
+	taskObjectId, err := bson.ObjectIDFromHex(taskId)
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := m.eventsCollection.Find(ctx,
+		bson.M{"taskId": taskObjectId, "seq": bson.M{"$gt": afterSeq}},
+		options.Find().SetSort(bson.D{{Key: "seq", Value: 1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	events := []*Event{}
+	err = cursor.All(ctx, &events)
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
 func (m *mongoDB) UpdateTask(ctx context.Context, appId, taskId string, title, description, status string) error {
 	taskObjectId, err := bson.ObjectIDFromHex(taskId)
 	if err != nil {
@@ -175,6 +360,7 @@ func (m *mongoDB) UpdateTask(ctx context.Context, appId, taskId string, title, d
 			"status":      status,
 			"title":       title,
 			"description": description,
+			"updated":     time.Now(),
 		},
 	})
 	if err != nil {
@@ -187,11 +373,14 @@ func (m *mongoDB) UpdateTask(ctx context.Context, appId, taskId string, title, d
 func (m *mongoDB) GetTask(ctx context.Context, taskId string) (*Task, error) {
 	taskObjectId, err := bson.ObjectIDFromHex(taskId)
 	if err != nil {
-		return nil, err
+		return nil, ErrInvalidID
 	}
 
 	var task Task
 	err = m.tasksCollection.FindOne(ctx, bson.M{"_id": taskObjectId}).Decode(&task)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -202,11 +391,14 @@ func (m *mongoDB) GetTask(ctx context.Context, taskId string) (*Task, error) {
 func (m *mongoDB) GetApp(ctx context.Context, appId string) (*App, error) {
 	appObjectId, err := bson.ObjectIDFromHex(appId)
 	if err != nil {
-		return nil, err
+		return nil, ErrInvalidID
 	}
 
 	var app App
 	err = m.appsCollection.FindOne(ctx, bson.M{"_id": appObjectId}).Decode(&app)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -235,6 +427,15 @@ func (m *mongoDB) GetApps(ctx context.Context) ([]*App, error) {
 	return apps, nil
 }
 
+func (m *mongoDB) CountTasks(ctx context.Context, appId string, status string) (int64, error) {
+	appObjectId, err := bson.ObjectIDFromHex(appId)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.tasksCollection.CountDocuments(ctx, bson.M{"appId": appObjectId, "status": status})
+}
+
 func (m *mongoDB) GetTasks(ctx context.Context, appId string) ([]*Task, error) {
 	appObjectId, err := bson.ObjectIDFromHex(appId)
 	if err != nil {
@@ -260,44 +461,1033 @@ func (m *mongoDB) GetTasks(ctx context.Context, appId string) ([]*Task, error) {
 	return tasks, nil
 }
 
-func (m *mongoDB) StartLogStream(ctx context.Context, taskId string) iter.Seq[Log] {
-	return func(yield func(Log) bool) {
+// StreamEvents yields the task's events after afterSeq and then every event added to it, until
+// ctx is done or the consumer stops. A failure of the change stream is yielded as the last error.
+func (m *mongoDB) StreamEvents(ctx context.Context, taskId string, afterSeq int64) iter.Seq2[*Event, error] {
+	return func(yield func(*Event, error) bool) {
 		taskObjectId, err := bson.ObjectIDFromHex(taskId)
 		if err != nil {
-			log.Printf("Unable to decode task %s with error %s", taskId, err)
+			yield(nil, err)
 			return
 		}
 
-		csOpts := options.ChangeStream().SetFullDocument(options.UpdateLookup)
-
 		type changeDoc struct {
-			FullDocument Log `bson:"fullDocument"`
+			FullDocument Event `bson:"fullDocument"`
 		}
 
-		stream, err := m.logStreamCollection.Watch(ctx, mongo.Pipeline{
+		// Watch before reading the backlog so no event falls in between
+		stream, err := m.eventsCollection.Watch(ctx, mongo.Pipeline{
 			bson.D{
-				{"$match", bson.D{
+				{Key: "$match", Value: bson.D{
+					{Key: "operationType", Value: "insert"},
 					{Key: "fullDocument.taskId", Value: taskObjectId},
 				}},
 			},
-		}, csOpts)
+		})
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+
+		defer stream.Close(context.Background())
+
+		backlog, err := m.FetchEvents(ctx, taskId, afterSeq)
 		if err != nil {
-			log.Printf("Unable to watch task %s with error %s", taskId, err)
+			yield(nil, err)
 			return
 		}
 
-		defer stream.Close(ctx)
+		lastSeq := afterSeq
+		for _, e := range backlog {
+			if !yield(e, nil) {
+				return
+			}
+			lastSeq = e.Seq
+		}
 
 		for stream.Next(ctx) {
 			var ev changeDoc
 			if err := stream.Decode(&ev); err != nil {
-				log.Printf("Unable to decode log %s with error %s", taskId, err)
+				yield(nil, err)
 				return
 			}
 
-			if !yield(ev.FullDocument) {
+			// Already sent with the backlog
+			if ev.FullDocument.Seq <= lastSeq {
+				continue
+			}
+			lastSeq = ev.FullDocument.Seq
+
+			if !yield(&ev.FullDocument, nil) {
 				return
 			}
 		}
+
+		if err := stream.Err(); err != nil && ctx.Err() == nil {
+			yield(nil, err)
+		}
+	}
+}
+
+func (m *mongoDB) UpdateAppPassword(ctx context.Context, appId string, password *secrets.Envelope) error {
+	appObjectId, err := bson.ObjectIDFromHex(appId)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.appsCollection.UpdateOne(ctx, bson.M{"_id": appObjectId}, bson.M{
+		"$set": bson.M{
+			"encryptedPassword": password,
+		},
+		"$unset": bson.M{
+			"password": "",
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// appliedBatchesKept bounds the batch IDs remembered on tasks and daily app usage. Writers
+// apply their batches in order, so only the latest ones are ever retried.
+const appliedBatchesKept = 100
+
+// pushAppliedBatch records that the batch was applied to a document
+func pushAppliedBatch(batchId string) bson.M {
+	return bson.M{"appliedBatches": bson.M{"$each": bson.A{batchId}, "$slice": -appliedBatchesKept}}
+}
+
+func (m *mongoDB) AddTaskUsage(ctx context.Context, taskId, batchId string, at time.Time, usage TaskUsage) error {
+	taskObjectId, err := bson.ObjectIDFromHex(taskId)
+	if err != nil {
+		return err
+	}
+
+	// A batch retried after a failure that may have been applied is skipped if it was
+	var task Task
+	err = m.tasksCollection.FindOneAndUpdate(ctx, bson.M{"_id": taskObjectId, "appliedBatches": bson.M{"$ne": batchId}}, bson.M{
+		"$inc":  usageIncrements("usage.", usage),
+		"$push": pushAppliedBatch(batchId),
+	}, options.FindOneAndUpdate().SetProjection(bson.M{"appId": 1})).Decode(&task)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// Already added to the task, but maybe not to its app
+		err = m.tasksCollection.FindOne(ctx, bson.M{"_id": taskObjectId}, options.FindOne().SetProjection(bson.M{"appId": 1})).Decode(&task)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Budgets and usage reports count usage when it happens, so it is also added up per
+	// app and day along with the tasks that used it
+	filter := bson.M{"appId": task.AppId, "day": at.UTC().Truncate(24 * time.Hour), "appliedBatches": bson.M{"$ne": batchId}}
+	update := bson.M{
+		"$inc":      usageIncrements("", usage),
+		"$addToSet": bson.M{"taskIds": taskObjectId},
+		"$push":     pushAppliedBatch(batchId),
+	}
+	_, err = m.appUsageCollection.UpdateOne(ctx, filter, update, options.UpdateOne().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		// The day's totals exist, either with the batch or created by another writer
+		// since, in which case it is added to them now
+		_, err = m.appUsageCollection.UpdateOne(ctx, filter, update)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func usageIncrements(prefix string, usage TaskUsage) bson.M {
+	return bson.M{
+		prefix + "inputTokens":              usage.InputTokens,
+		prefix + "outputTokens":             usage.OutputTokens,
+		prefix + "cacheCreationInputTokens": usage.CacheCreationInputTokens,
+		prefix + "cacheReadInputTokens":     usage.CacheReadInputTokens,
+		prefix + "costUsd":                  usage.CostUSD,
+		prefix + "reportedCostUsd":          usage.ReportedCostUSD,
+		prefix + "durationMs":               usage.DurationMs,
+		prefix + "durationApiMs":            usage.DurationApiMs,
+		prefix + "numTurns":                 usage.NumTurns,
+	}
+}
+
+func (m *mongoDB) GetAppUsageSince(ctx context.Context, appId string, from time.Time) (*TaskUsage, error) {
+	appObjectId, err := bson.ObjectIDFromHex(appId)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: bson.M{
+			"appId": appObjectId,
+			"day":   bson.M{"$gte": from.UTC().Truncate(24 * time.Hour)},
+		}}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":                      nil,
+			"inputTokens":              bson.M{"$sum": "$inputTokens"},
+			"outputTokens":             bson.M{"$sum": "$outputTokens"},
+			"cacheCreationInputTokens": bson.M{"$sum": "$cacheCreationInputTokens"},
+			"cacheReadInputTokens":     bson.M{"$sum": "$cacheReadInputTokens"},
+			"costUsd":                  bson.M{"$sum": "$costUsd"},
+			"reportedCostUsd":          bson.M{"$sum": "$reportedCostUsd"},
+			"durationMs":               bson.M{"$sum": "$durationMs"},
+			"durationApiMs":            bson.M{"$sum": "$durationApiMs"},
+			"numTurns":                 bson.M{"$sum": "$numTurns"},
+		}}},
+	}
+
+	cursor, err := m.appUsageCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := []*TaskUsage{}
+	err = cursor.All(ctx, &totals)
+	if err != nil {
+		return nil, err
+	}
+	if len(totals) == 0 {
+		return &TaskUsage{}, nil
+	}
+
+	return totals[0], nil
+}
+
+func (m *mongoDB) ConsumeQuota(ctx context.Context, key string, limit int64, expires time.Time) (bool, error) {
+	// A counter at the limit does not match, so the upsert tries to insert a second
+	// document with the same key and fails. The expiry is set on every use, so a counter
+	// used as a lease is kept for as long as it is taken again.
+	_, err := m.quotaCountersCollection.UpdateOne(ctx,
+		bson.M{"_id": key, "count": bson.M{"$lt": limit}},
+		bson.M{"$inc": bson.M{"count": 1}, "$set": bson.M{"expires": expires}},
+		options.UpdateOne().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (m *mongoDB) ReleaseQuota(ctx context.Context, key string) error {
+	_, err := m.quotaCountersCollection.UpdateOne(ctx,
+		bson.M{"_id": key, "count": bson.M{"$gt": 0}},
+		bson.M{"$inc": bson.M{"count": -1}},
+	)
+	return err
+}
+
+func (m *mongoDB) GetQuotaCount(ctx context.Context, key string) (int64, error) {
+	var counter struct {
+		Count int64 `bson:"count"`
+	}
+	err := m.quotaCountersCollection.FindOne(ctx, bson.M{"_id": key}).Decode(&counter)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Count, nil
+}
+
+func (m *mongoDB) GetUsage(ctx context.Context, filter UsageFilter) ([]*UsageSummary, error) {
+	match := bson.M{}
+	appIds := filter.AppIds
+	if filter.AppId != "" {
+		appIds = append(appIds, filter.AppId)
+	}
+	if len(appIds) > 0 {
+		appObjectIds := bson.A{}
+		for _, appId := range appIds {
+			appObjectId, err := bson.ObjectIDFromHex(appId)
+			if err != nil {
+				return nil, err
+			}
+			appObjectIds = append(appObjectIds, appObjectId)
+		}
+		match["appId"] = bson.M{"$in": appObjectIds}
+	}
+
+	// Usage is added up per day, so the range covers the days from and to fall in
+	day := bson.M{}
+	if !filter.From.IsZero() {
+		day["$gte"] = filter.From.UTC().Truncate(24 * time.Hour)
+	}
+	if !filter.To.IsZero() {
+		day["$lt"] = filter.To
+	}
+	if len(day) > 0 {
+		match["day"] = day
+	}
+
+	groupId := bson.M{"appId": "$appId"}
+	if filter.Period != "" {
+		groupId["period"] = bson.M{"$dateTrunc": bson.M{"date": "$day", "unit": filter.Period}}
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{Key: "$match", Value: match}},
+		bson.D{{Key: "$group", Value: bson.M{
+			"_id":                      groupId,
+			"taskIds":                  bson.M{"$push": bson.M{"$ifNull": bson.A{"$taskIds", bson.A{}}}},
+			"inputTokens":              bson.M{"$sum": "$inputTokens"},
+			"outputTokens":             bson.M{"$sum": "$outputTokens"},
+			"cacheCreationInputTokens": bson.M{"$sum": "$cacheCreationInputTokens"},
+			"cacheReadInputTokens":     bson.M{"$sum": "$cacheReadInputTokens"},
+			"costUsd":                  bson.M{"$sum": "$costUsd"},
+			"reportedCostUsd":          bson.M{"$sum": "$reportedCostUsd"},
+			"durationMs":               bson.M{"$sum": "$durationMs"},
+			"durationApiMs":            bson.M{"$sum": "$durationApiMs"},
+			"numTurns":                 bson.M{"$sum": "$numTurns"},
+		}}},
+		// A task that used tokens on several days of a period is counted once
+		bson.D{{Key: "$addFields", Value: bson.M{
+			"appId":  "$_id.appId",
+			"period": "$_id.period",
+			"tasks": bson.M{"$size": bson.M{"$reduce": bson.M{
+				"input":        "$taskIds",
+				"initialValue": bson.A{},
+				"in":           bson.M{"$setUnion": bson.A{"$$value", "$$this"}},
+			}}},
+		}}},
+		bson.D{{Key: "$project", Value: bson.M{"taskIds": 0}}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: "period", Value: 1}, {Key: "appId", Value: 1}}}},
+	}
+
+	cursor, err := m.appUsageCollection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := []*UsageSummary{}
+	err = cursor.All(ctx, &summaries)
+	if err != nil {
+		return nil, err
+	}
+
+	return summaries, nil
+}
+
+func (m *mongoDB) InsertAuditRecord(ctx context.Context, record *AuditRecord) error {
+	record.Id = bson.NewObjectID()
+
+	_, err := m.auditCollection.InsertOne(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoDB) GetAuditRecords(ctx context.Context, filter AuditFilter) ([]*AuditRecord, error) {
+	query := bson.M{}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.AppId != "" {
+		query["appId"] = filter.AppId
+	}
+	if filter.TaskId != "" {
+		query["taskId"] = filter.TaskId
+	}
+
+	timeRange := bson.M{}
+	if !filter.From.IsZero() {
+		timeRange["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		timeRange["$lt"] = filter.To
+	}
+	if len(timeRange) > 0 {
+		query["time"] = timeRange
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "time", Value: -1}})
+	if filter.Limit > 0 {
+		opts.SetLimit(filter.Limit)
+	}
+
+	cursor, err := m.auditCollection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*AuditRecord{}
+	err = cursor.All(ctx, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+func (m *mongoDB) RotateAppPassword(ctx context.Context, app *App, password string, encrypted *secrets.Envelope) error {
+	res := m.client.Database(app.Database).RunCommand(ctx,
+		bson.D{
+			{Key: "updateUser", Value: app.User},
+			{Key: "pwd", Value: password},
+		})
+	if res.Err() != nil {
+		return res.Err()
+	}
+
+	// The database user already has the new password, so storing it must not give up easily
+	// or the app would be left without a working credential
+	update := bson.M{
+		"$set": bson.M{
+			"encryptedPassword": encrypted,
+			"passwordRotated":   time.Now(),
+		},
+		"$unset": bson.M{
+			"password": "",
+		},
+	}
+
+	var err error
+	for attempt := 1; attempt <= 5; attempt++ {
+		_, err = m.appsCollection.UpdateOne(ctx, bson.M{"_id": app.Id}, update)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Unable to store rotated password for app %s (attempt %d): %s", app.Id.Hex(), attempt, err)
+
+		timer := time.NewTimer(time.Duration(attempt) * time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%w (last attempt: %s)", ctx.Err(), err)
+		case <-timer.C:
+		}
+	}
+
+	return err
+}
+
+func (m *mongoDB) UpdateTaskTodos(ctx context.Context, taskId string, todos *TodoList) error {
+	taskObjectId, err := bson.ObjectIDFromHex(taskId)
+	if err != nil {
+		return err
 	}
+
+	_, err = m.tasksCollection.UpdateOne(ctx, bson.M{"_id": taskObjectId}, bson.M{
+		"$set": bson.M{
+			"todos": todos,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoDB) AddTaskRedactions(ctx context.Context, taskId, batchId string, count int) error {
+	taskObjectId, err := bson.ObjectIDFromHex(taskId)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.tasksCollection.UpdateOne(ctx, bson.M{"_id": taskObjectId, "appliedBatches": bson.M{"$ne": batchId}}, bson.M{
+		"$inc": bson.M{
+			"redactions": count,
+		},
+		"$push": pushAppliedBatch(batchId),
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoDB) AddTaskStream(ctx context.Context, taskId string, stream StreamArchive) error {
+	taskObjectId, err := bson.ObjectIDFromHex(taskId)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.tasksCollection.UpdateOne(ctx, bson.M{"_id": taskObjectId}, bson.M{
+		"$push": bson.M{
+			"streams": stream,
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoDB) Search(ctx context.Context, query SearchQuery) ([]*SearchHit, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = 20
+	}
+	terms := searchTerms(query.Text)
+	textScore := bson.M{"$meta": "textScore"}
+
+	taskFilter := bson.M{"$text": bson.M{"$search": query.Text}}
+	eventFilter := bson.M{
+		"$text": bson.M{"$search": query.Text},
+		"kind":  bson.M{"$in": bson.A{EventKindText, EventKindToolUse}},
+	}
+
+	if len(query.AppIds) > 0 {
+		appObjectIds := bson.A{}
+		for _, appId := range query.AppIds {
+			appObjectId, err := bson.ObjectIDFromHex(appId)
+			if err != nil {
+				return nil, err
+			}
+			appObjectIds = append(appObjectIds, appObjectId)
+		}
+		taskFilter["appId"] = bson.M{"$in": appObjectIds}
+
+		// Events only reference their task, so narrow them to the tasks of the apps
+		taskIds := bson.A{}
+		cursor, err := m.tasksCollection.Find(ctx, bson.M{"appId": bson.M{"$in": appObjectIds}}, options.Find().SetProjection(bson.M{"_id": 1}))
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next(ctx) {
+			var t struct {
+				Id bson.ObjectID `bson:"_id"`
+			}
+			if err := cursor.Decode(&t); err != nil {
+				return nil, err
+			}
+			taskIds = append(taskIds, t.Id)
+		}
+		eventFilter["taskId"] = bson.M{"$in": taskIds}
+	}
+
+	findOpts := options.Find().
+		SetProjection(bson.M{"score": textScore}).
+		SetSort(bson.M{"score": textScore}).
+		SetLimit(int64(limit))
+
+	hits := []*SearchHit{}
+
+	taskCursor, err := m.tasksCollection.Find(ctx, taskFilter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	var scoredTasks []struct {
+		Task  `bson:",inline"`
+		Score float64 `bson:"score"`
+	}
+	err = taskCursor.All(ctx, &scoredTasks)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range scoredTasks {
+		// Prefer the title when it matches, otherwise show where the description does
+		field := "title"
+		snippet, highlights := highlight(t.Title, terms)
+		if len(highlights) == 0 && t.Description != "" {
+			field = "description"
+			snippet, highlights = highlight(t.Description, terms)
+		}
+		hits = append(hits, &SearchHit{
+			Kind:       SearchHitTask,
+			AppId:      t.AppId,
+			TaskId:     t.Id,
+			TaskTitle:  t.Title,
+			Field:      field,
+			Snippet:    snippet,
+			Highlights: highlights,
+			Score:      t.Score,
+			Time:       t.Created,
+		})
+	}
+
+	eventCursor, err := m.eventsCollection.Find(ctx, eventFilter, findOpts)
+	if err != nil {
+		return nil, err
+	}
+	var scoredEvents []struct {
+		Event `bson:",inline"`
+		Score float64 `bson:"score"`
+	}
+	err = eventCursor.All(ctx, &scoredEvents)
+	if err != nil {
+		return nil, err
+	}
+
+	// Look up the tasks of the matched events for their app and title
+	eventTaskIds := bson.A{}
+	for _, e := range scoredEvents {
+		eventTaskIds = append(eventTaskIds, e.TaskID)
+	}
+	tasks := map[bson.ObjectID]*Task{}
+	if len(eventTaskIds) > 0 {
+		cursor, err := m.tasksCollection.Find(ctx, bson.M{"_id": bson.M{"$in": eventTaskIds}})
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next(ctx) {
+			var t Task
+			if err := cursor.Decode(&t); err != nil {
+				return nil, err
+			}
+			tasks[t.Id] = &t
+		}
+	}
+
+	for _, e := range scoredEvents {
+		task, ok := tasks[e.TaskID]
+		if !ok {
+			continue
+		}
+		field, text := "text", e.Text
+		if e.Kind == EventKindToolUse {
+			field, text = "toolName", e.ToolName
+		}
+		snippet, highlights := highlight(text, terms)
+		hits = append(hits, &SearchHit{
+			Kind:       SearchHitEvent,
+			AppId:      task.AppId,
+			TaskId:     e.TaskID,
+			TaskTitle:  task.Title,
+			Seq:        e.Seq,
+			EventKind:  e.Kind,
+			Field:      field,
+			Snippet:    snippet,
+			Highlights: highlights,
+			Score:      e.Score,
+			Time:       e.Time,
+		})
+	}
+
+	sort.SliceStable(hits, func(i, j int) bool { return hits[i].Score > hits[j].Score })
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return hits, nil
+}
+
+func (m *mongoDB) CreateAPIToken(ctx context.Context, token *APIToken) (string, error) {
+	token.Id = bson.NewObjectID()
+
+	_, err := m.tokensCollection.InsertOne(ctx, token)
+	if err != nil {
+		return "", err
+	}
+
+	return token.Id.Hex(), nil
+}
+
+func (m *mongoDB) GetAPITokenByHash(ctx context.Context, hash string) (*APIToken, error) {
+	var token APIToken
+	err := m.tokensCollection.FindOne(ctx, bson.M{"hash": hash}).Decode(&token)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (m *mongoDB) GetAPITokens(ctx context.Context) ([]*APIToken, error) {
+	cursor, err := m.tokensCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := []*APIToken{}
+	err = cursor.All(ctx, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (m *mongoDB) DeleteAPIToken(ctx context.Context, tokenId string) error {
+	tokenObjectId, err := bson.ObjectIDFromHex(tokenId)
+	if err != nil {
+		return err
+	}
+
+	res, err := m.tokensCollection.DeleteOne(ctx, bson.M{"_id": tokenObjectId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoDB) GetAccessibleApps(ctx context.Context, user string, teamIds []string) ([]*App, error) {
+	filter := bson.M{"access": bson.M{"$elemMatch": bson.M{"$or": bson.A{
+		bson.M{"kind": GrantKindUser, "subject": user},
+		bson.M{"kind": GrantKindTeam, "subject": bson.M{"$in": teamIds}},
+	}}}}
+
+	cursor, err := m.appsCollection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	apps := []*App{}
+	err = cursor.All(ctx, &apps)
+	if err != nil {
+		return nil, err
+	}
+
+	return apps, nil
+}
+
+func (m *mongoDB) SetAppGrant(ctx context.Context, appId string, grant AppGrant) error {
+	appObjectId, err := bson.ObjectIDFromHex(appId)
+	if err != nil {
+		return err
+	}
+
+	// Replace in two steps so a user or team never holds two roles on the app
+	err = m.RemoveAppGrant(ctx, appId, grant.Kind, grant.Subject)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.appsCollection.UpdateOne(ctx, bson.M{"_id": appObjectId}, bson.M{
+		"$push": bson.M{"access": grant},
+	})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoDB) RemoveAppGrant(ctx context.Context, appId string, kind, subject string) error {
+	appObjectId, err := bson.ObjectIDFromHex(appId)
+	if err != nil {
+		return err
+	}
+
+	res, err := m.appsCollection.UpdateOne(ctx, bson.M{"_id": appObjectId}, bson.M{
+		"$pull": bson.M{"access": bson.M{"kind": kind, "subject": subject}},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoDB) CreateUser(ctx context.Context, user *User) (string, error) {
+	user.Id = bson.NewObjectID()
+
+	_, err := m.usersCollection.InsertOne(ctx, user)
+	if err != nil {
+		return "", err
+	}
+
+	return user.Id.Hex(), nil
+}
+
+func (m *mongoDB) GetUsers(ctx context.Context) ([]*User, error) {
+	cursor, err := m.usersCollection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*User{}
+	err = cursor.All(ctx, &users)
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (m *mongoDB) CreateTeam(ctx context.Context, team *Team) (string, error) {
+	team.Id = bson.NewObjectID()
+	if team.Members == nil {
+		team.Members = []string{}
+	}
+
+	_, err := m.teamsCollection.InsertOne(ctx, team)
+	if err != nil {
+		return "", err
+	}
+
+	return team.Id.Hex(), nil
+}
+
+func (m *mongoDB) GetTeams(ctx context.Context) ([]*Team, error) {
+	return m.findTeams(ctx, bson.M{})
+}
+
+func (m *mongoDB) GetTeamsForUser(ctx context.Context, user string) ([]*Team, error) {
+	return m.findTeams(ctx, bson.M{"members": user})
+}
+
+func (m *mongoDB) findTeams(ctx context.Context, filter bson.M) ([]*Team, error) {
+	cursor, err := m.teamsCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	teams := []*Team{}
+	err = cursor.All(ctx, &teams)
+	if err != nil {
+		return nil, err
+	}
+
+	return teams, nil
+}
+
+func (m *mongoDB) UpdateTeamMembers(ctx context.Context, teamId string, members []string) error {
+	teamObjectId, err := bson.ObjectIDFromHex(teamId)
+	if err != nil {
+		return err
+	}
+
+	res, err := m.teamsCollection.UpdateOne(ctx, bson.M{"_id": teamObjectId}, bson.M{
+		"$set": bson.M{"members": members},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func (m *mongoDB) CreateWebhook(ctx context.Context, webhook *Webhook) (string, error) {
+	webhook.Id = bson.NewObjectID()
+
+	_, err := m.webhooksCollection.InsertOne(ctx, webhook)
+	if err != nil {
+		return "", err
+	}
+
+	return webhook.Id.Hex(), nil
+}
+
+func (m *mongoDB) GetWebhook(ctx context.Context, webhookId string) (*Webhook, error) {
+	webhookObjectId, err := bson.ObjectIDFromHex(webhookId)
+	if err != nil {
+		return nil, err
+	}
+
+	var webhook Webhook
+	err = m.webhooksCollection.FindOne(ctx, bson.M{"_id": webhookObjectId}).Decode(&webhook)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &webhook, nil
+}
+
+func (m *mongoDB) GetWebhooks(ctx context.Context, appId string) ([]*Webhook, error) {
+	filter := bson.M{"appId": bson.M{"$exists": false}}
+	if appId != "" {
+		appObjectId, err := bson.ObjectIDFromHex(appId)
+		if err != nil {
+			return nil, err
+		}
+		filter = bson.M{"appId": appObjectId}
+	}
+
+	return m.findWebhooks(ctx, filter)
+}
+
+func (m *mongoDB) GetWebhooksForEvent(ctx context.Context, appId string, event string) ([]*Webhook, error) {
+	scopes := bson.A{bson.M{"appId": bson.M{"$exists": false}}}
+	if appId != "" {
+		appObjectId, err := bson.ObjectIDFromHex(appId)
+		if err != nil {
+			return nil, err
+		}
+		scopes = append(scopes, bson.M{"appId": appObjectId})
+	}
+
+	return m.findWebhooks(ctx, bson.M{
+		"$or":    scopes,
+		"events": bson.M{"$in": bson.A{event, WebhookEventAll}},
+	})
+}
+
+func (m *mongoDB) GetAllWebhooks(ctx context.Context) ([]*Webhook, error) {
+	return m.findWebhooks(ctx, bson.M{})
+}
+
+func (m *mongoDB) UpdateWebhookSecret(ctx context.Context, webhookId string, secret *secrets.Envelope) error {
+	webhookObjectId, err := bson.ObjectIDFromHex(webhookId)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.webhooksCollection.UpdateOne(ctx, bson.M{"_id": webhookObjectId}, bson.M{
+		"$set": bson.M{
+			"secret": secret,
+		},
+	})
+	return err
+}
+
+func (m *mongoDB) findWebhooks(ctx context.Context, filter bson.M) ([]*Webhook, error) {
+	cursor, err := m.webhooksCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := []*Webhook{}
+	err = cursor.All(ctx, &webhooks)
+	if err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (m *mongoDB) DeleteWebhook(ctx context.Context, webhookId string) error {
+	webhookObjectId, err := bson.ObjectIDFromHex(webhookId)
+	if err != nil {
+		return err
+	}
+
+	res, err := m.webhooksCollection.DeleteOne(ctx, bson.M{"_id": webhookObjectId})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return ErrNotFound
+	}
+
+	_, err = m.webhookDeliveriesCollection.DeleteMany(ctx, bson.M{"webhookId": webhookObjectId})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *mongoDB) CreateWebhookDelivery(ctx context.Context, delivery *WebhookDelivery) (string, error) {
+	delivery.Id = bson.NewObjectID()
+	if delivery.Attempts == nil {
+		delivery.Attempts = []WebhookAttempt{}
+	}
+
+	_, err := m.webhookDeliveriesCollection.InsertOne(ctx, delivery)
+	if err != nil {
+		return "", err
+	}
+
+	return delivery.Id.Hex(), nil
+}
+
+func (m *mongoDB) GetWebhookDelivery(ctx context.Context, deliveryId string) (*WebhookDelivery, error) {
+	deliveryObjectId, err := bson.ObjectIDFromHex(deliveryId)
+	if err != nil {
+		return nil, err
+	}
+
+	var delivery WebhookDelivery
+	err = m.webhookDeliveriesCollection.FindOne(ctx, bson.M{"_id": deliveryObjectId}).Decode(&delivery)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func (m *mongoDB) GetWebhookDeliveries(ctx context.Context, webhookId string, limit int64) ([]*WebhookDelivery, error) {
+	webhookObjectId, err := bson.ObjectIDFromHex(webhookId)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created", Value: -1}})
+	if limit > 0 {
+		opts.SetLimit(limit)
+	}
+
+	cursor, err := m.webhookDeliveriesCollection.Find(ctx, bson.M{"webhookId": webhookObjectId}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []*WebhookDelivery{}
+	err = cursor.All(ctx, &deliveries)
+	if err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (m *mongoDB) ClaimWebhookDelivery(ctx context.Context, lease time.Duration) (*WebhookDelivery, error) {
+	now := time.Now()
+
+	// Pushing nextAttempt past the lease keeps other control planes from sending it too
+	var delivery WebhookDelivery
+	err := m.webhookDeliveriesCollection.FindOneAndUpdate(ctx,
+		bson.M{"status": WebhookDeliveryPending, "nextAttempt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"nextAttempt": now.Add(lease)}},
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "nextAttempt", Value: 1}}).SetReturnDocument(options.After),
+	).Decode(&delivery)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+func (m *mongoDB) RecordWebhookAttempt(ctx context.Context, deliveryId string, attempt WebhookAttempt, status string, nextAttempt time.Time) error {
+	deliveryObjectId, err := bson.ObjectIDFromHex(deliveryId)
+	if err != nil {
+		return err
+	}
+
+	set := bson.M{"status": status}
+	update := bson.M{
+		"$push": bson.M{"attempts": attempt},
+		"$set":  set,
+	}
+	if nextAttempt.IsZero() {
+		update["$unset"] = bson.M{"nextAttempt": ""}
+	} else {
+		set["nextAttempt"] = nextAttempt
+	}
+
+	_, err = m.webhookDeliveriesCollection.UpdateOne(ctx, bson.M{"_id": deliveryObjectId}, update)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
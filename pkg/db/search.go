@@ -0,0 +1,126 @@
+package db
+
+import (
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+type SearchQuery struct {
+	Text   string
+	AppIds []string // Limit to these apps, or all apps when empty
+	Limit  int
+}
+
+// SearchHit is a task or an event matching a search. Highlights are byte offsets of the
+// matched terms within Snippet.
+type SearchHit struct {
+	Kind       string        `json:"kind"` // SearchHitTask or SearchHitEvent
+	AppId      bson.ObjectID `json:"appId"`
+	TaskId     bson.ObjectID `json:"taskId"`
+	TaskTitle  string        `json:"taskTitle"`
+	Seq        int64         `json:"seq,omitempty"`
+	EventKind  string        `json:"eventKind,omitempty"`
+	Field      string        `json:"field"`
+	Snippet    string        `json:"snippet"`
+	Highlights [][2]int      `json:"highlights"`
+	Score      float64       `json:"score"`
+	Time       time.Time     `json:"time"`
+}
+
+const SearchHitTask = "task"
+const SearchHitEvent = "event"
+
+const snippetRadius = 80
+
+// searchTerms splits a query into the lower-cased words to highlight, ignoring quotes and
+// negated terms
+func searchTerms(query string) []string {
+	terms := []string{}
+	for _, word := range strings.Fields(query) {
+		if strings.HasPrefix(word, "-") {
+			continue
+		}
+		word = strings.ToLower(strings.Trim(word, `"'`))
+		if word != "" {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// highlight returns a snippet of text around the first matched term and the offsets of every
+// term match within it. Matching is case-insensitive on word prefixes, approximating the
+// stemming of text indexes.
+func highlight(text string, terms []string) (string, [][2]int) {
+	lower := strings.ToLower(text)
+
+	matches := [][2]int{}
+	for _, term := range terms {
+		for offset := 0; offset < len(lower); {
+			i := strings.Index(lower[offset:], term)
+			if i < 0 {
+				break
+			}
+			start := offset + i
+			end := start + len(term)
+			// Extend to the end of the word so stems highlight the whole word
+			for end < len(lower) && isWordByte(lower[end]) {
+				end++
+			}
+			if start == 0 || !isWordByte(lower[start-1]) {
+				matches = append(matches, [2]int{start, end})
+			}
+			offset = end
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i][0] < matches[j][0] })
+
+	if len(matches) == 0 {
+		if len(text) > 2*snippetRadius {
+			to := 2 * snippetRadius
+			for to > 0 && !isRuneStart(text[to]) {
+				to--
+			}
+			return text[:to] + "…", matches
+		}
+		return text, matches
+	}
+
+	from := max(0, matches[0][0]-snippetRadius)
+	to := min(len(text), matches[0][1]+snippetRadius)
+	for from > 0 && !isRuneStart(text[from]) {
+		from--
+	}
+	for to < len(text) && !isRuneStart(text[to]) {
+		to++
+	}
+
+	prefix, suffix := "", ""
+	if from > 0 {
+		prefix = "…"
+	}
+	if to < len(text) {
+		suffix = "…"
+	}
+
+	highlights := [][2]int{}
+	for _, m := range matches {
+		if m[0] >= from && m[1] <= to {
+			highlights = append(highlights, [2]int{m[0] - from + len(prefix), m[1] - from + len(prefix)})
+		}
+	}
+
+	return prefix + text[from:to] + suffix, highlights
+}
+
+func isWordByte(b byte) bool {
+	return b >= 0x80 || unicode.IsLetter(rune(b)) || unicode.IsDigit(rune(b))
+}
+
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"slices"
+	"time"
+	"umami/pkg/secrets"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const WebhookEventAppCreated = "app.created"
+const WebhookEventTaskCreated = "task.created"
+const WebhookEventTaskQueued = "task.queued"
+const WebhookEventTaskCancelled = "task.cancelled"
+const WebhookEventTaskCompleted = "task.completed"
+const WebhookEventTaskFailed = "task.failed"
+const WebhookEventPing = "ping" // Only sent on request, to test an endpoint
+const WebhookEventAll = "*"
+
+var WebhookEvents = []string{
+	WebhookEventAppCreated,
+	WebhookEventTaskCreated,
+	WebhookEventTaskQueued,
+	WebhookEventTaskCancelled,
+	WebhookEventTaskCompleted,
+	WebhookEventTaskFailed,
+}
+
+const WebhookDeliveryPending = "pending"
+const WebhookDeliverySucceeded = "succeeded"
+const WebhookDeliveryFailed = "failed" // Every attempt failed
+
+// Webhook is an endpoint that is sent the events it subscribes to. Webhooks without an app
+// are global and receive the events of every app.
+type Webhook struct {
+	Id        bson.ObjectID     `json:"id" bson:"_id"`
+	AppId     bson.ObjectID     `json:"appId,omitzero" bson:"appId,omitempty"`
+	URL       string            `json:"url" bson:"url"`
+	Events    []string          `json:"events" bson:"events"` // Event names, or WebhookEventAll
+	Secret    *secrets.Envelope `json:"-" bson:"secret"`      // Signs the deliveries
+	CreatedBy string            `json:"createdBy" bson:"createdBy"`
+	Created   time.Time         `json:"created" bson:"created"`
+}
+
+// ValidWebhookEvent reports whether a webhook can subscribe to event
+func ValidWebhookEvent(event string) bool {
+	return event == WebhookEventAll || slices.Contains(WebhookEvents, event)
+}
+
+// WebhookDelivery is one event sent to one webhook, with every attempt made to send it
+type WebhookDelivery struct {
+	Id           bson.ObjectID    `json:"id" bson:"_id"`
+	WebhookId    bson.ObjectID    `json:"webhookId" bson:"webhookId"`
+	Event        string           `json:"event" bson:"event"`
+	Payload      string           `json:"payload" bson:"payload"` // Request body, the same for every attempt
+	Status       string           `json:"status" bson:"status"`
+	Attempts     []WebhookAttempt `json:"attempts" bson:"attempts"`
+	NextAttempt  time.Time        `json:"nextAttempt,omitzero" bson:"nextAttempt,omitempty"` // Zero once the delivery succeeded or failed
+	RedeliveryOf bson.ObjectID    `json:"redeliveryOf,omitzero" bson:"redeliveryOf,omitempty"`
+	Created      time.Time        `json:"created" bson:"created"`
+}
+
+type WebhookAttempt struct {
+	Time       time.Time `json:"time" bson:"time"`
+	StatusCode int       `json:"statusCode,omitempty" bson:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	Response   string    `json:"response,omitempty" bson:"response,omitempty"` // Start of the response body
+	DurationMs int       `json:"durationMs" bson:"durationMs"`
+}
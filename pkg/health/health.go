@@ -0,0 +1,131 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+	"umami/pkg/apierror"
+)
+
+const StatusOK = "ok"
+const StatusDegraded = "degraded" // An optional dependency is failing
+const StatusFailing = "failing"
+
+// checkTimeout bounds each check, so that a dependency that hangs is reported as failing
+// rather than holding up the probe
+const checkTimeout = 2 * time.Second
+
+// Check is a dependency of the service
+type Check struct {
+	Name     string
+	Optional bool // The service still does its main job without it, so it stays ready
+	Run      func(ctx context.Context) error
+}
+
+type Result struct {
+	Name      string  `json:"name"`
+	Status    string  `json:"status"` // StatusOK or StatusFailing
+	Optional  bool    `json:"optional,omitempty"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status  string    `json:"status"`
+	Time    time.Time `json:"time"`
+	Checks  []Result  `json:"checks"`
+	Details any       `json:"details,omitempty"`
+}
+
+// Checker serves the health of a service and its dependencies. Details, when set, adds
+// the state of the service itself to reports.
+type Checker struct {
+	Checks  []Check
+	Details func() any
+}
+
+// Run runs every check at once and reports on them
+func (c *Checker) Run(ctx context.Context) Report {
+	report := Report{Status: StatusOK, Time: time.Now(), Checks: make([]Result, len(c.Checks))}
+
+	wg := sync.WaitGroup{}
+	for i, check := range c.Checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		switch {
+		case result.Status == StatusOK:
+		case result.Optional && report.Status == StatusOK:
+			report.Status = StatusDegraded
+		case !result.Optional:
+			report.Status = StatusFailing
+		}
+	}
+	if c.Details != nil {
+		report.Details = c.Details()
+	}
+
+	return report
+}
+
+func run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	started := time.Now()
+	err := check.Run(ctx)
+	result := Result{
+		Name:      check.Name,
+		Status:    StatusOK,
+		Optional:  check.Optional,
+		LatencyMs: float64(time.Since(started).Microseconds()) / 1000,
+	}
+	if err != nil {
+		result.Status, result.Error = StatusFailing, err.Error()
+	}
+	return result
+}
+
+// Healthz reports whether the service is alive. It answers 200 as long as the service can
+// serve it; the report shows how its dependencies are doing.
+func (c *Checker) Healthz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, false)
+	}
+}
+
+// Readyz reports whether the service can take traffic. It answers 503 while a dependency
+// that is not optional is failing.
+func (c *Checker) Readyz() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c.serve(w, r, true)
+	}
+}
+
+func (c *Checker) serve(w http.ResponseWriter, r *http.Request, readiness bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	report := c.Run(r.Context())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if readiness && report.Status == StatusFailing {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	err := json.NewEncoder(w).Encode(report)
+	if err != nil {
+		log.Printf("Unable to marshal health response %s", err)
+	}
+}
@@ -1,15 +1,52 @@
 package pubsub
 
-import "context"
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// ErrLockLost is returned when renewing an app lock that expired, and may have been taken
+// by another worker along with the task that was being processed
+var ErrLockLost = errors.New("app lock is no longer held")
 
 type PubSub interface {
-	SendMessage(ctx context.Context, appID string, taskID string) error
-	PullMessage(ctx context.Context) (string, error)
-	RenewLock(ctx context.Context, appID string) error
+	SendMessage(ctx context.Context, appID string, taskID string) error // Carries the trace context of ctx to the worker
+	PullMessage(ctx context.Context) (*Message, error)
+	RenewLock(ctx context.Context, appID string, token string) error // Extend a lock taken by PullMessage; ErrLockLost if it is no longer the holder's
 	DeleteLock(ctx context.Context, appID string) error
+	TryLock(ctx context.Context, appID string) (token string, locked bool, err error) // Take the app lock unless it is held; release with ReleaseLock
+	ReleaseLock(ctx context.Context, appID string, token string) error                // Release a lock taken with TryLock, if it is still the holder's
+	SendAppStart(ctx context.Context, appID string, port int) error                   // Ask a runner to start the app's process on port
+	PullAppStart(ctx context.Context) (*AppStart, error)                              // Wait a while for an app start, nil if none was asked for
+}
+
+// Message is a task taken from an app queue
+type Message struct {
+	TaskID string            `json:"taskId"`
+	Trace  map[string]string `json:"trace,omitempty"` // W3C trace context of the request that queued the task
+
+	LockToken string `json:"-"` // Held in the app lock while the task is processed, for RenewLock
+}
+
+// Context returns ctx with the trace context of the message, so that the spans of the
+// worker continue the trace of the request that queued the task
+func (m *Message) Context(ctx context.Context) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(m.Trace))
+}
+
+// AppStart asks a runner to start an app's process. Apps are started by runners, as app
+// credentials are only decrypted there.
+type AppStart struct {
+	AppID string `json:"appId"`
+	Port  int    `json:"port"`
 }
 
 type Cache interface {
 	GetAppPid(ctx context.Context, appID string) (int, error)
 	SetAppPid(ctx context.Context, appID string, pid int) error
+	GetAppPort(ctx context.Context, appID string) (int, error) // Port of the process last started for the app
+	SetAppPort(ctx context.Context, appID string, port int) error
 }
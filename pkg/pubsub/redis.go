@@ -2,19 +2,45 @@ package pubsub
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"time"
+	"umami/pkg/metrics"
+	"umami/pkg/tracing"
 
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var (
+	messagesSent    = metrics.NewCounter("umami_queue_messages_sent_total", "Tasks added to app queues.")
+	messagesPulled  = metrics.NewCounter("umami_queue_messages_pulled_total", "Tasks taken from app queues by workers.")
+	lockRenewFailed = metrics.NewCounter("umami_lock_renew_failures_total", "App lock renewals that failed.")
+	locksExpired    = metrics.NewCounter("umami_lock_expirations_total", "App locks that expired, putting the task back in the queue.")
+)
+
+// queueDepthTimeout bounds reading the queue depths when metrics are scraped
+const queueDepthTimeout = 2 * time.Second
+
+// pullWait bounds each wait for a ready app or an app start, so that runners notice they
+// are stopped, as Redis keeps blocking after the context is cancelled
+const pullWait = 5 * time.Second
+
 type redisClient struct {
-	client *redis.Client
+	client  *redis.Client
+	lockTTL time.Duration
 }
 
-func NewRedis(address string) (*redisClient, error) {
+// NewRedis connects to Redis at address. An app lock that is not renewed expires after
+// lockTTL, which puts the task that was being processed back in the app's queue.
+func NewRedis(address string, lockTTL time.Duration) (*redisClient, error) {
 	rdb := redis.NewClient(&redis.Options{
 		Addr:     address,
 		Password: "", // no password set
@@ -47,6 +73,7 @@ func NewRedis(address string) (*redisClient, error) {
 			if appID == "" {
 				continue
 			}
+			locksExpired.Inc()
 
 			// Put the task that was being processed back into the app queue as the first task to be processed
 			taskId := rdb.Get(ctx, "processing:"+appID)
@@ -71,18 +98,56 @@ func NewRedis(address string) (*redisClient, error) {
 	}()
 
 	return &redisClient{
-		client: rdb,
+		client:  rdb,
+		lockTTL: lockTTL,
 	}, nil
 }
 
-func (r *redisClient) SendMessage(ctx context.Context, appID string, taskID string) error {
+func (r *redisClient) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx).Err()
+}
+
+// encodeMessage is the payload queued for a task, carrying the trace context of ctx
+func encodeMessage(ctx context.Context, taskID string) (string, error) {
+	m := Message{TaskID: taskID, Trace: map[string]string{}}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(m.Trace))
+	payload, err := json.Marshal(m)
+	return string(payload), err
+}
+
+// decodeMessage reads a queued payload. Tasks queued before payloads carried trace context
+// are bare task IDs.
+func decodeMessage(payload string) (*Message, error) {
+	if !strings.HasPrefix(payload, "{") {
+		return &Message{TaskID: payload}, nil
+	}
+	m := &Message{}
+	err := json.Unmarshal([]byte(payload), m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (r *redisClient) SendMessage(ctx context.Context, appID string, taskID string) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "queue.send", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("app.id", appID),
+		attribute.String("task.id", taskID),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	appQueueName := fmt.Sprintf("q:%s", appID)
+	payload, err := encodeMessage(ctx, taskID)
+	if err != nil {
+		return err
+	}
 
 	log.Printf("SEND MESSAGE: Task Id being inserted is %s", taskID)
-	res := r.client.LPush(ctx, appQueueName, taskID)
+	res := r.client.LPush(ctx, appQueueName, payload)
 	if res.Err() != nil {
 		return res.Err()
 	}
+	messagesSent.Inc()
 
 	// Check lock for app
 	if r.client.Get(ctx, "lock:"+appID).Err() != nil {
@@ -98,14 +163,25 @@ func (r *redisClient) SendMessage(ctx context.Context, appID string, taskID stri
 	return nil
 }
 
-// Called by workers when they need to BRPOP an appID and hence a task to process
-func (r *redisClient) PullMessage(ctx context.Context) (string, error) {
+// Called by workers when they need to BRPOP an appID and hence a task to process. It
+// returns the context's error once it is done.
+func (r *redisClient) PullMessage(ctx context.Context) (*Message, error) {
 	for {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
 		// Pop message from ready queue
-		res := r.client.BZPopMin(ctx, 0, "ready")
+		res := r.client.BZPopMin(ctx, pullWait, "ready")
+		if errors.Is(res.Err(), redis.Nil) {
+			continue
+		}
 		if res.Err() != nil {
 			log.Printf("Redis.PullMessage Unable to pull message from redis %s", res.Err())
-			time.Sleep(time.Second * 10)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second * 10):
+			}
 			continue
 		}
 
@@ -114,7 +190,9 @@ func (r *redisClient) PullMessage(ctx context.Context) (string, error) {
 		// Check lock for app
 		log.Printf("Redis.PullMessage Worker trying to lock %s", appID)
 		log.Printf("LOCKING NOW: TASK ID IS %s", appID)
-		if r.client.SetNX(ctx, "lock:"+appID, "", 30*time.Second).Err() != nil {
+		// SetNX reports an existing lock as false rather than as an error
+		token := uuid.New().String()
+		if locked, err := r.client.SetNX(ctx, "lock:"+appID, token, r.lockTTL).Result(); err != nil || !locked {
 			log.Printf("Redis.PullMessage Worker unable to lock %s", appID)
 			// App is locked
 			continue
@@ -131,30 +209,93 @@ func (r *redisClient) PullMessage(ctx context.Context) (string, error) {
 			continue
 		}
 
-		taskId := task.Val()
+		payload := task.Val()
 
-		if taskId == "" {
-			log.Printf("Redis.PullMessage Worker got no message %s", taskId)
+		if payload == "" {
+			log.Printf("Redis.PullMessage Worker got no message %s", payload)
 			r.client.Del(ctx, "lock:"+appID)
 			continue
 		}
 
-		log.Printf("Redis.PullMessage Worker got message %s", taskId)
-		err := r.client.Set(ctx, "processing:"+appID, taskId, 0).Err()
+		message, err := decodeMessage(payload)
+		if err != nil {
+			log.Printf("Redis.PullMessage Dropping unreadable message %s for app %s: %s", payload, appID, err)
+			// Unlike an empty queue, there may be tasks behind it, so the app is made ready again
+			r.DeleteLock(ctx, appID)
+			continue
+		}
+
+		log.Printf("Redis.PullMessage Worker got message %s", message.TaskID)
+		// The payload is kept whole, so a task restored after its lock expires keeps its trace
+		err = r.client.Set(ctx, "processing:"+appID, payload, 0).Err()
 		if err != nil {
 			// TODO: if unable to set then remove lock
 			r.client.Del(ctx, "lock:"+appID)
 			continue
 		}
+		messagesPulled.Inc()
 
-		return taskId, nil
+		message.LockToken = token
+		return message, nil
 	}
 
 }
 
-func (r *redisClient) RenewLock(ctx context.Context, appID string) error {
+// releaseLockScript deletes a lock only if it still holds the owner's token, as the lock
+// may have expired and been taken by a worker. Tasks queued while it was held did not make
+// the app ready, so it is made ready if its queue is not empty.
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+if redis.call("LLEN", KEYS[2]) > 0 then
+	redis.call("ZADD", KEYS[3], 1, ARGV[2])
+end
+return 1
+`)
+
+// renewLockScript extends a lock only if it still holds the owner's token. Once it expired
+// the task was put back in the queue, and another worker may hold the lock.
+var renewLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`)
+
+func (r *redisClient) TryLock(ctx context.Context, appID string) (string, bool, error) {
+	token := uuid.New().String()
+	locked, err := r.client.SetNX(ctx, "lock:"+appID, token, r.lockTTL).Result()
+	if err != nil || !locked {
+		return "", false, err
+	}
+	return token, true, nil
+}
+
+func (r *redisClient) ReleaseLock(ctx context.Context, appID string, token string) error {
+	released, err := releaseLockScript.Run(ctx, r.client, []string{"lock:" + appID, "q:" + appID, "ready"}, token, appID).Int()
+	if err != nil {
+		return err
+	}
+	if released == 0 {
+		log.Printf("Lock %s was no longer held when releasing it", appID)
+	}
+	return nil
+}
+
+func (r *redisClient) RenewLock(ctx context.Context, appID string, token string) error {
 	log.Printf("Trying to renew lock %s", appID)
-	return r.client.Set(ctx, "lock:"+appID, "", 30*time.Second).Err()
+	renewed, err := renewLockScript.Run(ctx, r.client, []string{"lock:" + appID}, token, r.lockTTL.Milliseconds()).Int()
+	if err != nil {
+		lockRenewFailed.Inc()
+		return err
+	}
+	if renewed == 0 {
+		lockRenewFailed.Inc()
+		return ErrLockLost
+	}
+	return nil
 }
 
 func (r *redisClient) DeleteLock(ctx context.Context, appID string) error {
@@ -194,6 +335,62 @@ func (r *redisClient) DeleteLock(ctx context.Context, appID string) error {
 	return nil
 }
 
+// ExposeQueueDepth adds the number of apps ready to be worked on and the tasks queued
+// per app to the metrics. Apps only have a series while they have queued tasks.
+func (r *redisClient) ExposeQueueDepth() {
+	metrics.NewGaugeFunc("umami_queue_ready_apps", "Apps with queued tasks and no worker.", nil, func(emit func(float64, ...string)) {
+		ctx, cancel := context.WithTimeout(context.Background(), queueDepthTimeout)
+		defer cancel()
+		ready, err := r.client.ZCard(ctx, "ready").Result()
+		if err != nil {
+			log.Printf("Unable to read the ready apps for metrics %s", err)
+			return
+		}
+		emit(float64(ready))
+	})
+
+	metrics.NewGaugeFunc("umami_queue_tasks", "Tasks waiting in the queue of an app.", []string{"app"}, func(emit func(float64, ...string)) {
+		ctx, cancel := context.WithTimeout(context.Background(), queueDepthTimeout)
+		defer cancel()
+		iter := r.client.Scan(ctx, 0, "q:*", 100).Iterator()
+		for iter.Next(ctx) {
+			depth, err := r.client.LLen(ctx, iter.Val()).Result()
+			if err == nil && depth > 0 {
+				emit(float64(depth), strings.TrimPrefix(iter.Val(), "q:"))
+			}
+		}
+		if err := iter.Err(); err != nil {
+			log.Printf("Unable to read the app queues for metrics %s", err)
+		}
+	})
+}
+
+func (r *redisClient) SendAppStart(ctx context.Context, appID string, port int) error {
+	payload, err := json.Marshal(AppStart{AppID: appID, Port: port})
+	if err != nil {
+		return err
+	}
+	return r.client.LPush(ctx, "starts", payload).Err()
+}
+
+func (r *redisClient) PullAppStart(ctx context.Context) (*AppStart, error) {
+	res, err := r.client.BRPop(ctx, pullWait, "starts").Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// BRPOP replies with the name of the list and the payload
+	start := &AppStart{}
+	err = json.Unmarshal([]byte(res[1]), start)
+	if err != nil {
+		return nil, fmt.Errorf("unreadable app start %s: %w", res[1], err)
+	}
+	return start, nil
+}
+
 func (r *redisClient) GetAppPid(ctx context.Context, appID string) (int, error) {
 	return r.client.Get(ctx, "pid:"+appID).Int()
 }
@@ -201,3 +398,11 @@ func (r *redisClient) GetAppPid(ctx context.Context, appID string) (int, error)
 func (r *redisClient) SetAppPid(ctx context.Context, appID string, pid int) error {
 	return r.client.Set(ctx, "pid:"+appID, pid, 0).Err()
 }
+
+func (r *redisClient) GetAppPort(ctx context.Context, appID string) (int, error) {
+	return r.client.Get(ctx, "port:"+appID).Int()
+}
+
+func (r *redisClient) SetAppPort(ctx context.Context, appID string, port int) error {
+	return r.client.Set(ctx, "port:"+appID, port, 0).Err()
+}
@@ -0,0 +1,259 @@
+package quota
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+	"umami/pkg/db"
+)
+
+// Enforcer checks actions against the quotas and counts what they use
+type Enforcer struct {
+	config *Config
+	db     db.DB
+}
+
+func NewEnforcer(config *Config, dbConn db.DB) *Enforcer {
+	return &Enforcer{config: config, db: dbConn}
+}
+
+// The queue of an app is locked while a task is checked against its queued tasks and moved
+// into it, so that two requests cannot both take its last slot. The lease frees the lock of
+// a process that died holding it.
+const (
+	queueLockLease = 30 * time.Second
+	queueLockWait  = 5 * time.Second
+	queueLockRetry = 100 * time.Millisecond
+)
+
+// Reservation is a task that a user may queue for an app. Until it is released, the app's
+// queue stays locked. Unless it was committed, releasing it gives back the task it counted
+// against the user's day.
+type Reservation struct {
+	e         *Enforcer
+	lockKey   string // Empty when the app's queued tasks are not limited
+	dayKey    string // Empty when the user's tasks per day are not limited
+	committed bool
+}
+
+// ReserveQueue checks that user may queue another task of the app and counts it against the
+// user's tasks of the day. It returns an *Exceeded when a quota does not allow it. Once the
+// task is queued, call Commit; release the reservation in either case.
+func (e *Enforcer) ReserveQueue(ctx context.Context, user, appId string) (*Reservation, error) {
+	r := &Reservation{e: e}
+
+	limits := e.config.ForApp(appId)
+	if limits.QueuedTasks > 0 {
+		lockKey := fmt.Sprintf("queue:%s", appId)
+		err := e.lockQueue(ctx, lockKey)
+		if err != nil {
+			return nil, err
+		}
+		r.lockKey = lockKey
+
+		queued, err := e.db.CountTasks(ctx, appId, db.TaskStatusInProgress)
+		if err != nil {
+			r.Release()
+			return nil, err
+		}
+		if queued >= limits.QueuedTasks {
+			r.Release()
+			return nil, &Exceeded{Quota: QuotaQueuedTasks, Limit: float64(limits.QueuedTasks), Used: float64(queued)}
+		}
+	}
+
+	err := e.CheckBudget(ctx, appId)
+	if err != nil {
+		r.Release()
+		return nil, err
+	}
+
+	// Counted last, so that a task another quota refuses does not use up the day
+	tasksPerDay := e.config.ForUser(user).TasksPerDay
+	if tasksPerDay > 0 {
+		now := time.Now()
+		key, resets := dailyTasksKey(user, now)
+		ok, err := e.db.ConsumeQuota(ctx, key, tasksPerDay, resets)
+		if err != nil {
+			r.Release()
+			return nil, err
+		}
+		if !ok {
+			r.Release()
+			return nil, &Exceeded{Quota: QuotaTasksPerDay, Limit: float64(tasksPerDay), Used: float64(tasksPerDay), ResetsAt: resets}
+		}
+		r.dayKey = key
+	}
+
+	return r, nil
+}
+
+// Commit records that the task was queued, so that releasing the reservation keeps it
+// counted against the user's day
+func (r *Reservation) Commit() {
+	if r != nil {
+		r.committed = true
+	}
+}
+
+// Release unlocks the app's queue and, unless the reservation was committed, gives back
+// the task counted against the user's day. It may be called on a nil reservation.
+func (r *Reservation) Release() {
+	if r == nil {
+		return
+	}
+
+	// The request may be done by now, but the counters must still be put right
+	ctx := context.Background()
+	if r.dayKey != "" && !r.committed {
+		err := r.e.db.ReleaseQuota(ctx, r.dayKey)
+		if err != nil {
+			log.Printf("Unable to give back quota %s %s", r.dayKey, err)
+		}
+		r.dayKey = ""
+	}
+	if r.lockKey != "" {
+		err := r.e.db.ReleaseQuota(ctx, r.lockKey)
+		if err != nil {
+			log.Printf("Unable to unlock queue %s %s", r.lockKey, err)
+		}
+		r.lockKey = ""
+	}
+}
+
+// lockQueue takes the lock of an app's queue, waiting a while for another request to
+// release it
+func (e *Enforcer) lockQueue(ctx context.Context, key string) error {
+	deadline := time.Now().Add(queueLockWait)
+	for {
+		ok, err := e.db.ConsumeQuota(ctx, key, 1, time.Now().Add(queueLockLease))
+		if err != nil || ok {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for lock %s", key)
+		}
+
+		timer := time.NewTimer(queueLockRetry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// CheckCreateApp checks that user may own another app
+func (e *Enforcer) CheckCreateApp(ctx context.Context, user string) error {
+	limit := e.config.ForUser(user).Apps
+	if limit == 0 {
+		return nil
+	}
+
+	owned, err := e.ownedApps(ctx, user)
+	if err != nil {
+		return err
+	}
+	if owned >= limit {
+		return &Exceeded{Quota: QuotaApps, Limit: float64(limit), Used: float64(owned)}
+	}
+
+	return nil
+}
+
+// CheckBudget checks that the app has not used up the tokens or cost of its budget period
+func (e *Enforcer) CheckBudget(ctx context.Context, appId string) error {
+	budget := e.config.ForApp(appId).Budget
+	if budget.Tokens == 0 && budget.CostUSD == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	used, err := e.db.GetAppUsageSince(ctx, appId, budget.PeriodStart(now))
+	if err != nil {
+		return err
+	}
+
+	if budget.Tokens > 0 && int64(used.Tokens()) >= budget.Tokens {
+		return &Exceeded{Quota: QuotaBudgetTokens, Limit: float64(budget.Tokens), Used: float64(used.Tokens()), ResetsAt: budget.PeriodEnd(now)}
+	}
+	if budget.CostUSD > 0 && used.Cost() >= budget.CostUSD {
+		return &Exceeded{Quota: QuotaBudgetCost, Limit: budget.CostUSD, Used: used.Cost(), ResetsAt: budget.PeriodEnd(now)}
+	}
+
+	return nil
+}
+
+// UserUsage reports the user's quotas and how much of them is used
+func (e *Enforcer) UserUsage(ctx context.Context, user string) ([]Usage, error) {
+	limits := e.config.ForUser(user)
+	now := time.Now()
+
+	key, resets := dailyTasksKey(user, now)
+	tasks, err := e.db.GetQuotaCount(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	owned, err := e.ownedApps(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return []Usage{
+		{Quota: QuotaTasksPerDay, Limit: float64(limits.TasksPerDay), Used: float64(tasks), ResetsAt: resets},
+		{Quota: QuotaApps, Limit: float64(limits.Apps), Used: float64(owned)},
+	}, nil
+}
+
+// AppUsage reports the app's quotas and how much of them is used
+func (e *Enforcer) AppUsage(ctx context.Context, appId string) ([]Usage, error) {
+	limits := e.config.ForApp(appId)
+	now := time.Now()
+
+	queued, err := e.db.CountTasks(ctx, appId, db.TaskStatusInProgress)
+	if err != nil {
+		return nil, err
+	}
+
+	used, err := e.db.GetAppUsageSince(ctx, appId, limits.Budget.PeriodStart(now))
+	if err != nil {
+		return nil, err
+	}
+
+	resets := limits.Budget.PeriodEnd(now)
+	return []Usage{
+		{Quota: QuotaQueuedTasks, Limit: float64(limits.QueuedTasks), Used: float64(queued)},
+		{Quota: QuotaBudgetTokens, Limit: float64(limits.Budget.Tokens), Used: float64(used.Tokens()), ResetsAt: resets},
+		{Quota: QuotaBudgetCost, Limit: limits.Budget.CostUSD, Used: used.Cost(), ResetsAt: resets},
+	}, nil
+}
+
+// ownedApps counts the apps that grant the user the owner role directly
+func (e *Enforcer) ownedApps(ctx context.Context, user string) (int64, error) {
+	apps, err := e.db.GetAccessibleApps(ctx, user, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	owned := int64(0)
+	for _, app := range apps {
+		for _, grant := range app.Access {
+			if grant.Kind == db.GrantKindUser && grant.Subject == user && grant.Role == db.AppRoleOwner {
+				owned++
+				break
+			}
+		}
+	}
+
+	return owned, nil
+}
+
+// dailyTasksKey returns the counter of the tasks user queued on the UTC day of t, and when
+// the day ends
+func dailyTasksKey(user string, t time.Time) (string, time.Time) {
+	day := Budget{Period: PeriodDay}
+	return fmt.Sprintf("tasks:%s:%s", user, day.PeriodStart(t).Format(time.DateOnly)), day.PeriodEnd(t)
+}
@@ -0,0 +1,161 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+const PeriodDay = "day"
+const PeriodWeek = "week" // Weeks start on Sunday, as in usage reports
+const PeriodMonth = "month"
+
+// Names of the quotas, as reported in errors and usage
+const QuotaTasksPerDay = "tasksPerDay"
+const QuotaApps = "apps"
+const QuotaQueuedTasks = "queuedTasks"
+const QuotaBudgetTokens = "budgetTokens"
+const QuotaBudgetCost = "budgetCostUsd"
+
+// Config holds the limits of every user and app. Users and Apps override the defaults for a
+// user name or app ID; an override replaces the default limits as a whole. A limit of 0
+// means unlimited.
+type Config struct {
+	User  UserLimits            `json:"user"`
+	App   AppLimits             `json:"app"`
+	Users map[string]UserLimits `json:"users"`
+	Apps  map[string]AppLimits  `json:"apps"`
+}
+
+type UserLimits struct {
+	TasksPerDay int64 `json:"tasksPerDay"` // Tasks the user may queue per UTC day
+	Apps        int64 `json:"apps"`        // Apps the user may own
+}
+
+type AppLimits struct {
+	QueuedTasks int64  `json:"queuedTasks"` // Tasks of the app that may be in progress at once
+	Budget      Budget `json:"budget"`
+}
+
+// Budget caps the usage of an app's tasks over a calendar period in UTC
+type Budget struct {
+	Period  string  `json:"period"` // PeriodDay, PeriodWeek or PeriodMonth, default PeriodMonth
+	Tokens  int64   `json:"tokens"`
+	CostUSD float64 `json:"costUsd"`
+}
+
+// Load reads the quotas from a JSON file. Without a path nothing is limited.
+func Load(path string) (*Config, error) {
+	if path == "" {
+		return &Config{}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := Config{}
+	err = json.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func (c *Config) validate() error {
+	budgets := map[string]Budget{"app": c.App.Budget}
+	for appId, limits := range c.Apps {
+		budgets["apps."+appId] = limits.Budget
+	}
+	for name, budget := range budgets {
+		switch budget.Period {
+		case "", PeriodDay, PeriodWeek, PeriodMonth:
+		default:
+			return fmt.Errorf("%s.budget.period must be %s, %s or %s, not %q", name, PeriodDay, PeriodWeek, PeriodMonth, budget.Period)
+		}
+	}
+	return nil
+}
+
+// ForUser returns the limits of a user
+func (c *Config) ForUser(user string) UserLimits {
+	if limits, ok := c.Users[user]; ok {
+		return limits
+	}
+	return c.User
+}
+
+// ForApp returns the limits of an app
+func (c *Config) ForApp(appId string) AppLimits {
+	if limits, ok := c.Apps[appId]; ok {
+		return limits
+	}
+	return c.App
+}
+
+// PeriodStart returns the start of the budget period that contains t
+func (b Budget) PeriodStart(t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	switch b.Period {
+	case PeriodDay:
+		return day
+	case PeriodWeek:
+		return day.AddDate(0, 0, -int(day.Weekday()))
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// PeriodEnd returns the start of the budget period after the one that contains t
+func (b Budget) PeriodEnd(t time.Time) time.Time {
+	start := b.PeriodStart(t)
+	switch b.Period {
+	case PeriodDay:
+		return start.AddDate(0, 0, 1)
+	case PeriodWeek:
+		return start.AddDate(0, 0, 7)
+	default:
+		return start.AddDate(0, 1, 0)
+	}
+}
+
+// ErrExceeded matches every *Exceeded with errors.Is
+var ErrExceeded = errors.New("quota exceeded")
+
+// Exceeded is the error of an action that a quota does not allow
+type Exceeded struct {
+	Quota    string
+	Limit    float64
+	Used     float64
+	ResetsAt time.Time // Zero for quotas that free up as tasks finish or apps are deleted
+}
+
+func (e *Exceeded) Error() string {
+	message := fmt.Sprintf("quota %s exceeded, %v of %v used", e.Quota, e.Used, e.Limit)
+	if !e.ResetsAt.IsZero() {
+		message += fmt.Sprintf(", resets at %s", e.ResetsAt.Format(time.RFC3339))
+	}
+	return message
+}
+
+func (e *Exceeded) Is(target error) bool {
+	return target == ErrExceeded
+}
+
+// Usage is how much of a quota is used. A Limit of 0 means unlimited.
+type Usage struct {
+	Quota    string    `json:"quota"`
+	Limit    float64   `json:"limit"`
+	Used     float64   `json:"used"`
+	ResetsAt time.Time `json:"resetsAt,omitzero"`
+}
@@ -0,0 +1,221 @@
+package redact
+
+import (
+	"bufio"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const Replacement = "[REDACTED]"
+
+// Secrets shorter than this are not redacted as they would mask ordinary words
+const minSecretLength = 6
+
+// DefaultPatterns match common credential formats
+var DefaultPatterns = []string{
+	`sk-ant-[A-Za-z0-9_\-]{20,}`,      // Anthropic API keys
+	`AKIA[0-9A-Z]{16}`,                // AWS access key IDs
+	`gh[pousr]_[A-Za-z0-9]{36,}`,      // GitHub tokens
+	`github_pat_[A-Za-z0-9_]{22,}`,    // GitHub fine-grained tokens
+	`xox[abprs]-[A-Za-z0-9\-]{10,}`,   // Slack tokens
+	`AIza[0-9A-Za-z\-_]{35}`,          // Google API keys
+	`(?:sk|rk)_live_[0-9A-Za-z]{24,}`, // Stripe secret keys
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`, // PEM private keys
+	`(?:mongodb(?:\+srv)?|postgres(?:ql)?|mysql|redis)://[^:\s/@]+:[^@\s]+@`,     // Credentials in connection strings
+}
+
+// Env variables whose values are treated as secrets
+var secretEnvNames = []string{"KEY", "SECRET", "TOKEN", "PASSWORD", "CONNECTION_STRING"}
+
+type Redactor struct {
+	secrets  []string
+	patterns []*regexp.Regexp
+}
+
+// New returns a redactor for the given literal secrets and regular expressions.
+func New(secrets []string, patterns []string) (*Redactor, error) {
+	r := &Redactor{}
+
+	seen := map[string]struct{}{}
+	for _, s := range secrets {
+		if len(s) < minSecretLength {
+			continue
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		r.secrets = append(r.secrets, s)
+	}
+	// Longer secrets first so a secret containing another is masked whole
+	sort.Slice(r.secrets, func(i, j int) bool { return len(r.secrets[i]) > len(r.secrets[j]) })
+
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		r.patterns = append(r.patterns, re)
+	}
+
+	return r, nil
+}
+
+// EnvSecrets returns the values of secret-looking variables in env, given as KEY=value,
+// along with any password embedded in URL values.
+func EnvSecrets(env []string) []string {
+	secrets := []string{}
+	for _, kv := range env {
+		name, value, ok := strings.Cut(kv, "=")
+		if !ok || value == "" {
+			continue
+		}
+
+		upper := strings.ToUpper(name)
+		for _, marker := range secretEnvNames {
+			if strings.Contains(upper, marker) {
+				secrets = append(secrets, value)
+				break
+			}
+		}
+
+		if u, err := url.Parse(value); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				secrets = append(secrets, password)
+			}
+		}
+	}
+	return secrets
+}
+
+// LoadPatterns reads one regular expression per line from path, skipping blank lines and
+// lines starting with #. An empty path returns no patterns.
+func LoadPatterns(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	patterns := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	return patterns, scanner.Err()
+}
+
+// String masks every secret and pattern match in s and returns the number of masks applied.
+// Matches are found in s as given, and overlapping ones are masked together and counted
+// once, so a pattern matching around a secret counts a single mask. Matches that take in
+// text redacted before are masked without being counted again.
+func (r *Redactor) String(s string) (string, int) {
+	if r == nil || s == "" {
+		return s, 0
+	}
+
+	spans := []span{}
+	for _, secret := range r.secrets {
+		spans = appendLiteralSpans(spans, s, secret, false)
+	}
+	for _, re := range r.patterns {
+		for _, loc := range re.FindAllStringIndex(s, -1) {
+			if loc[0] < loc[1] {
+				spans = append(spans, span{start: loc[0], end: loc[1]})
+			}
+		}
+	}
+	if len(spans) == 0 {
+		return s, 0
+	}
+	spans = appendLiteralSpans(spans, s, Replacement, true)
+
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	merged := []span{spans[0]}
+	for _, next := range spans[1:] {
+		last := &merged[len(merged)-1]
+		if next.start < last.end {
+			last.end = max(last.end, next.end)
+			last.redacted = last.redacted || next.redacted
+			continue
+		}
+		merged = append(merged, next)
+	}
+
+	var b strings.Builder
+	count, pos := 0, 0
+	for _, m := range merged {
+		b.WriteString(s[pos:m.start])
+		b.WriteString(Replacement)
+		pos = m.end
+		if !m.redacted {
+			count++
+		}
+	}
+	b.WriteString(s[pos:])
+
+	return b.String(), count
+}
+
+// span is a part of a string to mask. Redacted spans were masked before.
+type span struct {
+	start, end int
+	redacted   bool
+}
+
+func appendLiteralSpans(spans []span, s, literal string, redacted bool) []span {
+	for i := 0; ; {
+		j := strings.Index(s[i:], literal)
+		if j < 0 {
+			return spans
+		}
+		spans = append(spans, span{start: i + j, end: i + j + len(literal), redacted: redacted})
+		i += j + len(literal)
+	}
+}
+
+// Value masks secrets in every string inside v, which is a decoded JSON value, in place
+// where possible, and returns the masked value and the number of masks applied.
+func (r *Redactor) Value(v any) (any, int) {
+	switch value := v.(type) {
+	case string:
+		return r.String(value)
+	case map[string]any:
+		count := 0
+		for k, item := range value {
+			masked, n := r.Value(item)
+			value[k] = masked
+			count += n
+		}
+		return value, count
+	case []any:
+		count := 0
+		for i, item := range value {
+			masked, n := r.Value(item)
+			value[i] = masked
+			count += n
+		}
+		return value, count
+	case []string:
+		count := 0
+		for i, item := range value {
+			masked, n := r.String(item)
+			value[i] = masked
+			count += n
+		}
+		return value, count
+	}
+	return v, 0
+}
@@ -0,0 +1,165 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"umami/pkg/apierror"
+	"umami/pkg/auth"
+	"umami/pkg/db"
+)
+
+// RequireAppAccess wraps a handler for an app's routes. Reading needs the viewer role on the
+// app and anything else the editor role.
+func RequireAppAccess(dbConn db.DB, next http.HandlerFunc) http.HandlerFunc {
+	viewer := RequireAppRole(dbConn, db.AppRoleViewer, next)
+	editor := RequireAppRole(dbConn, db.AppRoleEditor, next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			viewer(w, r)
+		default:
+			editor(w, r)
+		}
+	}
+}
+
+// RequireAppRole wraps a handler for an app's routes so it only runs when the caller has at
+// least role on the app named by {id}, and the task named by {taskId}, if any, belongs to it.
+// Apps the caller has no role on are reported as not found.
+func RequireAppRole(dbConn db.DB, role string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appId := r.PathValue("id")
+		app, err := dbConn.GetApp(r.Context(), appId)
+		if errors.Is(err, db.ErrInvalidID) {
+			apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid app %s", appId))
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			apierror.Write(w, http.StatusNotFound, fmt.Sprintf("App %s not found", appId))
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get app: %s", err))
+			return
+		}
+
+		callerRole, err := appRole(r.Context(), dbConn, app)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to resolve access: %s", err))
+			return
+		}
+		if callerRole == "" {
+			apierror.Write(w, http.StatusNotFound, fmt.Sprintf("App %s not found", appId))
+			return
+		}
+		if !db.AppRoleAtLeast(callerRole, role) {
+			apierror.Write(w, http.StatusForbidden, fmt.Sprintf("Forbidden: requires the %s role on the app", role))
+			return
+		}
+
+		if taskId := r.PathValue("taskId"); taskId != "" {
+			task, err := dbConn.GetTask(r.Context(), taskId)
+			if errors.Is(err, db.ErrInvalidID) {
+				apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid task %s", taskId))
+				return
+			}
+			if errors.Is(err, db.ErrNotFound) || (err == nil && task.AppId != app.Id) {
+				apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Task %s not found", taskId))
+				return
+			}
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get task: %s", err))
+				return
+			}
+		}
+
+		next(w, r)
+	}
+}
+
+// appRole returns the caller's role on app. Callers with the admin scope own every app.
+func appRole(ctx context.Context, dbConn db.DB, app *db.App) (string, error) {
+	identity, ok := auth.FromContext(ctx)
+	if !ok {
+		return "", nil
+	}
+	if identity.HasScope(auth.ScopeAdmin) {
+		return db.AppRoleOwner, nil
+	}
+
+	teamIds, err := callerTeamIds(ctx, dbConn, identity.Subject)
+	if err != nil {
+		return "", err
+	}
+
+	return app.RoleFor(identity.Subject, teamIds), nil
+}
+
+func callerTeamIds(ctx context.Context, dbConn db.DB, user string) ([]string, error) {
+	teams, err := dbConn.GetTeamsForUser(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	teamIds := []string{}
+	for _, team := range teams {
+		teamIds = append(teamIds, team.Id.Hex())
+	}
+	return teamIds, nil
+}
+
+// accessibleApps returns the apps the caller has any role on. all is set for admins, who
+// can see every app, in which case apps is nil.
+func accessibleApps(ctx context.Context, dbConn db.DB) (apps []*db.App, all bool, err error) {
+	identity, ok := auth.FromContext(ctx)
+	if !ok {
+		return []*db.App{}, false, nil
+	}
+	if identity.HasScope(auth.ScopeAdmin) {
+		return nil, true, nil
+	}
+
+	teamIds, err := callerTeamIds(ctx, dbConn, identity.Subject)
+	if err != nil {
+		return nil, false, err
+	}
+
+	apps, err = dbConn.GetAccessibleApps(ctx, identity.Subject, teamIds)
+	if err != nil {
+		return nil, false, err
+	}
+	return apps, false, nil
+}
+
+// scopeAppIds narrows the requested app IDs to those the caller can see. An empty request
+// means every app the caller can see. ok is false when nothing is left to query.
+func scopeAppIds(ctx context.Context, dbConn db.DB, requested []string) (appIds []string, ok bool, err error) {
+	apps, all, err := accessibleApps(ctx, dbConn)
+	if err != nil {
+		return nil, false, err
+	}
+	if all {
+		return requested, true, nil
+	}
+
+	visible := map[string]bool{}
+	for _, app := range apps {
+		visible[app.Id.Hex()] = true
+	}
+
+	appIds = []string{}
+	if len(requested) == 0 {
+		for appId := range visible {
+			appIds = append(appIds, appId)
+		}
+	}
+	for _, appId := range requested {
+		if visible[appId] {
+			appIds = append(appIds, appId)
+		}
+	}
+
+	return appIds, len(appIds) > 0, nil
+}
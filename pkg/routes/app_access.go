@@ -0,0 +1,141 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+)
+
+type grantRequest db.AppGrant
+
+func (req *grantRequest) validate(v *validation) {
+	validateGrantee(v, req.Kind, req.Subject)
+	if !db.ValidAppRole(req.Role) {
+		v.add("role", fmt.Sprintf("must be one of %s, %s or %s", db.AppRoleViewer, db.AppRoleEditor, db.AppRoleOwner))
+	}
+}
+
+func validateGrantee(v *validation, kind, subject string) {
+	if kind != db.GrantKindUser && kind != db.GrantKindTeam {
+		v.add("kind", fmt.Sprintf("must be %s or %s", db.GrantKindUser, db.GrantKindTeam))
+	}
+	v.required("subject", subject)
+	v.maxLength("subject", subject, maxNameLength)
+}
+
+// ManageAppAccess lists the grants on an app, and adds, changes or removes them. PUT takes
+// a grant and replaces any existing grant to the same user or team; DELETE takes ?kind= and
+// ?subject=. An app always keeps at least one owner.
+func ManageAppAccess(dbConn db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appId := r.PathValue("id")
+		app, err := dbConn.GetApp(r.Context(), appId)
+		if errors.Is(err, db.ErrInvalidID) {
+			apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid app %s", appId))
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			apierror.Write(w, http.StatusNotFound, fmt.Sprintf("App %s not found", appId))
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get app: %s", err))
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			grants := app.Access
+			if grants == nil {
+				grants = []db.AppGrant{}
+			}
+
+			err = json.NewEncoder(w).Encode(grants)
+			if err != nil {
+				log.Printf("Unable to marshal access response %s", err)
+			}
+		case http.MethodPut:
+			req := grantRequest{}
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+			grant := db.AppGrant(req)
+			if grant.Role != db.AppRoleOwner && removesLastOwner(app, grant.Kind, grant.Subject) {
+				apierror.Write(w, http.StatusConflict, "Unable to change the role of the last owner")
+				return
+			}
+
+			err = dbConn.SetAppGrant(r.Context(), appId, grant)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to grant access: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionAppGrantAccess, appId, "", map[string]db.AuditChange{
+				grant.Kind + ":" + grant.Subject: {Before: grantRole(app, grant.Kind, grant.Subject), After: grant.Role},
+			})
+
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodDelete:
+			kind, subject := r.URL.Query().Get("kind"), r.URL.Query().Get("subject")
+			v := validation{}
+			validateGrantee(&v, kind, subject)
+			if v.failed(w) {
+				return
+			}
+			if removesLastOwner(app, kind, subject) {
+				apierror.Write(w, http.StatusConflict, "Unable to remove the last owner")
+				return
+			}
+
+			err = dbConn.RemoveAppGrant(r.Context(), appId, kind, subject)
+			if errors.Is(err, db.ErrNotFound) {
+				apierror.Write(w, http.StatusNotFound, fmt.Sprintf("App %s not found", appId))
+				return
+			}
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to revoke access: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionAppRevokeAccess, appId, "", map[string]db.AuditChange{
+				kind + ":" + subject: {Before: grantRole(app, kind, subject)},
+			})
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// grantRole returns the role of the grant to kind and subject, ignoring any other grant that
+// also applies to them
+func grantRole(app *db.App, kind, subject string) string {
+	for _, grant := range app.Access {
+		if grant.Kind == kind && grant.Subject == subject {
+			return grant.Role
+		}
+	}
+	return ""
+}
+
+// removesLastOwner reports whether dropping the grant to kind and subject would leave the app without an owner
+func removesLastOwner(app *db.App, kind, subject string) bool {
+	owners := 0
+	target := false
+	for _, grant := range app.Access {
+		if grant.Role != db.AppRoleOwner {
+			continue
+		}
+		owners++
+		if grant.Kind == kind && grant.Subject == subject {
+			target = true
+		}
+	}
+	return target && owners == 1
+}
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/auth"
+	"umami/pkg/db"
+)
+
+// recordAudit writes an audit record for a mutating request. A failure to audit is
+// logged rather than failing a request that has already taken effect.
+func recordAudit(ctx context.Context, database db.DB, r *http.Request, action, appId, taskId string, changes map[string]db.AuditChange) {
+	err := database.InsertAuditRecord(ctx, &db.AuditRecord{
+		Time:     time.Now(),
+		Actor:    requestActor(r),
+		Action:   action,
+		AppId:    appId,
+		TaskId:   taskId,
+		ClientIP: clientIP(r),
+		Changes:  changes,
+	})
+	if err != nil {
+		log.Printf("Unable to record audit %s for app %s task %s: %s", action, appId, taskId, err)
+	}
+}
+
+// requestActor is the subject of the authenticated caller
+func requestActor(r *http.Request) string {
+	if identity, ok := auth.FromContext(r.Context()); ok {
+		return identity.Subject
+	}
+	return "anonymous"
+}
+
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		ip, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(ip)
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// diffTask returns the fields that differ between two versions of a task
+func diffTask(before, after *db.Task) map[string]db.AuditChange {
+	changes := map[string]db.AuditChange{}
+	if before.Title != after.Title {
+		changes["title"] = db.AuditChange{Before: before.Title, After: after.Title}
+	}
+	if before.Description != after.Description {
+		changes["description"] = db.AuditChange{Before: before.Description, After: after.Description}
+	}
+	if before.Status != after.Status {
+		changes["status"] = db.AuditChange{Before: before.Status, After: after.Status}
+	}
+	return changes
+}
+
+// AuditLog lists audit records, newest first, filtered by ?actor=, ?action=, ?appId=,
+// ?taskId=, ?from=, ?to= and ?limit=.
+func AuditLog(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		query := r.URL.Query()
+		filter := db.AuditFilter{
+			Actor:  query.Get("actor"),
+			Action: query.Get("action"),
+			AppId:  query.Get("appId"),
+			TaskId: query.Get("taskId"),
+			Limit:  100,
+		}
+
+		var err error
+		filter.From, err = parseTimeParam(query.Get("from"))
+		if err != nil {
+			invalidParam(w, "from", err.Error())
+			return
+		}
+		filter.To, err = parseTimeParam(query.Get("to"))
+		if err != nil {
+			invalidParam(w, "to", err.Error())
+			return
+		}
+
+		if limit := query.Get("limit"); limit != "" {
+			filter.Limit, err = strconv.ParseInt(limit, 10, 64)
+			if err != nil || filter.Limit <= 0 {
+				invalidParam(w, "limit", "must be a positive integer")
+				return
+			}
+		}
+
+		records, err := database.GetAuditRecords(r.Context(), filter)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get audit records: %s", err))
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(records)
+		if err != nil {
+			log.Printf("Unable to marshal audit response %s", err)
+		}
+	}
+}
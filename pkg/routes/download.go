@@ -7,20 +7,21 @@ import (
 	"log"
 	"net/http"
 	"os"
-	"path"
 	"path/filepath"
+	"umami/pkg/apierror"
+	"umami/pkg/apps"
 	"umami/pkg/db"
 )
 
-func Download(database db.DB) http.HandlerFunc {
+func Download(database db.DB, dirs apps.Dirs) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		appId := r.PathValue("id")
 		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 
-		rootPath := path.Join("./repository", appId)
+		rootPath := dirs.Repository(appId)
 		buf := new(bytes.Buffer)
 		archive := zip.NewWriter(buf)
 		directoriesToIgnore := map[string]struct{}{
@@ -72,17 +73,19 @@ func Download(database db.DB) http.HandlerFunc {
 
 		if err != nil {
 			log.Printf("Unable to generate archive %s", err)
-			http.Error(w, "Unable to generate archive", http.StatusInternalServerError)
+			apierror.Write(w, http.StatusInternalServerError, "Unable to generate archive")
 			return
 		}
 
 		err = archive.Close()
 		if err != nil {
 			log.Printf("Unable to generate archive %s", err)
-			http.Error(w, "Unable to generate archive", http.StatusInternalServerError)
+			apierror.Write(w, http.StatusInternalServerError, "Unable to generate archive")
 			return
 		}
 
+		recordAudit(r.Context(), database, r, db.AuditActionAppDownload, appId, "", nil)
+
 		w.Write(buf.Bytes())
 	}
 }
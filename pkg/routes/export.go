@@ -0,0 +1,100 @@
+package routes
+
+import (
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+	"umami/pkg/transcript"
+)
+
+// ExportTranscript renders the transcript of a task, or of every task of an app in creation
+// order when mounted without {taskId}. The format is picked with ?format=jsonl|markdown|html
+// or else negotiated from the Accept header, defaulting to Markdown.
+func ExportTranscript(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = negotiateTranscriptFormat(r.Header.Get("Accept"))
+		}
+		if _, ok := transcript.ContentTypes[format]; !ok {
+			apierror.Write(w, http.StatusNotAcceptable, fmt.Sprintf("Unsupported format %s", format))
+			return
+		}
+
+		appId := r.PathValue("id")
+		app, err := database.GetApp(r.Context(), appId)
+		if err != nil {
+			apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Unable to get app: %s", err))
+			return
+		}
+
+		var tasks []*db.Task
+		title := app.Name
+		name := app.Name
+		if taskId := r.PathValue("taskId"); taskId != "" {
+			task, err := database.GetTask(r.Context(), taskId)
+			if err != nil || task.AppId != app.Id {
+				apierror.Write(w, http.StatusNotFound, "Task not found")
+				return
+			}
+			tasks = []*db.Task{task}
+			title = fmt.Sprintf("%s: %s", app.Name, task.Title)
+			name = fmt.Sprintf("%s-%s", app.Name, taskId)
+		} else {
+			tasks, err = database.GetTasks(r.Context(), appId)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get tasks: %s", err))
+				return
+			}
+			sort.SliceStable(tasks, func(i, j int) bool { return tasks[i].Created.Before(tasks[j].Created) })
+		}
+
+		transcripts := []transcript.Task{}
+		for _, t := range tasks {
+			events, err := database.FetchEvents(r.Context(), t.Id.Hex(), 0)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get events for task %s: %s", t.Id.Hex(), err))
+				return
+			}
+			transcripts = append(transcripts, transcript.Task{Task: t, Events: events})
+		}
+
+		w.Header().Set("Content-Type", transcript.ContentTypes[format])
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+			"filename": fmt.Sprintf("%s.%s", strings.ReplaceAll(name, " ", "_"), transcript.Extensions[format]),
+		}))
+
+		err = transcript.Write(w, format, title, transcripts)
+		if err != nil {
+			log.Printf("Unable to write transcript for app %s: %s", appId, err)
+		}
+	}
+}
+
+func negotiateTranscriptFormat(accept string) string {
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/x-ndjson", "application/jsonl", "application/json":
+			return transcript.FormatJSONL
+		case "text/markdown":
+			return transcript.FormatMarkdown
+		case "text/html":
+			return transcript.FormatHTML
+		}
+	}
+	return transcript.FormatMarkdown
+}
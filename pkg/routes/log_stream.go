@@ -0,0 +1,212 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+	"umami/pkg/metrics"
+
+	"github.com/gorilla/websocket"
+)
+
+// Idle streams send a heartbeat this often so proxies do not drop them
+const logStreamHeartbeat = 15 * time.Second
+
+const logStreamWriteTimeout = 10 * time.Second
+
+var upgrader = websocket.Upgrader{}
+
+var logSubscribers = metrics.NewGauge("umami_log_subscribers", "Clients following the log of a task, by transport.", "transport")
+
+// logStreamMessage is one event of a log stream. Id is the event's sequence number, which a
+// client resumes after.
+type logStreamMessage struct {
+	Id      int64             `json:"id"`
+	Event   *db.Event         `json:"event"`
+	Message map[string]string `json:"message,omitempty"` // Legacy log message for the event, for kinds the UI shows
+}
+
+type logStreamItem struct {
+	message *logStreamMessage
+	err     error
+}
+
+// streamLogMessages runs the task's event stream in the background so that the caller can
+// send heartbeats while it waits for events. The channel closes when the stream ends.
+func streamLogMessages(ctx context.Context, database db.DB, taskId string, afterSeq int64) <-chan logStreamItem {
+	items := make(chan logStreamItem)
+	go func() {
+		defer close(items)
+		for e, err := range database.StreamEvents(ctx, taskId, afterSeq) {
+			item := logStreamItem{err: err}
+			if e != nil {
+				item.message = &logStreamMessage{Id: e.Seq, Event: e, Message: e.CompatMessage()}
+			}
+			select {
+			case items <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return items
+}
+
+// resumeSeq returns the sequence number to resume after, from the Last-Event-ID header that
+// reconnecting EventSource clients send, or else from ?after=
+func resumeSeq(r *http.Request) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("after")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// StreamLogEvents streams a task's log as Server-Sent Events: first the events so far, then
+// each new event. Every SSE event carries the event's sequence number as its ID, so a
+// reconnecting client resumes where it left off.
+func StreamLogEvents(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		afterSeq, err := resumeSeq(r)
+		if err != nil {
+			invalidParam(w, "after", "Last-Event-ID and after must be an event sequence number")
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			apierror.Write(w, http.StatusInternalServerError, "Streaming is not supported")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		// Tell nginx not to buffer the stream
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "retry: %d\n\n", (3 * time.Second).Milliseconds())
+		flusher.Flush()
+
+		logSubscribers.Inc("sse")
+		defer logSubscribers.Dec("sse")
+
+		heartbeat := time.NewTicker(logStreamHeartbeat)
+		defer heartbeat.Stop()
+
+		items := streamLogMessages(r.Context(), database, r.PathValue("taskId"), afterSeq)
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			case item, ok := <-items:
+				if !ok {
+					return
+				}
+				if item.err != nil {
+					log.Printf("Unable to stream log of task %s %s", r.PathValue("taskId"), item.err)
+					fmt.Fprintf(w, "event: error\ndata: %q\n\n", item.err.Error())
+					flusher.Flush()
+					return
+				}
+
+				data, err := json.Marshal(item.message)
+				if err != nil {
+					log.Printf("Unable to marshal log event %s", err)
+					continue
+				}
+				if _, err := fmt.Fprintf(w, "id: %d\ndata: %s\n\n", item.message.Id, data); err != nil {
+					return
+				}
+				heartbeat.Reset(logStreamHeartbeat)
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// StreamLogWebsocket streams a task's log over a websocket: first the events after ?after=,
+// then each new event, one logStreamMessage per text message. Pings keep the connection alive.
+func StreamLogWebsocket(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		afterSeq, err := resumeSeq(r)
+		if err != nil {
+			invalidParam(w, "after", "must be an event sequence number")
+			return
+		}
+
+		c, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Print("upgrade:", err)
+			return
+		}
+		defer c.Close()
+
+		logSubscribers.Inc("websocket")
+		defer logSubscribers.Dec("websocket")
+
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		// Reading is needed to process pongs and notice the client closing
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := c.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+
+		heartbeat := time.NewTicker(logStreamHeartbeat)
+		defer heartbeat.Stop()
+
+		items := streamLogMessages(ctx, database, r.PathValue("taskId"), afterSeq)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.C:
+				err := c.WriteControl(websocket.PingMessage, nil, time.Now().Add(logStreamWriteTimeout))
+				if err != nil {
+					log.Println("ping:", err)
+					return
+				}
+			case item, ok := <-items:
+				if !ok {
+					return
+				}
+				if item.err != nil {
+					log.Printf("Unable to stream log of task %s %s", r.PathValue("taskId"), item.err)
+					c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInternalServerErr, "log stream failed"), time.Now().Add(logStreamWriteTimeout))
+					return
+				}
+
+				c.SetWriteDeadline(time.Now().Add(logStreamWriteTimeout))
+				err := c.WriteJSON(item.message)
+				if err != nil {
+					log.Println("write:", err)
+					return
+				}
+			}
+		}
+	}
+}
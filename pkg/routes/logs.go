@@ -2,7 +2,11 @@ package routes
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
+	"umami/pkg/apierror"
 	"umami/pkg/db"
 )
 
@@ -10,20 +14,51 @@ func FetchLogs(database db.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		taskId := r.PathValue("taskId")
 		if r.Method != http.MethodGet {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 
 		logEntries, err := database.FetchLog(r.Context(), taskId)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get logs: %s", err))
 			return
 		}
 
 		err = json.NewEncoder(w).Encode(logEntries)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			log.Printf("Unable to marshal logs response %s", err)
+		}
+	}
+}
+
+// FetchEvents returns the typed events of a task, optionally only those after ?after=<seq>
+func FetchEvents(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		taskId := r.PathValue("taskId")
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var afterSeq int64
+		if after := r.URL.Query().Get("after"); after != "" {
+			var err error
+			afterSeq, err = strconv.ParseInt(after, 10, 64)
+			if err != nil {
+				invalidParam(w, "after", "must be an integer")
+				return
+			}
+		}
+
+		events, err := database.FetchEvents(r.Context(), taskId, afterSeq)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get events: %s", err))
 			return
 		}
+
+		err = json.NewEncoder(w).Encode(events)
+		if err != nil {
+			log.Printf("Unable to marshal events response %s", err)
+		}
 	}
 }
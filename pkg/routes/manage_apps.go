@@ -3,92 +3,137 @@ package routes
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"path"
+	"regexp"
 	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/apps"
 	"umami/pkg/db"
+	"umami/pkg/quota"
+	"umami/pkg/secrets"
 	"umami/pkg/storage"
+	"umami/pkg/webhooks"
 
 	"github.com/go-git/go-git/v6"
 )
 
-func ManageApps(dbConn db.DB, storageClient storage.Storage) http.HandlerFunc {
+// App names also name the app's bucket and database, so they are limited to characters
+// those names can be derived from
+var appNamePattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9 _.'()/&%-]*[A-Za-z0-9])?$`)
+
+const maxAppNameLength = 50
+
+type createAppRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func (req *createAppRequest) validate(v *validation) {
+	v.required("name", req.Name)
+	v.maxLength("name", req.Name, maxAppNameLength)
+	if req.Name != "" && !appNamePattern.MatchString(req.Name) {
+		v.add("name", "must start and end with a letter or digit and only contain letters, digits, spaces and _ . ' ( ) / & % -")
+	}
+	v.maxLength("description", req.Description, maxDescriptionLength)
+}
+
+func ManageApps(dbConn db.DB, dirs apps.Dirs, storageClient storage.Storage, keys secrets.KeyProvider, enforcer *quota.Enforcer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		if r.Method == http.MethodPost {
-			app := db.App{}
-			err := json.NewDecoder(r.Body).Decode(&app)
-			if err != nil {
-				http.Error(w, fmt.Sprintf("Bad Request %s", err), http.StatusBadRequest)
+			req := createAppRequest{}
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+			if !allowedByQuota(w, "create the app", enforcer.CheckCreateApp(r.Context(), requestActor(r))) {
 				return
 			}
+			app := db.App{Name: req.Name, Description: req.Description}
 
 			// 2. Create database in mongo
 			// 3. Create a user with access to that database only
 			databaseName, username, password, err := dbConn.CreateAppDatabase(r.Context(), app.Name)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to create a new database for the app: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create a new database for the app: %s", err))
+				return
+			}
+
+			encryptedPassword, err := secrets.Seal(r.Context(), keys, password)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to encrypt app credentials: %s", err))
 				return
 			}
 
 			app.Created = time.Now()
 			app.Status = db.AppStatusActive
 			app.User = username
-			app.Password = password
+			app.EncryptedPassword = encryptedPassword
 			app.Database = databaseName
+			// The creator owns the app
+			app.Access = []db.AppGrant{{Kind: db.GrantKindUser, Subject: requestActor(r), Role: db.AppRoleOwner}}
 
 			// 1. Creates app in mongo
 			appId, err := dbConn.CreateApp(r.Context(), &app)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to create app: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create app: %s", err))
 				return
 			}
 
 			// 4. Creates git repository
-			repoDir := path.Join(".", "repository", appId)
+			repoDir := dirs.Repository(appId)
 			err = os.MkdirAll(repoDir, os.ModePerm)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to create repository: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create repository: %s", err))
 				return
 			}
 
 			_, err = git.PlainInit(repoDir, false)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to initialise repository: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to initialise repository: %s", err))
 				return
 			}
 
 			// 5. Creates bucket in GCS
 			err = storageClient.CreateBucket(r.Context(), app.Name)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to create bucket: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create bucket: %s", err))
 				return
 			}
 
+			recordAudit(r.Context(), dbConn, r, db.AuditActionAppCreate, appId, "", nil)
+			emitWebhookEvent(r.Context(), dbConn, db.WebhookEventAppCreated, appId, webhooks.AppData{App: &app})
+
 			err = json.NewEncoder(w).Encode(map[string]string{
 				"id": appId,
 			})
 			if err != nil {
-				http.Error(w, "Unable to respond", http.StatusInternalServerError)
-				return
+				log.Printf("Unable to marshal app response %s", err)
 			}
 
 		} else if r.Method == http.MethodGet {
-			apps, err := dbConn.GetApps(r.Context())
+			// Callers only see the apps they have a role on
+			apps, all, err := accessibleApps(r.Context(), dbConn)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to resolve access: %s", err))
 				return
 			}
+			if all {
+				apps, err = dbConn.GetApps(r.Context())
+				if err != nil {
+					apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get apps: %s", err))
+					return
+				}
+			}
 
 			err = json.NewEncoder(w).Encode(&apps)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				return
+				log.Printf("Unable to marshal apps response %s", err)
 			}
 
 		} else {
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 	}
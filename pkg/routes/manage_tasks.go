@@ -1,32 +1,75 @@
 package routes
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"umami/pkg/apierror"
 	"umami/pkg/db"
 	"umami/pkg/pubsub"
+	"umami/pkg/quota"
+	"umami/pkg/webhooks"
 )
 
-func ManageTasks(dbConn db.DB, pubsubClient pubsub.PubSub) http.HandlerFunc {
+type createTaskRequest struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+}
+
+func (req *createTaskRequest) validate(v *validation) {
+	v.required("title", req.Title)
+	v.maxLength("title", req.Title, maxTitleLength)
+	v.maxLength("description", req.Description, maxDescriptionLength)
+}
+
+// updateTaskRequest changes the fields that are set and leaves the others as they are
+type updateTaskRequest struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Status      *string `json:"status"`
+}
+
+func (req *updateTaskRequest) validate(v *validation) {
+	if req.Title != nil {
+		v.required("title", *req.Title)
+		v.maxLength("title", *req.Title, maxTitleLength)
+	}
+	if req.Description != nil {
+		v.maxLength("description", *req.Description, maxDescriptionLength)
+	}
+	if req.Status != nil && !db.ValidTaskStatus(*req.Status) {
+		v.add("status", fmt.Sprintf("must be one of %s, %s, %s, %s or %s", db.TaskStatusAuthoring, db.TaskStatusInProgress, db.TaskStatusCompleted, db.TaskStatusCancelled, db.TaskStatusFailed))
+	}
+}
+
+// ManageTasks lists, creates and updates the tasks of an app. PATCH only changes the fields
+// it is sent, and moving a task to in-progress queues it once the quotas allow it.
+func ManageTasks(dbConn db.DB, pubsubClient pubsub.PubSub, enforcer *quota.Enforcer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		appId := r.PathValue("id")
 		switch r.Method {
 		case http.MethodPost:
-			t := db.Task{}
-			err := json.NewDecoder(r.Body).Decode(&t)
-			if err != nil {
-				log.Printf("Unable to unmarshal task request %s", err)
+			t := createTaskRequest{}
+			if !decodeRequest(w, r, &t) {
+				return
 			}
 
 			// Create task in database
 			id, err := dbConn.CreateTask(r.Context(), appId, t.Title, t.Description)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to create task: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create task: %s", err))
 				return
 			}
 
+			recordAudit(r.Context(), dbConn, r, db.AuditActionTaskCreate, appId, id, map[string]db.AuditChange{
+				"title":       {After: t.Title},
+				"description": {After: t.Description},
+			})
+			emitTaskEvent(r.Context(), dbConn, db.WebhookEventTaskCreated, appId, id)
+
 			// Add Task to queue
 			// err = pubsubClient.SendMessage(r.Context(), "tasks", id)
 			// if err != nil {
@@ -42,26 +85,76 @@ func ManageTasks(dbConn db.DB, pubsubClient pubsub.PubSub) http.HandlerFunc {
 				log.Printf("Unable to marshal task response %s", err)
 			}
 		case http.MethodPatch:
-			t := db.Task{}
+			req := updateTaskRequest{}
 			taskId := r.PathValue("taskId")
-			err := json.NewDecoder(r.Body).Decode(&t)
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+
+			before, err := dbConn.GetTask(r.Context(), taskId)
+			if errors.Is(err, db.ErrInvalidID) {
+				apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid task %s", taskId))
+				return
+			}
+			if errors.Is(err, db.ErrNotFound) {
+				apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Task %s not found", taskId))
+				return
+			}
 			if err != nil {
-				log.Printf("Unable to unmarshal task request %s", err)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get task: %s", err))
+				return
+			}
+
+			t := *before
+			if req.Title != nil {
+				t.Title = *req.Title
+			}
+			if req.Description != nil {
+				t.Description = *req.Description
+			}
+			if req.Status != nil {
+				t.Status = *req.Status
+			}
+			if !db.CanTransitionTask(before.Status, t.Status) {
+				apierror.WriteCode(w, http.StatusConflict, apierror.CodeInvalidTransition, fmt.Sprintf("Unable to move a task from %s to %s", before.Status, t.Status), apierror.FieldError{
+					Field:   "status",
+					Message: fmt.Sprintf("cannot change from %s to %s", before.Status, t.Status),
+				})
+				return
+			}
+
+			// Held until the task is queued, and given back if it is not
+			var reservation *quota.Reservation
+			if t.Status != before.Status && t.Status == db.TaskStatusInProgress {
+				reservation, err = enforcer.ReserveQueue(r.Context(), requestActor(r), appId)
+				if !allowedByQuota(w, "queue the task", err) {
+					return
+				}
+				defer reservation.Release()
 			}
 
 			// Create task in database
 			err = dbConn.UpdateTask(r.Context(), appId, taskId, t.Title, t.Description, t.Status)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to update task: %s", err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to update task: %s", err))
 				return
 			}
 
-			if t.Status == db.TaskStatusInProgress {
-				// Add Task to queue
-				err = pubsubClient.SendMessage(r.Context(), appId, taskId)
-				if err != nil {
-					http.Error(w, fmt.Sprintf("Unable to add task to queue: %s", err), http.StatusInternalServerError)
-					return
+			recordAudit(r.Context(), dbConn, r, db.AuditActionTaskUpdate, appId, taskId, diffTask(before, &t))
+
+			if t.Status != before.Status {
+				switch t.Status {
+				case db.TaskStatusInProgress:
+					// Add Task to queue
+					err = pubsubClient.SendMessage(r.Context(), appId, taskId)
+					if err != nil {
+						apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to add task to queue: %s", err))
+						return
+					}
+					reservation.Commit()
+					emitTaskEvent(r.Context(), dbConn, db.WebhookEventTaskQueued, appId, taskId)
+				case db.TaskStatusCancelled:
+					emitTaskEvent(r.Context(), dbConn, db.WebhookEventTaskCancelled, appId, taskId)
 				}
 			}
 
@@ -70,7 +163,7 @@ func ManageTasks(dbConn db.DB, pubsubClient pubsub.PubSub) http.HandlerFunc {
 		case http.MethodGet:
 			tasks, err := dbConn.GetTasks(r.Context(), appId)
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Unable to get tasks for the app %s to queue: %s", appId, err), http.StatusInternalServerError)
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get tasks for the app %s to queue: %s", appId, err))
 				return
 			}
 
@@ -85,8 +178,18 @@ func ManageTasks(dbConn db.DB, pubsubClient pubsub.PubSub) http.HandlerFunc {
 			}
 
 		default:
-			w.WriteHeader(http.StatusMethodNotAllowed)
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
 		}
 
 	}
 }
+
+// emitTaskEvent emits a task event carrying the task as it is stored now
+func emitTaskEvent(ctx context.Context, dbConn db.DB, event, appId, taskId string) {
+	task, err := dbConn.GetTask(ctx, taskId)
+	if err != nil {
+		log.Printf("Unable to get task %s for webhook event %s: %s", taskId, event, err)
+		return
+	}
+	emitWebhookEvent(ctx, dbConn, event, appId, webhooks.TaskData{Task: task})
+}
@@ -0,0 +1,14 @@
+package routes
+
+import (
+	"fmt"
+	"net/http"
+	"umami/pkg/apierror"
+)
+
+// NotFound answers requests that match no route with the same JSON error as the routes
+func NotFound() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apierror.Write(w, http.StatusNotFound, fmt.Sprintf("No route for %s", r.URL.Path))
+	}
+}
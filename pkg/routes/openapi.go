@@ -0,0 +1,25 @@
+package routes
+
+import (
+	_ "embed"
+	"net/http"
+	"umami/pkg/apierror"
+)
+
+// openAPI documents every route registered by the control plane. Update it with the handlers.
+//
+//go:embed openapi.yaml
+var openAPI []byte
+
+// OpenAPI serves the OpenAPI document of the API
+func OpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write(openAPI)
+	}
+}
@@ -0,0 +1,61 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/quota"
+)
+
+// Quotas reports the quotas of the caller, or of the app named by {id}, and how much of
+// each is used. A limit of 0 means unlimited.
+func Quotas(enforcer *quota.Enforcer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		var usage []quota.Usage
+		var err error
+		if appId := r.PathValue("id"); appId != "" {
+			usage, err = enforcer.AppUsage(r.Context(), appId)
+		} else {
+			usage, err = enforcer.UserUsage(r.Context(), requestActor(r))
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get quota usage: %s", err))
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(usage)
+		if err != nil {
+			log.Printf("Unable to marshal quotas response %s", err)
+		}
+	}
+}
+
+// allowedByQuota responds with the error of a quota check, if there is one, and reports
+// whether the action may go ahead. An exceeded quota is a 429 with a Retry-After when
+// the quota resets at a known time.
+func allowedByQuota(w http.ResponseWriter, action string, err error) bool {
+	var exceeded *quota.Exceeded
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &exceeded):
+		if !exceeded.ResetsAt.IsZero() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(exceeded.ResetsAt).Seconds()))))
+		}
+		apierror.Write(w, http.StatusTooManyRequests, fmt.Sprintf("Unable to %s, %s", action, exceeded))
+	default:
+		apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to check quotas: %s", err))
+	}
+	return false
+}
@@ -0,0 +1,109 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/apps"
+	"umami/pkg/claude"
+	"umami/pkg/db"
+	"umami/pkg/storage"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ReplayStream feeds an archived agent stream of a task back through a LogWriter into a
+// new task, so that parser changes and the UI can be exercised without running the agent.
+// ?object= picks the archive, defaulting to the task's latest one, and ?delayMs= paces the
+// lines. The replay runs in the background; follow it through the new task's logs.
+func ReplayStream(dbConn db.DB, storageClient storage.Storage, prices claude.PriceTable, dirs apps.Dirs, spoolDir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		appId := r.PathValue("id")
+		taskId := r.PathValue("taskId")
+
+		app, err := dbConn.GetApp(r.Context(), appId)
+		if err != nil {
+			apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Unable to get app: %s", err))
+			return
+		}
+
+		task, err := dbConn.GetTask(r.Context(), taskId)
+		if err != nil || task.AppId != app.Id {
+			apierror.Write(w, http.StatusNotFound, "Task not found")
+			return
+		}
+
+		object := r.URL.Query().Get("object")
+		if object == "" {
+			if len(task.Streams) == 0 {
+				apierror.Write(w, http.StatusNotFound, "Task has no archived stream")
+				return
+			}
+			object = task.Streams[len(task.Streams)-1].Object
+		}
+
+		var delay time.Duration
+		if delayMs := r.URL.Query().Get("delayMs"); delayMs != "" {
+			ms, err := strconv.Atoi(delayMs)
+			if err != nil || ms < 0 {
+				invalidParam(w, "delayMs", "must be a non-negative integer")
+				return
+			}
+			delay = time.Duration(ms) * time.Millisecond
+		}
+
+		archive, err := storageClient.GetObject(r.Context(), app.Name, object)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to read archived stream: %s", err))
+			return
+		}
+
+		replayId, err := dbConn.CreateTask(r.Context(), appId, fmt.Sprintf("Replay: %s", task.Title), fmt.Sprintf("Replay of task %s from %s", taskId, object))
+		if err != nil {
+			archive.Close()
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create replay task: %s", err))
+			return
+		}
+
+		go func() {
+			defer archive.Close()
+			// The replay outlives the request, but stays in its trace
+			ctx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(r.Context()))
+
+			// The archive is already redacted
+			logWriter := claude.NewLogWriter(ctx, dbConn, replayId, dirs.Repository(appId), spoolDir, prices, nil)
+			err := claude.Replay(ctx, archive, logWriter, delay)
+			if err != nil {
+				log.Printf("Replay of %s into task %s stopped: %s", object, replayId, err)
+			}
+
+			err = logWriter.Flush()
+			if err != nil {
+				log.Printf("Unable to write all logs for replay task %s: %s", replayId, err)
+			}
+
+			err = dbConn.UpdateTask(ctx, appId, replayId, fmt.Sprintf("Replay: %s", task.Title), fmt.Sprintf("Replay of task %s from %s", taskId, object), db.TaskStatusCompleted)
+			if err != nil {
+				log.Printf("Unable to complete replay task %s: %s", replayId, err)
+			}
+		}()
+
+		w.WriteHeader(http.StatusAccepted)
+		err = json.NewEncoder(w).Encode(map[string]string{
+			"id": replayId,
+		})
+		if err != nil {
+			log.Printf("Unable to marshal replay response %s", err)
+		}
+	}
+}
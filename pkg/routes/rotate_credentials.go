@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"umami/pkg/apierror"
+	"umami/pkg/apps"
+	"umami/pkg/db"
+	"umami/pkg/pubsub"
+	"umami/pkg/secrets"
+)
+
+// queueClient is satisfied by the redis client, which is both the task queue and the pid
+// cache. Starting and restarting apps needs both.
+type queueClient interface {
+	pubsub.PubSub
+	pubsub.Cache
+}
+
+func RotateCredentials(dbConn db.DB, pubsubClient queueClient, keys secrets.KeyProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		appId := r.PathValue("id")
+		app, err := dbConn.GetApp(r.Context(), appId)
+		if errors.Is(err, db.ErrInvalidID) {
+			apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid app %s", appId))
+			return
+		}
+		if errors.Is(err, db.ErrNotFound) {
+			apierror.Write(w, http.StatusNotFound, fmt.Sprintf("App %s not found", appId))
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get app: %s", err))
+			return
+		}
+
+		err = apps.RotateCredentials(r.Context(), app, dbConn, pubsubClient, pubsubClient, keys)
+		if errors.Is(err, apps.ErrAppBusy) {
+			apierror.Write(w, http.StatusConflict, "App has a task in progress, retry once it completes")
+			return
+		}
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to rotate credentials: %s", err))
+			return
+		}
+
+		recordAudit(r.Context(), dbConn, r, db.AuditActionAppRotateCredentials, appId, "", nil)
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+)
+
+const maxSearchLimit = 100
+
+// Search serves full-text search over tasks and their logs. The query is given with ?q=,
+// apps are picked with one or more ?appId= and the number of hits with ?limit=.
+func Search(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		query := r.URL.Query()
+		searchQuery := db.SearchQuery{
+			Text:   query.Get("q"),
+			AppIds: query["appId"],
+		}
+		if searchQuery.Text == "" {
+			invalidParam(w, "q", "is required")
+			return
+		}
+
+		if limit := query.Get("limit"); limit != "" {
+			n, err := strconv.Atoi(limit)
+			if err != nil || n <= 0 {
+				invalidParam(w, "limit", "must be a positive integer")
+				return
+			}
+			searchQuery.Limit = min(n, maxSearchLimit)
+		}
+
+		// Only apps the caller can see are searched
+		appIds, ok, err := scopeAppIds(r.Context(), database, searchQuery.AppIds)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to resolve access: %s", err))
+			return
+		}
+		if !ok {
+			json.NewEncoder(w).Encode([]*db.SearchHit{})
+			return
+		}
+		searchQuery.AppIds = appIds
+
+		hits, err := database.Search(r.Context(), searchQuery)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to search: %s", err))
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(hits)
+		if err != nil {
+			log.Printf("Unable to marshal search response %s", err)
+		}
+	}
+}
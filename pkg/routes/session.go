@@ -0,0 +1,62 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"umami/pkg/apierror"
+	"umami/pkg/auth"
+)
+
+// Session signs the UI in. POST exchanges the caller's API token, given as a bearer token,
+// for a session token that is returned and set as an HTTP-only cookie. DELETE clears the cookie.
+func Session(authenticator *auth.Authenticator) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			identity, ok := auth.FromContext(r.Context())
+			if !ok {
+				apierror.Write(w, http.StatusUnauthorized, "Unauthorized: a session needs a token")
+				return
+			}
+
+			token, expires, err := authenticator.IssueSession(identity)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to issue session: %s", err))
+				return
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Name:     auth.SessionCookie,
+				Value:    token,
+				Path:     "/",
+				Expires:  expires,
+				HttpOnly: true,
+				Secure:   r.TLS != nil,
+				SameSite: http.SameSiteStrictMode,
+			})
+
+			err = json.NewEncoder(w).Encode(map[string]any{
+				"token":   token,
+				"subject": identity.Subject,
+				"scopes":  identity.Scopes,
+				"expires": expires,
+			})
+			if err != nil {
+				log.Printf("Unable to marshal session response %s", err)
+			}
+		case http.MethodDelete:
+			http.SetCookie(w, &http.Cookie{
+				Name:     auth.SessionCookie,
+				Path:     "/",
+				MaxAge:   -1,
+				HttpOnly: true,
+				SameSite: http.SameSiteStrictMode,
+			})
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
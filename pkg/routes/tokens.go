@@ -0,0 +1,127 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/auth"
+	"umami/pkg/db"
+)
+
+type createTokenRequest struct {
+	Name      string   `json:"name"`
+	Subject   string   `json:"subject"` // Defaults to the caller
+	Scopes    []string `json:"scopes"`
+	ExpiresIn string   `json:"expiresIn"` // Go duration such as 720h, or empty for a token that never expires
+}
+
+func (req *createTokenRequest) validate(v *validation) {
+	v.required("name", req.Name)
+	v.maxLength("name", req.Name, maxNameLength)
+	v.maxLength("subject", req.Subject, maxNameLength)
+	if len(req.Scopes) == 0 {
+		v.add("scopes", "needs at least one scope")
+	}
+	for i, scope := range req.Scopes {
+		if !auth.ValidScope(scope) {
+			v.add(fmt.Sprintf("scopes[%d]", i), fmt.Sprintf("must be one of %s, %s or %s", auth.ScopeRead, auth.ScopeWrite, auth.ScopeAdmin))
+		}
+	}
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			v.add("expiresIn", "must be a positive Go duration such as 720h")
+		}
+	}
+}
+
+// ManageTokens lists, creates and deletes API tokens. The token is only returned by the
+// request that creates it.
+func ManageTokens(dbConn db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			tokens, err := dbConn.GetAPITokens(r.Context())
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get tokens: %s", err))
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(tokens)
+			if err != nil {
+				log.Printf("Unable to marshal tokens response %s", err)
+			}
+		case http.MethodPost:
+			req := createTokenRequest{}
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+			if req.Subject == "" {
+				req.Subject = requestActor(r)
+			}
+
+			token := db.APIToken{
+				Name:    req.Name,
+				Subject: req.Subject,
+				Scopes:  req.Scopes,
+				Created: time.Now(),
+			}
+			if req.ExpiresIn != "" {
+				expiresIn, _ := time.ParseDuration(req.ExpiresIn)
+				token.Expires = token.Created.Add(expiresIn)
+			}
+
+			secret, hash, err := auth.NewAPIToken()
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to generate token: %s", err))
+				return
+			}
+			token.Hash = hash
+
+			tokenId, err := dbConn.CreateAPIToken(r.Context(), &token)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create token: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionTokenCreate, "", "", map[string]db.AuditChange{
+				"id":      {After: tokenId},
+				"subject": {After: token.Subject},
+				"scopes":  {After: strings.Join(token.Scopes, ",")},
+			})
+
+			w.WriteHeader(http.StatusCreated)
+			err = json.NewEncoder(w).Encode(struct {
+				db.APIToken
+				Token string `json:"token"`
+			}{token, secret})
+			if err != nil {
+				log.Printf("Unable to marshal token response %s", err)
+			}
+		case http.MethodDelete:
+			tokenId := r.PathValue("tokenId")
+			err := dbConn.DeleteAPIToken(r.Context(), tokenId)
+			if errors.Is(err, db.ErrNotFound) {
+				apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Token %s not found", tokenId))
+				return
+			}
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to delete token: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionTokenDelete, "", "", map[string]db.AuditChange{
+				"id": {Before: tokenId},
+			})
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+)
+
+// FetchToolCalls returns the tool calls of a task paired with their results
+func FetchToolCalls(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		taskId := r.PathValue("taskId")
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		events, err := database.FetchEvents(r.Context(), taskId, 0)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get events: %s", err))
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(db.PairToolCalls(events))
+		if err != nil {
+			log.Printf("Unable to marshal tool calls response %s", err)
+		}
+	}
+}
+
+// FetchFilesTouched returns the files a task changed with the diff of every change.
+// ?path= limits the response to a single file.
+func FetchFilesTouched(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		taskId := r.PathValue("taskId")
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		events, err := database.FetchEvents(r.Context(), taskId, 0)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get events: %s", err))
+			return
+		}
+
+		files := db.FilesTouched(db.PairToolCalls(events))
+		if filePath := r.URL.Query().Get("path"); filePath != "" {
+			filtered := []*db.FileChanges{}
+			for _, f := range files {
+				if f.Path == filePath {
+					filtered = append(filtered, f)
+				}
+			}
+			files = filtered
+		}
+
+		err = json.NewEncoder(w).Encode(files)
+		if err != nil {
+			log.Printf("Unable to marshal files response %s", err)
+		}
+	}
+}
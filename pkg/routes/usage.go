@@ -0,0 +1,86 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+)
+
+// Usage serves token usage and cost aggregates. It is mounted both globally, where the
+// app can be picked with ?appId=, and under an app. Periods are set with ?period=day|week|month
+// and the range with ?from= and ?to= as RFC 3339 times or YYYY-MM-DD dates. Usage is
+// counted by the UTC day it happened on, whenever its task was created.
+func Usage(database db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		query := r.URL.Query()
+		filter := db.UsageFilter{
+			AppId:  r.PathValue("id"),
+			Period: query.Get("period"),
+		}
+		if filter.AppId == "" {
+			// Globally, usage is limited to the apps the caller can see
+			appIds, ok, err := scopeAppIds(r.Context(), database, query["appId"])
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to resolve access: %s", err))
+				return
+			}
+			if !ok {
+				json.NewEncoder(w).Encode([]*db.UsageSummary{})
+				return
+			}
+			filter.AppIds = appIds
+		}
+
+		switch filter.Period {
+		case "", db.UsagePeriodDay, db.UsagePeriodWeek, db.UsagePeriodMonth:
+		default:
+			invalidParam(w, "period", fmt.Sprintf("must be %s, %s or %s", db.UsagePeriodDay, db.UsagePeriodWeek, db.UsagePeriodMonth))
+			return
+		}
+
+		var err error
+		filter.From, err = parseTimeParam(query.Get("from"))
+		if err != nil {
+			invalidParam(w, "from", err.Error())
+			return
+		}
+		filter.To, err = parseTimeParam(query.Get("to"))
+		if err != nil {
+			invalidParam(w, "to", err.Error())
+			return
+		}
+
+		summaries, err := database.GetUsage(r.Context(), filter)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get usage: %s", err))
+			return
+		}
+
+		err = json.NewEncoder(w).Encode(summaries)
+		if err != nil {
+			log.Printf("Unable to marshal usage response %s", err)
+		}
+	}
+}
+
+func parseTimeParam(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.DateOnly, value)
+}
@@ -0,0 +1,175 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/db"
+)
+
+type createUserRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+func (req *createUserRequest) validate(v *validation) {
+	v.required("name", req.Name)
+	v.maxLength("name", req.Name, maxNameLength)
+	if strings.ContainsAny(req.Name, " \t\r\n") {
+		v.add("name", "must not contain whitespace")
+	}
+	v.maxLength("email", req.Email, 254)
+	if req.Email != "" && !strings.Contains(req.Email, "@") {
+		v.add("email", "must be an email address")
+	}
+}
+
+type createTeamRequest struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+func (req *createTeamRequest) validate(v *validation) {
+	v.required("name", req.Name)
+	v.maxLength("name", req.Name, maxNameLength)
+	validateMembers(v, req.Members)
+}
+
+type teamMembersRequest struct {
+	Members []string `json:"members"`
+}
+
+func (req *teamMembersRequest) validate(v *validation) {
+	validateMembers(v, req.Members)
+}
+
+func validateMembers(v *validation, members []string) {
+	for i, member := range members {
+		field := fmt.Sprintf("members[%d]", i)
+		v.required(field, member)
+		v.maxLength(field, member, maxNameLength)
+	}
+}
+
+// ManageUsers lists and creates users
+func ManageUsers(dbConn db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			users, err := dbConn.GetUsers(r.Context())
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get users: %s", err))
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(users)
+			if err != nil {
+				log.Printf("Unable to marshal users response %s", err)
+			}
+		case http.MethodPost:
+			req := createUserRequest{}
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+			user := db.User{Name: req.Name, Email: req.Email, Created: time.Now()}
+
+			userId, err := dbConn.CreateUser(r.Context(), &user)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create user: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionUserCreate, "", "", map[string]db.AuditChange{
+				"name": {After: user.Name},
+			})
+
+			w.WriteHeader(http.StatusCreated)
+			err = json.NewEncoder(w).Encode(map[string]string{
+				"id": userId,
+			})
+			if err != nil {
+				log.Printf("Unable to marshal user response %s", err)
+			}
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// ManageTeams lists and creates teams, and replaces the members of a team with PUT on
+// /api/v1/teams/{teamId}/members
+func ManageTeams(dbConn db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			teams, err := dbConn.GetTeams(r.Context())
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get teams: %s", err))
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(teams)
+			if err != nil {
+				log.Printf("Unable to marshal teams response %s", err)
+			}
+		case http.MethodPost:
+			req := createTeamRequest{}
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+			team := db.Team{Name: req.Name, Members: req.Members, Created: time.Now()}
+
+			teamId, err := dbConn.CreateTeam(r.Context(), &team)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create team: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionTeamCreate, "", "", map[string]db.AuditChange{
+				"name":    {After: team.Name},
+				"members": {After: strings.Join(team.Members, ",")},
+			})
+
+			w.WriteHeader(http.StatusCreated)
+			err = json.NewEncoder(w).Encode(map[string]string{
+				"id": teamId,
+			})
+			if err != nil {
+				log.Printf("Unable to marshal team response %s", err)
+			}
+		case http.MethodPut:
+			teamId := r.PathValue("teamId")
+			body := teamMembersRequest{}
+			if !decodeRequest(w, r, &body) {
+				return
+			}
+			if body.Members == nil {
+				body.Members = []string{}
+			}
+
+			err := dbConn.UpdateTeamMembers(r.Context(), teamId, body.Members)
+			if errors.Is(err, db.ErrNotFound) {
+				apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Team %s not found", teamId))
+				return
+			}
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to update team: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionTeamUpdate, "", "", map[string]db.AuditChange{
+				"team":    {After: teamId},
+				"members": {After: strings.Join(body.Members, ",")},
+			})
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
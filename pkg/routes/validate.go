@@ -0,0 +1,111 @@
+package routes
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"umami/pkg/apierror"
+	"unicode/utf8"
+)
+
+const maxRequestBytes = 1 << 20
+
+const maxNameLength = 100
+const maxTitleLength = 200
+const maxDescriptionLength = 20000
+
+// request is a request body that can check its own fields
+type request interface {
+	validate(v *validation)
+}
+
+// validation collects the problems with a request so they are reported together
+type validation struct {
+	fields []apierror.FieldError
+}
+
+func (v *validation) add(field, message string) {
+	v.fields = append(v.fields, apierror.FieldError{Field: field, Message: message})
+}
+
+func (v *validation) required(field, value string) {
+	if value == "" {
+		v.add(field, "is required")
+	}
+}
+
+func (v *validation) maxLength(field, value string, max int) {
+	if utf8.RuneCountInString(value) > max {
+		v.add(field, fmt.Sprintf("must be at most %d characters", max))
+	}
+}
+
+// failed responds with the problems found, if any, and reports whether there were some
+func (v *validation) failed(w http.ResponseWriter) bool {
+	if len(v.fields) == 0 {
+		return false
+	}
+	apierror.Write(w, http.StatusBadRequest, "The request is invalid", v.fields...)
+	return true
+}
+
+// invalidParam responds that a query parameter or header is invalid
+func invalidParam(w http.ResponseWriter, name, message string) {
+	apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid %s", name), apierror.FieldError{Field: name, Message: message})
+}
+
+// decodeRequest decodes a JSON body into req and validates it. It responds with an error
+// and returns false when the body is too large, malformed or invalid.
+func decodeRequest(w http.ResponseWriter, r *http.Request, req request) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(req)
+
+	var tooLarge *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+	case errors.As(err, &tooLarge):
+		apierror.Write(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("The request body is larger than %d bytes", tooLarge.Limit))
+		return false
+	case errors.Is(err, io.EOF):
+		apierror.Write(w, http.StatusBadRequest, "The request body is empty, expected a JSON object")
+		return false
+	case errors.As(err, &syntaxErr):
+		apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("The request body is not valid JSON at offset %d", syntaxErr.Offset))
+		return false
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		apierror.Write(w, http.StatusBadRequest, "The request is invalid", apierror.FieldError{
+			Field:   typeErr.Field,
+			Message: fmt.Sprintf("must be %s", jsonTypeName(typeErr.Type)),
+		})
+		return false
+	default:
+		apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Unable to decode the request body: %s", err))
+		return false
+	}
+
+	v := validation{}
+	req.validate(&v)
+	return !v.failed(w)
+}
+
+// jsonTypeName describes the JSON value that decodes into t
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	case reflect.Pointer:
+		return jsonTypeName(t.Elem())
+	default:
+		return "a number"
+	}
+}
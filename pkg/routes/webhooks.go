@@ -0,0 +1,345 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"umami/pkg/apierror"
+	"umami/pkg/auth"
+	"umami/pkg/db"
+	"umami/pkg/secrets"
+	"umami/pkg/webhooks"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+const defaultDeliveriesLimit = 50
+const maxWebhookURLLength = 2048
+
+type createWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"` // Defaults to every event
+}
+
+func (req *createWebhookRequest) validate(v *validation) {
+	v.required("url", req.URL)
+	v.maxLength("url", req.URL, maxWebhookURLLength)
+	endpoint, err := url.Parse(req.URL)
+	if req.URL != "" && (err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "") {
+		v.add("url", "must be an absolute http or https URL")
+	}
+	for i, event := range req.Events {
+		if !db.ValidWebhookEvent(event) {
+			v.add(fmt.Sprintf("events[%d]", i), fmt.Sprintf("must be %s or one of %s", db.WebhookEventAll, strings.Join(db.WebhookEvents, ", ")))
+		}
+	}
+}
+
+// ManageWebhooks lists and creates the webhooks of the app named by {id}, or the global
+// webhooks without it, and gets or deletes the webhook named by {webhookId}. The signing
+// secret is only returned by the request that creates the webhook, and its URL must be
+// allowed by policy.
+func ManageWebhooks(dbConn db.DB, keys secrets.KeyProvider, policy *webhooks.AddressPolicy) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		appId := r.PathValue("id")
+		if r.PathValue("webhookId") != "" {
+			manageWebhook(dbConn, w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			hooks, err := dbConn.GetWebhooks(r.Context(), appId)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get webhooks: %s", err))
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(hooks)
+			if err != nil {
+				log.Printf("Unable to marshal webhooks response %s", err)
+			}
+		case http.MethodPost:
+			req := createWebhookRequest{}
+			if !decodeRequest(w, r, &req) {
+				return
+			}
+			if len(req.Events) == 0 {
+				req.Events = []string{db.WebhookEventAll}
+			}
+
+			err := policy.CheckURL(r.Context(), req.URL)
+			if errors.Is(err, webhooks.ErrBlockedAddress) {
+				apierror.Write(w, http.StatusBadRequest, "The request is invalid", apierror.FieldError{Field: "url", Message: "must not resolve to a loopback, private or link-local address"})
+				return
+			}
+			if err != nil {
+				apierror.Write(w, http.StatusBadRequest, "The request is invalid", apierror.FieldError{Field: "url", Message: "must have a host that resolves"})
+				return
+			}
+
+			secret, err := webhooks.NewSecret()
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to generate webhook secret: %s", err))
+				return
+			}
+			encryptedSecret, err := secrets.Seal(r.Context(), keys, secret)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to encrypt webhook secret: %s", err))
+				return
+			}
+
+			hook := db.Webhook{
+				URL:       req.URL,
+				Events:    req.Events,
+				Secret:    encryptedSecret,
+				CreatedBy: requestActor(r),
+				Created:   time.Now(),
+			}
+			if appId != "" {
+				hook.AppId, err = bson.ObjectIDFromHex(appId)
+				if err != nil {
+					apierror.Write(w, http.StatusBadRequest, fmt.Sprintf("Invalid app %s", appId))
+					return
+				}
+			}
+
+			webhookId, err := dbConn.CreateWebhook(r.Context(), &hook)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to create webhook: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionWebhookCreate, appId, "", map[string]db.AuditChange{
+				"id":     {After: webhookId},
+				"url":    {After: hook.URL},
+				"events": {After: strings.Join(hook.Events, ",")},
+			})
+
+			w.WriteHeader(http.StatusCreated)
+			err = json.NewEncoder(w).Encode(struct {
+				db.Webhook
+				Secret string `json:"secret"`
+			}{hook, secret})
+			if err != nil {
+				log.Printf("Unable to marshal webhook response %s", err)
+			}
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+func manageWebhook(dbConn db.DB, w http.ResponseWriter, r *http.Request) {
+	hook, ok := webhookForCaller(dbConn, w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		err := json.NewEncoder(w).Encode(hook)
+		if err != nil {
+			log.Printf("Unable to marshal webhook response %s", err)
+		}
+	case http.MethodDelete:
+		err := dbConn.DeleteWebhook(r.Context(), hook.Id.Hex())
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to delete webhook: %s", err))
+			return
+		}
+
+		recordAudit(r.Context(), dbConn, r, db.AuditActionWebhookDelete, webhookAppId(hook), "", map[string]db.AuditChange{
+			"id":  {Before: hook.Id.Hex()},
+			"url": {Before: hook.URL},
+		})
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// WebhookDeliveries lists the deliveries of the webhook named by {webhookId}, newest first,
+// and with POST on .../deliveries/{deliveryId}/redeliver queues a new delivery of the same
+// payload. A ?limit= caps the list.
+func WebhookDeliveries(dbConn db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		deliveryId := r.PathValue("deliveryId")
+		if (deliveryId == "") != (r.Method == http.MethodGet) {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		hook, ok := webhookForCaller(dbConn, w, r)
+		if !ok {
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			limit := int64(defaultDeliveriesLimit)
+			if raw := r.URL.Query().Get("limit"); raw != "" {
+				parsed, err := strconv.ParseInt(raw, 10, 64)
+				if err != nil || parsed <= 0 {
+					invalidParam(w, "limit", "must be a positive integer")
+					return
+				}
+				limit = parsed
+			}
+
+			deliveries, err := dbConn.GetWebhookDeliveries(r.Context(), hook.Id.Hex(), limit)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get webhook deliveries: %s", err))
+				return
+			}
+
+			err = json.NewEncoder(w).Encode(deliveries)
+			if err != nil {
+				log.Printf("Unable to marshal webhook deliveries response %s", err)
+			}
+		case http.MethodPost:
+			delivery, err := dbConn.GetWebhookDelivery(r.Context(), deliveryId)
+			if errors.Is(err, db.ErrNotFound) || (err == nil && delivery.WebhookId != hook.Id) {
+				apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Delivery %s not found", deliveryId))
+				return
+			}
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get webhook delivery: %s", err))
+				return
+			}
+
+			now := time.Now()
+			redelivery := db.WebhookDelivery{
+				WebhookId:    hook.Id,
+				Event:        delivery.Event,
+				Payload:      delivery.Payload,
+				Status:       db.WebhookDeliveryPending,
+				NextAttempt:  now,
+				RedeliveryOf: delivery.Id,
+				Created:      now,
+			}
+			redeliveryId, err := dbConn.CreateWebhookDelivery(r.Context(), &redelivery)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to queue redelivery: %s", err))
+				return
+			}
+
+			recordAudit(r.Context(), dbConn, r, db.AuditActionWebhookRedeliver, webhookAppId(hook), "", map[string]db.AuditChange{
+				"delivery": {Before: deliveryId, After: redeliveryId},
+			})
+
+			w.WriteHeader(http.StatusAccepted)
+			err = json.NewEncoder(w).Encode(map[string]string{
+				"id": redeliveryId,
+			})
+			if err != nil {
+				log.Printf("Unable to marshal redelivery response %s", err)
+			}
+		default:
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+		}
+	}
+}
+
+// PingWebhook queues a ping event to the webhook named by {webhookId}, to test its endpoint
+func PingWebhook(dbConn db.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			apierror.Write(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		hook, ok := webhookForCaller(dbConn, w, r)
+		if !ok {
+			return
+		}
+
+		payload, err := webhooks.NewPayload(db.WebhookEventPing, webhookAppId(hook), map[string]string{
+			"webhookId": hook.Id.Hex(),
+		})
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to build ping: %s", err))
+			return
+		}
+
+		deliveryId, err := webhooks.Enqueue(r.Context(), dbConn, hook, db.WebhookEventPing, payload)
+		if err != nil {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to queue ping: %s", err))
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+		err = json.NewEncoder(w).Encode(map[string]string{
+			"id": deliveryId,
+		})
+		if err != nil {
+			log.Printf("Unable to marshal ping response %s", err)
+		}
+	}
+}
+
+// webhookForCaller looks up the webhook named by {webhookId}. Global webhooks need the
+// admin scope and app webhooks the owner role on their app; webhooks the caller cannot
+// manage are reported as not found.
+func webhookForCaller(dbConn db.DB, w http.ResponseWriter, r *http.Request) (*db.Webhook, bool) {
+	webhookId := r.PathValue("webhookId")
+	hook, err := dbConn.GetWebhook(r.Context(), webhookId)
+	if errors.Is(err, db.ErrNotFound) {
+		apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Webhook %s not found", webhookId))
+		return nil, false
+	}
+	if err != nil {
+		apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get webhook: %s", err))
+		return nil, false
+	}
+
+	role := ""
+	if hook.AppId.IsZero() {
+		if identity, ok := auth.FromContext(r.Context()); ok && identity.HasScope(auth.ScopeAdmin) {
+			role = db.AppRoleOwner
+		}
+	} else {
+		app, err := dbConn.GetApp(r.Context(), hook.AppId.Hex())
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to get app: %s", err))
+			return nil, false
+		}
+		if err == nil {
+			role, err = appRole(r.Context(), dbConn, app)
+			if err != nil {
+				apierror.Write(w, http.StatusInternalServerError, fmt.Sprintf("Unable to resolve access: %s", err))
+				return nil, false
+			}
+		}
+	}
+	if role != db.AppRoleOwner {
+		apierror.Write(w, http.StatusNotFound, fmt.Sprintf("Webhook %s not found", webhookId))
+		return nil, false
+	}
+
+	return hook, true
+}
+
+func webhookAppId(hook *db.Webhook) string {
+	if hook.AppId.IsZero() {
+		return ""
+	}
+	return hook.AppId.Hex()
+}
+
+// emitWebhookEvent queues deliveries of an event. Like auditing, a failure is logged rather
+// than failing a request that has already taken effect.
+func emitWebhookEvent(ctx context.Context, dbConn db.DB, event, appId string, data any) {
+	err := webhooks.Emit(ctx, dbConn, event, appId, data)
+	if err != nil {
+		log.Printf("Unable to emit webhook event %s for app %s: %s", event, appId, err)
+	}
+}
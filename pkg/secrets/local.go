@@ -0,0 +1,248 @@
+package secrets
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// keyFile is the on-disk layout of the local key ring. Older keys are kept so
+// that envelopes wrapped with them can still be opened until they are rewrapped.
+type keyFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// localKeyProvider holds the key ring of a key file. The file is read again when it
+// changes, so that running processes pick up the keys rotate_keys adds.
+type localKeyProvider struct {
+	path    string
+	mu      sync.RWMutex
+	keys    keyFile
+	modTime time.Time // Of the key file when it was last read
+}
+
+// NewLocalKeyProvider loads the key ring at path. The file must exist: a process that
+// made its own key would seal data that no other process can open, so key files are
+// only created by rotate_keys -init.
+func NewLocalKeyProvider(path string) (*localKeyProvider, error) {
+	l := &localKeyProvider{path: path}
+
+	err := l.load()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("key file %s does not exist, create it with rotate_keys -init", path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// CreateLocalKeyProvider creates a key ring at path with a fresh primary key. It fails if
+// the file exists.
+func CreateLocalKeyProvider(path string) (*localKeyProvider, error) {
+	l := &localKeyProvider{path: path, keys: keyFile{Keys: map[string][]byte{}}}
+
+	keyID, key, err := newKey()
+	if err != nil {
+		return nil, err
+	}
+	l.keys.Keys[keyID] = key
+	l.keys.Primary = keyID
+
+	err = l.write(true)
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// load reads the key ring from the key file
+func (l *localKeyProvider) load() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	keys := keyFile{}
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return fmt.Errorf("unable to parse key file %s: %w", l.path, err)
+	}
+
+	if _, ok := keys.Keys[keys.Primary]; !ok {
+		return fmt.Errorf("key file %s has no primary key", l.path)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys, l.modTime = keys, info.ModTime()
+
+	return nil
+}
+
+// refresh reads the key file again if it changed since it was read, or regardless when
+// force is set. The keys already loaded are kept if it cannot be read.
+func (l *localKeyProvider) refresh(force bool) {
+	if !force {
+		info, err := os.Stat(l.path)
+		if err != nil {
+			log.Printf("Unable to check key file %s, keeping the loaded keys: %s", l.path, err)
+			return
+		}
+
+		l.mu.RLock()
+		unchanged := info.ModTime().Equal(l.modTime)
+		l.mu.RUnlock()
+		if unchanged {
+			return
+		}
+	}
+
+	err := l.load()
+	if err != nil {
+		log.Printf("Unable to reload key file %s, keeping the loaded keys: %s", l.path, err)
+	}
+}
+
+// write saves the key ring. The file is replaced in one step, so that processes reading
+// it never see it half written. With create set, it fails if the file exists.
+func (l *localKeyProvider) write(create bool) error {
+	data, err := json.MarshalIndent(l.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".keys-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if create {
+		// Unlike a rename, a link does not replace an existing file
+		err = os.Link(tmp.Name(), l.path)
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("key file %s already exists", l.path)
+		}
+	} else {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	l.modTime = info.ModTime()
+
+	return nil
+}
+
+func newKey() (string, []byte, error) {
+	key := make([]byte, dekSize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", nil, err
+	}
+	return fmt.Sprintf("local-%d", time.Now().UnixNano()), key, nil
+}
+
+func (l *localKeyProvider) PrimaryKeyID() string {
+	l.refresh(false)
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.keys.Primary
+}
+
+// AddKey generates a new key, makes it the primary key and persists the key ring.
+func (l *localKeyProvider) AddKey() (string, error) {
+	keyID, key, err := newKey()
+	if err != nil {
+		return "", err
+	}
+
+	l.refresh(false)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.keys.Keys[keyID] = key
+	l.keys.Primary = keyID
+
+	err = l.write(false)
+	if err != nil {
+		return "", err
+	}
+
+	return keyID, nil
+}
+
+func (l *localKeyProvider) WrapKey(ctx context.Context, dek []byte) (string, []byte, error) {
+	l.refresh(false)
+
+	l.mu.RLock()
+	keyID := l.keys.Primary
+	kek := l.keys.Keys[keyID]
+	l.mu.RUnlock()
+
+	nonce, ciphertext, err := encrypt(kek, dek)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return keyID, append(nonce, ciphertext...), nil
+}
+
+func (l *localKeyProvider) UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	l.refresh(false)
+	kek, ok := l.key(keyID)
+	if !ok {
+		// The key may have been added within the resolution of the file's modification time
+		l.refresh(true)
+		kek, ok = l.key(keyID)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", keyID)
+	}
+
+	// The nonce is stored in front of the wrapped key
+	const nonceSize = 12
+	if len(wrapped) < nonceSize {
+		return nil, ErrInvalidEnvelope
+	}
+
+	return decrypt(kek, wrapped[:nonceSize], wrapped[nonceSize:])
+}
+
+func (l *localKeyProvider) key(keyID string) ([]byte, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	kek, ok := l.keys.Keys[keyID]
+	return kek, ok
+}
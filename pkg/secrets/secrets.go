@@ -0,0 +1,136 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+// KeyProvider wraps and unwraps data encryption keys with a key encryption key it holds.
+// The local key file provider implements it, and KMS-style providers can implement it
+// by delegating WrapKey/UnwrapKey to their encrypt/decrypt calls.
+type KeyProvider interface {
+	PrimaryKeyID() string
+	WrapKey(ctx context.Context, dek []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Envelope is a secret encrypted with its own data encryption key, which is in turn
+// wrapped by the key encryption key identified by KeyID.
+type Envelope struct {
+	KeyID      string `bson:"keyId" json:"-"`
+	WrappedKey []byte `bson:"wrappedKey" json:"-"`
+	Nonce      []byte `bson:"nonce" json:"-"`
+	Ciphertext []byte `bson:"ciphertext" json:"-"`
+}
+
+var ErrInvalidEnvelope = errors.New("invalid secret envelope")
+
+const dekSize = 32
+
+func Seal(ctx context.Context, keys KeyProvider, plaintext string) (*Envelope, error) {
+	dek := make([]byte, dekSize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext, err := encrypt(dek, []byte(plaintext))
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := keys.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+func Open(ctx context.Context, keys KeyProvider, env *Envelope) (string, error) {
+	if env == nil {
+		return "", ErrInvalidEnvelope
+	}
+
+	dek, err := keys.UnwrapKey(ctx, env.KeyID, env.WrappedKey)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := decrypt(dek, env.Nonce, env.Ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// Rewrap re-encrypts the data encryption key of env with the provider's primary key.
+// The secret itself is never decrypted.
+func Rewrap(ctx context.Context, keys KeyProvider, env *Envelope) (*Envelope, error) {
+	if env == nil {
+		return nil, ErrInvalidEnvelope
+	}
+
+	dek, err := keys.UnwrapKey(ctx, env.KeyID, env.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := keys.WrapKey(ctx, dek)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		KeyID:      keyID,
+		WrappedKey: wrapped,
+		Nonce:      env.Nonce,
+		Ciphertext: env.Ciphertext,
+	}, nil
+}
+
+func encrypt(key, plaintext []byte) (nonce []byte, ciphertext []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, gcm.Seal(nil, nonce, plaintext, nil), nil
+}
+
+func decrypt(key, nonce, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) != gcm.NonceSize() {
+		return nil, ErrInvalidEnvelope
+	}
+
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -3,31 +3,64 @@ package storage
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"umami/pkg/utils"
 
 	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
 )
 
 type gcs struct {
-	client *storage.Client
+	client   *storage.Client
+	location string
 }
 
-func NewGCS(ctx context.Context) (*gcs, error) {
+// NewGCS connects to Cloud Storage. Buckets are created in location, such as us-central1.
+func NewGCS(ctx context.Context, location string) (*gcs, error) {
 	client, err := storage.NewClient(ctx)
 	if err != nil {
 		return nil, err
 	}
 
 	return &gcs{
-		client: client,
+		client:   client,
+		location: location,
 	}, nil
 }
 
+// Ping checks that the project's buckets can be listed
+func (g *gcs) Ping(ctx context.Context) error {
+	_, err := g.client.Buckets(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT")).Next()
+	if err == iterator.Done {
+		return nil
+	}
+	return err
+}
+
+func bucketName(name string) string {
+	return fmt.Sprintf("umami-bucket-%s", utils.GetName(name))
+}
+
 func (g *gcs) CreateBucket(ctx context.Context, name string) error {
-	bucketName := fmt.Sprintf("umami-bucket-%s", utils.GetName(name))
-	err := g.client.Bucket(bucketName).Create(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"), &storage.BucketAttrs{
-		Location: "us-central1",
+	err := g.client.Bucket(bucketName(name)).Create(ctx, os.Getenv("GOOGLE_CLOUD_PROJECT"), &storage.BucketAttrs{
+		Location: g.location,
 	})
 	return err
 }
+
+func (g *gcs) PutObject(ctx context.Context, name string, object string, r io.Reader) error {
+	w := g.client.Bucket(bucketName(name)).Object(object).NewWriter(ctx)
+
+	_, err := io.Copy(w, r)
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+func (g *gcs) GetObject(ctx context.Context, name string, object string) (io.ReadCloser, error) {
+	return g.client.Bucket(bucketName(name)).Object(object).NewReader(ctx)
+}
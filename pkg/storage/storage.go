@@ -1,7 +1,12 @@
 package storage
 
-import "context"
+import (
+	"context"
+	"io"
+)
 
 type Storage interface {
 	CreateBucket(ctx context.Context, name string) error
+	PutObject(ctx context.Context, name string, object string, r io.Reader) error     // Write an object to the bucket of the app called name
+	GetObject(ctx context.Context, name string, object string) (io.ReadCloser, error) // Read an object from the bucket of the app called name
 }
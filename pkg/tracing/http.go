@@ -0,0 +1,29 @@
+package tracing
+
+import (
+	"net/http"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// Handler starts a span for each request served by next, continuing the trace of the
+// caller when it sends one. Spans are named after the pattern of router the request
+// matches, rather than its path. Metrics scrapes are not traced.
+func Handler(router *http.ServeMux, next http.Handler) http.Handler {
+	return otelhttp.NewHandler(next, "http.request",
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			_, route := router.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			if !strings.Contains(route, " ") {
+				route = r.Method + " " + route
+			}
+			return route
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return r.URL.Path != "/metrics"
+		}),
+	)
+}
@@ -0,0 +1,93 @@
+package transcript
+
+import (
+	"html/template"
+	"io"
+	"strings"
+)
+
+type htmlDiffLine struct {
+	Class string
+	Text  string
+}
+
+var htmlTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"summary":   toolSummary,
+	"inputJSON": toolInputJSON,
+	"diffLines": func(d string) []htmlDiffLine {
+		lines := []htmlDiffLine{}
+		for _, l := range strings.Split(strings.TrimRight(d, "\n"), "\n") {
+			class := ""
+			switch {
+			case strings.HasPrefix(l, "+++"), strings.HasPrefix(l, "---"):
+				class = "file"
+			case strings.HasPrefix(l, "@@"):
+				class = "hunk"
+			case strings.HasPrefix(l, "+"):
+				class = "add"
+			case strings.HasPrefix(l, "-"):
+				class = "del"
+			}
+			lines = append(lines, htmlDiffLine{Class: class, Text: l})
+		}
+		return lines
+	},
+	"entries":   entries,
+	"orDefault": orDefault,
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", sans-serif; max-width: 960px; margin: 2rem auto; padding: 0 1rem; color: #1e293b; line-height: 1.5; }
+h2 { border-bottom: 1px solid #e2e8f0; padding-bottom: .25rem; margin-top: 2.5rem; }
+.meta { color: #64748b; font-size: .875rem; }
+blockquote { border-left: 3px solid #cbd5e1; margin: 1rem 0; padding-left: 1rem; color: #475569; white-space: pre-wrap; }
+.text { white-space: pre-wrap; margin: 1rem 0; }
+details { background: #f8fafc; border: 1px solid #e2e8f0; border-radius: 6px; margin: .5rem 0; padding: .25rem .75rem; }
+summary { cursor: pointer; font-family: ui-monospace, monospace; font-size: .875rem; }
+.error summary { color: #b91c1c; }
+pre { background: #0f172a; color: #e2e8f0; padding: .75rem; border-radius: 6px; overflow-x: auto; font-size: .8125rem; }
+pre.diff { background: #fff; color: #1e293b; border: 1px solid #e2e8f0; }
+.diff span { display: block; }
+.diff .add { background: #dcfce7; }
+.diff .del { background: #fee2e2; }
+.diff .hunk { color: #7c3aed; }
+.diff .file { font-weight: bold; }
+.result { font-weight: bold; margin: 1rem 0; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{range .Tasks}}
+<h2>{{orDefault .Task.Title "Untitled task"}}</h2>
+<div class="meta">{{.Task.Status}} · {{.Task.Created.Format "2006-01-02 15:04:05 MST"}}{{with .Task.Usage}} · {{.InputTokens}} tokens in, {{.OutputTokens}} out, ${{printf "%.4f" .CostUSD}}{{end}}</div>
+{{with .Task.Description}}<blockquote>{{.}}</blockquote>{{end}}
+{{range entries .Events}}
+{{- with .Call}}
+<details{{if .IsError}} class="error"{{end}}><summary>{{summary .}}{{if .IsError}} (error){{end}}</summary>
+<pre>{{inputJSON .}}</pre>
+{{with .Result}}<pre>{{.}}</pre>{{end}}
+</details>
+{{with .Diff}}<pre class="diff">{{range diffLines .}}<span class="{{.Class}}">{{.Text}}</span>{{end}}</pre>{{end}}
+{{- end}}
+{{- with .Event}}
+{{- if eq .Kind "text"}}<div class="text">{{.Text}}</div>
+{{- else if eq .Kind "thinking"}}<details><summary>Thinking</summary><div class="text">{{.Text}}</div></details>
+{{- else if eq .Kind "result"}}<div class="result">{{if .IsError}}Failed{{else}}Completed{{end}} ({{.Subtype}})</div>
+{{- else if eq .Kind "raw"}}<pre>{{.Text}}</pre>
+{{- end}}
+{{- end}}
+{{end}}
+{{end}}
+</body>
+</html>
+`))
+
+func writeHTML(w io.Writer, title string, tasks []Task) error {
+	return htmlTemplate.Execute(w, struct {
+		Title string
+		Tasks []Task
+	}{title, tasks})
+}
@@ -0,0 +1,96 @@
+package transcript
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"umami/pkg/db"
+)
+
+func writeMarkdown(w io.Writer, title string, tasks []Task) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	for _, t := range tasks {
+		fmt.Fprintf(&b, "## %s\n\n", orDefault(t.Task.Title, "Untitled task"))
+		fmt.Fprintf(&b, "- Status: %s\n- Created: %s\n", t.Task.Status, t.Task.Created.Format(time.RFC3339))
+		if t.Task.Usage != nil {
+			fmt.Fprintf(&b, "- Tokens: %d in, %d out, cost $%.4f\n", t.Task.Usage.InputTokens, t.Task.Usage.OutputTokens, t.Task.Usage.CostUSD)
+		}
+		b.WriteString("\n")
+		if t.Task.Description != "" {
+			fmt.Fprintf(&b, "%s\n\n", quote(t.Task.Description))
+		}
+
+		for _, en := range entries(t.Events) {
+			if en.Call != nil {
+				writeMarkdownToolCall(&b, en.Call)
+				continue
+			}
+			writeMarkdownEvent(&b, en.Event)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeMarkdownEvent(b *strings.Builder, e *db.Event) {
+	switch e.Kind {
+	case db.EventKindText:
+		fmt.Fprintf(b, "%s\n\n", e.Text)
+	case db.EventKindThinking:
+		fmt.Fprintf(b, "<details><summary>Thinking</summary>\n\n%s\n\n</details>\n\n", e.Text)
+	case db.EventKindResult:
+		outcome := "Completed"
+		if e.IsError {
+			outcome = "Failed"
+		}
+		fmt.Fprintf(b, "**%s** (%s)\n\n", outcome, e.Subtype)
+	case db.EventKindRaw:
+		fmt.Fprintf(b, "%s\n\n", fence("", e.Text))
+	}
+}
+
+func writeMarkdownToolCall(b *strings.Builder, c *db.ToolCall) {
+	status := ""
+	if c.IsError {
+		status = " (error)"
+	}
+	fmt.Fprintf(b, "<details><summary>Tool: %s%s</summary>\n\n", escapeSummary(toolSummary(c)), status)
+	fmt.Fprintf(b, "%s\n\n", fence("json", toolInputJSON(c)))
+	if c.Result != "" {
+		fmt.Fprintf(b, "Result:\n\n%s\n\n", fence("", c.Result))
+	}
+	b.WriteString("</details>\n\n")
+
+	// Diffs stay visible so reviewers can follow the changes without unfolding every call
+	if c.Diff != "" {
+		fmt.Fprintf(b, "%s\n\n", fence("diff", c.Diff))
+	}
+}
+
+// fence wraps s in a code fence longer than any backtick run inside it
+func fence(lang, s string) string {
+	ticks := "```"
+	for strings.Contains(s, ticks) {
+		ticks += "`"
+	}
+	return fmt.Sprintf("%s%s\n%s\n%s", ticks, lang, strings.TrimRight(s, "\n"), ticks)
+}
+
+func quote(s string) string {
+	return "> " + strings.ReplaceAll(strings.TrimRight(s, "\n"), "\n", "\n> ")
+}
+
+func escapeSummary(s string) string {
+	return strings.NewReplacer("<", "&lt;", ">", "&gt;", "&", "&amp;").Replace(s)
+}
+
+func orDefault(s, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
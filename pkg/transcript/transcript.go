@@ -0,0 +1,115 @@
+package transcript
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"umami/pkg/db"
+)
+
+const (
+	FormatJSONL    = "jsonl"
+	FormatMarkdown = "markdown"
+	FormatHTML     = "html"
+)
+
+// ContentTypes maps each format to the media type it is served as
+var ContentTypes = map[string]string{
+	FormatJSONL:    "application/x-ndjson",
+	FormatMarkdown: "text/markdown; charset=utf-8",
+	FormatHTML:     "text/html; charset=utf-8",
+}
+
+var Extensions = map[string]string{
+	FormatJSONL:    "jsonl",
+	FormatMarkdown: "md",
+	FormatHTML:     "html",
+}
+
+// Task is a task together with its events, in sequence order
+type Task struct {
+	Task   *db.Task
+	Events []*db.Event
+}
+
+// entry is a step of a transcript: either a standalone event or a tool call folded
+// together with its result
+type entry struct {
+	Event *db.Event
+	Call  *db.ToolCall
+}
+
+func entries(events []*db.Event) []entry {
+	calls := map[string]*db.ToolCall{}
+	for _, c := range db.PairToolCalls(events) {
+		calls[c.ToolUseID] = c
+	}
+
+	result := []entry{}
+	for _, e := range events {
+		switch e.Kind {
+		case db.EventKindToolUse:
+			if c, ok := calls[e.ToolUseID]; ok {
+				result = append(result, entry{Call: c})
+				continue
+			}
+		case db.EventKindToolResult:
+			// Shown with its tool use
+			if _, ok := calls[e.ToolUseID]; ok {
+				continue
+			}
+		}
+		result = append(result, entry{Event: e})
+	}
+	return result
+}
+
+// Write renders the transcript of tasks in format to w
+func Write(w io.Writer, format string, title string, tasks []Task) error {
+	switch format {
+	case FormatJSONL:
+		return writeJSONL(w, tasks)
+	case FormatMarkdown:
+		return writeMarkdown(w, title, tasks)
+	case FormatHTML:
+		return writeHTML(w, title, tasks)
+	}
+	return fmt.Errorf("unknown transcript format %s", format)
+}
+
+func writeJSONL(w io.Writer, tasks []Task) error {
+	encoder := json.NewEncoder(w)
+	for _, t := range tasks {
+		for _, e := range t.Events {
+			if err := encoder.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func toolSummary(c *db.ToolCall) string {
+	summary := c.ToolName
+	if c.FilePath != "" {
+		return summary + " " + c.FilePath
+	}
+	for _, key := range []string{"command", "pattern", "path", "url", "description"} {
+		if v, ok := c.ToolInput[key].(string); ok && v != "" {
+			if len(v) > 80 {
+				v = v[:80] + "…"
+			}
+			return summary + " " + strings.ReplaceAll(v, "\n", " ")
+		}
+	}
+	return summary
+}
+
+func toolInputJSON(c *db.ToolCall) string {
+	data, err := json.MarshalIndent(c.ToolInput, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
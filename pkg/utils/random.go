@@ -1,13 +1,22 @@
 package utils
 
-import "math/rand"
+import (
+	"crypto/rand"
+	"math/big"
+)
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890"
 
+// RandStringBytes returns a random string of length n drawn from a CSPRNG, suitable for credentials.
 func RandStringBytes(n int) string {
 	b := make([]byte, n)
+	max := big.NewInt(int64(len(letterBytes)))
 	for i := range b {
-		b[i] = letterBytes[rand.Intn(len(letterBytes))]
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = letterBytes[idx.Int64()]
 	}
 	return string(b)
 }
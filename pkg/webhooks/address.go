@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+)
+
+// ErrBlockedAddress is returned for endpoints on loopback, private, link-local and other
+// internal addresses. Webhooks would otherwise let anyone who can create one make requests
+// into the network the control plane runs in.
+var ErrBlockedAddress = errors.New("webhook endpoint resolves to a blocked address")
+
+// sharedAddressSpace is the carrier-grade NAT range, which cloud providers also use for
+// internal services such as metadata endpoints
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// AddressPolicy decides which addresses webhooks may be sent to. Internal addresses are
+// blocked unless they are in one of the allowed networks, such as 127.0.0.0/8 to try
+// webhooks out against a local listener.
+type AddressPolicy struct {
+	allowed []netip.Prefix
+}
+
+// NewAddressPolicy returns the policy allowing the comma-separated CIDRs in allowedNetworks
+// on top of every public address. An empty string allows no internal address.
+func NewAddressPolicy(allowedNetworks string) (*AddressPolicy, error) {
+	p := &AddressPolicy{}
+	for _, cidr := range strings.Split(allowedNetworks, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed network %q: %w", cidr, err)
+		}
+		p.allowed = append(p.allowed, prefix.Masked())
+	}
+	return p, nil
+}
+
+// Blocked reports whether webhooks must not be sent to addr. The cloud metadata
+// endpoints are link-local (169.254.169.254) or private (fd00:ec2::254) addresses.
+func (p *AddressPolicy) Blocked(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+
+	return !addr.IsValid() ||
+		addr.IsLoopback() ||
+		addr.IsPrivate() ||
+		addr.IsLinkLocalUnicast() ||
+		addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() ||
+		addr.IsMulticast() ||
+		addr.IsUnspecified() ||
+		sharedAddressSpace.Contains(addr)
+}
+
+// CheckURL resolves the host of a webhook endpoint and returns ErrBlockedAddress if any of
+// its addresses is blocked. Deliveries check the address they connect to again, as the
+// host may resolve differently by then.
+func (p *AddressPolicy) CheckURL(ctx context.Context, rawURL string) error {
+	endpoint, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := endpoint.Hostname()
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if p.Blocked(addr) {
+			return ErrBlockedAddress
+		}
+		return nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve %s: %w", host, err)
+	}
+	for _, addr := range addrs {
+		if p.Blocked(addr) {
+			return ErrBlockedAddress
+		}
+	}
+
+	return nil
+}
+
+// checkDialAddress refuses connections to blocked addresses. It runs once the host has
+// been resolved, so a host that resolves to a public address when the webhook is created
+// cannot be pointed at an internal one later.
+func (p *AddressPolicy) checkDialAddress(network, address string, c syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if p.Blocked(addrPort.Addr()) {
+		return ErrBlockedAddress
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+	"umami/pkg/db"
+	"umami/pkg/secrets"
+)
+
+// MaxAttempts is how many times a delivery is tried before it is marked failed
+const MaxAttempts = 8
+
+const (
+	firstRetryDelay  = 30 * time.Second
+	maxRetryDelay    = time.Hour
+	deliveryTimeout  = 10 * time.Second
+	deliveryLease    = time.Minute // Longer than deliveryTimeout so a claimed delivery is not sent twice
+	maxResponseBytes = 1024
+	userAgent        = "umami-webhooks/1"
+)
+
+// Backoff returns how long to wait after the given failed attempt, counted from one,
+// before the next: 30s, 1m, 2m, and so on up to an hour.
+func Backoff(attempt int) time.Duration {
+	delay := firstRetryDelay
+	for i := 1; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRetryDelay)
+}
+
+// Deliverer sends the queued deliveries and records each attempt
+type Deliverer struct {
+	dbConn db.DB
+	keys   secrets.KeyProvider
+	client *http.Client
+}
+
+// NewDeliverer returns a deliverer that only connects to the addresses policy allows
+func NewDeliverer(dbConn db.DB, keys secrets.KeyProvider, policy *AddressPolicy) *Deliverer {
+	return &Deliverer{
+		dbConn: dbConn,
+		keys:   keys,
+		client: &http.Client{
+			Timeout: deliveryTimeout,
+			// Without a proxy, so that the address checked is the one the payload is sent to
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{
+					Timeout: deliveryTimeout,
+					Control: policy.checkDialAddress,
+				}).DialContext,
+				TLSHandshakeTimeout: deliveryTimeout,
+				IdleConnTimeout:     90 * time.Second,
+				MaxIdleConns:        100,
+				ForceAttemptHTTP2:   true,
+			},
+			// A redirect counts as a failed attempt rather than sending the payload elsewhere
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Run sends every delivery that is due, checking every interval, until ctx is done
+func (d *Deliverer) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for {
+			delivery, err := d.dbConn.ClaimWebhookDelivery(ctx, deliveryLease)
+			if errors.Is(err, db.ErrNotFound) {
+				break
+			}
+			if err != nil {
+				log.Printf("Webhooks unable to claim a delivery %s", err)
+				break
+			}
+
+			err = d.Deliver(ctx, delivery)
+			if err != nil {
+				log.Printf("Unable to deliver webhook delivery %s: %s", delivery.Id.Hex(), err)
+			}
+		}
+	}
+}
+
+// Deliver makes one attempt at a delivery and records its outcome. The returned error is
+// only set when the attempt could not be recorded; a failed attempt is rescheduled.
+func (d *Deliverer) Deliver(ctx context.Context, delivery *db.WebhookDelivery) error {
+	hook, err := d.dbConn.GetWebhook(ctx, delivery.WebhookId.Hex())
+	if errors.Is(err, db.ErrNotFound) {
+		// The webhook was deleted after the delivery was claimed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	attempt := d.send(ctx, hook, delivery)
+
+	status, nextAttempt := db.WebhookDeliverySucceeded, time.Time{}
+	if attempt.Error != "" {
+		attempts := len(delivery.Attempts) + 1
+		if attempts >= MaxAttempts {
+			status = db.WebhookDeliveryFailed
+		} else {
+			status, nextAttempt = db.WebhookDeliveryPending, time.Now().Add(Backoff(attempts))
+		}
+	}
+
+	return d.dbConn.RecordWebhookAttempt(ctx, delivery.Id.Hex(), attempt, status, nextAttempt)
+}
+
+// send posts the payload to the webhook. The attempt failed when its Error is set.
+func (d *Deliverer) send(ctx context.Context, hook *db.Webhook, delivery *db.WebhookDelivery) db.WebhookAttempt {
+	started := time.Now()
+	attempt := db.WebhookAttempt{Time: started.UTC()}
+
+	secret, err := secrets.Open(ctx, d.keys, hook.Secret)
+	if err != nil {
+		attempt.Error = fmt.Sprintf("unable to decrypt webhook secret: %s", err)
+		return attempt
+	}
+
+	body := []byte(delivery.Payload)
+	timestamp := started.Unix()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.Id.Hex())
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	attempt.DurationMs = int(time.Since(started).Milliseconds())
+	if errors.Is(err, ErrBlockedAddress) {
+		// Without the address, which would tell the webhook's owner about the internal network
+		attempt.Error = ErrBlockedAddress.Error()
+		return attempt
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+
+	response, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	attempt.StatusCode = resp.StatusCode
+	attempt.Response = string(bytes.ToValidUTF8(response, nil))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint responded %s", resp.Status)
+	}
+
+	return attempt
+}
@@ -0,0 +1,55 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const HeaderEvent = "X-Umami-Event"
+const HeaderDelivery = "X-Umami-Delivery"
+const HeaderTimestamp = "X-Umami-Timestamp" // Unix seconds when the attempt was signed
+const HeaderSignature = "X-Umami-Signature" // "sha256=" and the hex HMAC-SHA256 of the timestamp, a dot and the body
+
+const signaturePrefix = "sha256="
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+var ErrStaleTimestamp = errors.New("webhook timestamp outside tolerance")
+
+// Sign returns the signature header value for a body sent at timestamp. The timestamp is
+// signed too, so a captured delivery cannot be replayed later with a new one.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the timestamp and signature headers of a delivery against its body.
+// Receivers should reject deliveries older than tolerance; zero skips that check.
+func Verify(secret string, timestamp string, signature string, body []byte, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(Sign(secret, ts, body)), []byte(signature)) {
+		return ErrInvalidSignature
+	}
+
+	if tolerance > 0 {
+		age := time.Since(time.Unix(ts, 0))
+		if age > tolerance || age < -tolerance {
+			return ErrStaleTimestamp
+		}
+	}
+
+	return nil
+}
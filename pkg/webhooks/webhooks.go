@@ -0,0 +1,105 @@
+package webhooks
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+	"umami/pkg/db"
+
+	"github.com/google/uuid"
+)
+
+// Secrets carry a prefix so they can be told apart from API tokens and spotted by secret scanners
+const secretPrefix = "whsec_"
+
+const secretBytes = 32
+
+// Payload is the body of every delivery. Id names the event, so a receiver can recognise
+// a redelivery of an event it already handled.
+type Payload struct {
+	Id    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	AppId string    `json:"appId,omitempty"`
+	Data  any       `json:"data"`
+}
+
+// TaskData is the data of task events
+type TaskData struct {
+	Task  *db.Task `json:"task"`
+	Error string   `json:"error,omitempty"` // Why the task failed
+}
+
+// AppData is the data of app events
+type AppData struct {
+	App *db.App `json:"app"`
+}
+
+// NewSecret returns a new random signing secret for a webhook
+func NewSecret() (string, error) {
+	b := make([]byte, secretBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return secretPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// NewPayload returns the request body for an event
+func NewPayload(event string, appId string, data any) (string, error) {
+	body, err := json.Marshal(Payload{
+		Id:    uuid.New().String(),
+		Event: event,
+		Time:  time.Now().UTC(),
+		AppId: appId,
+		Data:  data,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// Emit queues a delivery of the event to every webhook of the app, and every global
+// webhook, subscribed to it. The deliveries are sent by a Deliverer, so Emit only needs
+// the database and can be called from any process.
+func Emit(ctx context.Context, dbConn db.DB, event string, appId string, data any) error {
+	hooks, err := dbConn.GetWebhooksForEvent(ctx, appId, event)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	payload, err := NewPayload(event, appId, data)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		_, err = Enqueue(ctx, dbConn, hook, event, payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Enqueue queues a single delivery of payload to hook, due now
+func Enqueue(ctx context.Context, dbConn db.DB, hook *db.Webhook, event string, payload string) (string, error) {
+	now := time.Now()
+	return dbConn.CreateWebhookDelivery(ctx, &db.WebhookDelivery{
+		WebhookId:   hook.Id,
+		Event:       event,
+		Payload:     payload,
+		Status:      db.WebhookDeliveryPending,
+		NextAttempt: now,
+		Created:     now,
+	})
+}
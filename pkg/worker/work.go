@@ -7,17 +7,50 @@ import (
 	"log"
 	"os"
 	"os/exec"
-	"path"
+	"time"
+	"umami/pkg/apps"
 	"umami/pkg/db"
-	"umami/pkg/utils"
+	"umami/pkg/metrics"
+	"umami/pkg/secrets"
+	"umami/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	agentRuns        = metrics.NewCounter("umami_agent_runs_total", "Agent runs that ended, by outcome: success, failure or cancelled.", "outcome")
+	agentRunDuration = metrics.NewHistogram("umami_agent_run_duration_seconds", "How long agent runs took, by outcome.", metrics.RunBuckets, "outcome")
+	agentRunsActive  = metrics.NewGauge("umami_agent_runs_active", "Agents running now.")
 )
 
 type Work struct {
 	Task *db.Task
 	App  *db.App
+	Dir  string // The app's repository, where the agent runs
+	Keys secrets.KeyProvider
 }
 
-func (w *Work) Execute(ctx context.Context, logWriter io.Writer) error {
+// Env returns the environment the agent runs with
+func (w *Work) Env(ctx context.Context) ([]string, error) {
+	appEnv, err := apps.Env(ctx, w.App, w.Keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]string{
+		fmt.Sprintf("ANTHROPIC_API_KEY=%s", os.Getenv("ANTHROPIC_API_KEY")),
+	}, appEnv...), nil
+}
+
+// Execute runs the agent on the task with env, as returned by Env
+func (w *Work) Execute(ctx context.Context, env []string, logWriter io.Writer) (err error) {
+	ctx, span := tracing.Tracer.Start(ctx, "agent.execute", trace.WithAttributes(
+		attribute.String("task.id", w.Task.Id.Hex()),
+		attribute.String("app.id", w.Task.AppId.Hex()),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// Start a new sub process
 	systemInstruction := `The app you generate will be spun up programmatically by the platform that manages these apps. Please ensure that
 							you create a run.sh file in the project route with steps that run the web application or the API server. The port will be
@@ -25,22 +58,32 @@ func (w *Work) Execute(ctx context.Context, logWriter io.Writer) error {
 							not exist, else update it as necessary.`
 	taskBrief := fmt.Sprintf("Important Instructions\n%s\nTask Title: %s\n Task Description:%s", systemInstruction, w.Task.Title, w.Task.Description)
 	cmd := exec.CommandContext(ctx, "claude", "-p", "--verbose", "--output-format", "stream-json", "--dangerously-skip-permissions", taskBrief)
-	cmd.Env = []string{
-		fmt.Sprintf("ANTHROPIC_API_KEY=%s", os.Getenv("ANTHROPIC_API_KEY")),
-		fmt.Sprintf("MONGO_CONNECTION_STRING=mongodb://%s:%s@localhost:27017", w.App.User, w.App.Password),
-		fmt.Sprintf("MONGO_DB_NAME=%s", w.App.Database),
-		fmt.Sprintf("APP_BUCKET_NAME=%s", fmt.Sprintf("umami-bucket-%s", utils.GetName(w.App.Name))),
-	}
-	cmd.Dir = path.Join(".", "repository", w.App.Id.Hex())
+	cmd.Env = env
+	cmd.Dir = w.Dir
 
 	// cmd.SysProcAttr = &syscall.SysProcAttr{
-	// 	Chroot: path.Join(".", "repository", w.App.Id.Hex()),
+	// 	Chroot: w.Dir,
 	// }
 	cmd.Stdout = logWriter
 	cmd.Stderr = os.Stderr
 
 	log.Printf("Executing task: with claude %s", w.Task.Title)
-	err := cmd.Run()
+	agentRunsActive.Inc()
+	started := time.Now()
+	err = cmd.Run()
+	agentRunsActive.Dec()
+
+	outcome := "success"
+	switch {
+	case ctx.Err() != nil:
+		outcome = "cancelled"
+	case err != nil:
+		outcome = "failure"
+	}
+	agentRuns.Inc(outcome)
+	agentRunDuration.Observe(time.Since(started).Seconds(), outcome)
+	span.SetAttributes(attribute.String("outcome", outcome), attribute.Int("exit_code", cmd.ProcessState.ExitCode()))
+
 	if err != nil {
 		return err
 	}
@@ -22,13 +22,22 @@ interface Task {
   completedDate: string;
 }
 
+interface LogMessage {
+  time: string;
+  title: string;
+  text: string;
+}
+
 interface Log {
   taskID: string;
-  messages: {
-    time: string;
-    title: string;
-    text: string;
-  }[]
+  eventCount: number;
+  messages: LogMessage[]
+}
+
+// One event of the log stream, identified by its sequence number
+interface LogStreamMessage {
+  id: number;
+  message?: LogMessage;
 }
 
 const colors = ["from-purple-500 to-pink-500", "from-blue-500 to-cyan-500", "from-green-500 to-emerald-500"]
@@ -87,8 +96,8 @@ const UmamiApp = () => {
       const data: Log = await response.json();
       setLogs(data);
 
-      // Start the log stream
-      const ws = new WebSocket(`ws://${location.host}/api/v1/apps/${selectedApp?.id}/tasks/${taskId}/logs/ws`);
+      // Stream the events after those already fetched
+      const ws = new WebSocket(`ws://${location.host}/api/v1/apps/${selectedApp?.id}/tasks/${taskId}/logs/ws?after=${data.eventCount}`);
       ws.onerror = function(e) {
         console.error(`Error in websocket connection ${e}`)
       }
@@ -99,8 +108,12 @@ const UmamiApp = () => {
         console.log('Socket closed')
       }
       ws.onmessage = function(message) {
-        const data: Log = JSON.parse(message.data);
-        setLogs(data);
+        const data: LogStreamMessage = JSON.parse(message.data);
+        const logMessage = data.message;
+        if (!logMessage) {
+          return;
+        }
+        setLogs((logs) => logs && { ...logs, eventCount: data.id, messages: [...logs.messages, logMessage] });
       }
     } catch (error) {
       console.error('Error fetching logs:', error);